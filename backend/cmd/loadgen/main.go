@@ -0,0 +1,342 @@
+// loadgenコマンド: 同期サーバーに負荷をかけ、ブロードキャストの遅延と欠落を計測する
+// roomごとにN個のYjsクライアントを接続し、ノードの追加・移動（Y.Mapへの書き込み）と
+// カーソル位置のawarenessを送り続ける。他のクライアントに届くまでの時間と、届かなかった
+// updateの割合を集計して表示する。
+//
+//	./loadgen [--url ws://localhost:8080] [--rooms 1] [--clients 10] [--rate 2] [--duration 30s]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// options コマンドラインの設定
+type options struct {
+	url        string
+	roomPrefix string
+	rooms      int
+	clients    int
+	rate       float64
+	nodes      int
+	awareness  bool
+	duration   time.Duration
+	drain      time.Duration
+	token      string
+}
+
+// sentUpdate 送信したupdateと、届くべきクライアント数
+type sentUpdate struct {
+	at       time.Time
+	expected int
+}
+
+// stats 計測結果（全クライアントで共有）
+type stats struct {
+	connected  atomic.Int64
+	failed     atomic.Int64
+	disconnect atomic.Int64
+	sent       atomic.Int64
+	expected   atomic.Int64
+	received   atomic.Int64
+	bytesSent  atomic.Int64
+
+	mutex     sync.Mutex
+	pending   map[itemID]sentUpdate
+	latencies []time.Duration
+}
+
+// recordSent 送信したupdateを記録する
+func (s *stats) recordSent(id itemID, peers int, size int) {
+	s.mutex.Lock()
+	s.pending[id] = sentUpdate{at: time.Now(), expected: peers}
+	s.mutex.Unlock()
+	s.sent.Add(1)
+	s.expected.Add(int64(peers))
+	s.bytesSent.Add(int64(size))
+}
+
+// recordReceived 他のクライアントのupdateを受信したことを記録する
+func (s *stats) recordReceived(client, clock, n uint64) {
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := uint64(0); i < n; i++ {
+		id := itemID{client: client, clock: clock + i}
+		sent, ok := s.pending[id]
+		if !ok {
+			continue
+		}
+		s.latencies = append(s.latencies, now.Sub(sent.at))
+		s.received.Add(1)
+		if sent.expected--; sent.expected <= 0 {
+			delete(s.pending, id)
+		} else {
+			s.pending[id] = sent
+		}
+	}
+}
+
+func main() {
+	var opts options
+	flag.StringVar(&opts.url, "url", "ws://localhost:8080", "サーバーのURL（/ws/:room の前まで）")
+	flag.StringVar(&opts.roomPrefix, "room-prefix", "loadgen", "room名の接頭辞（<prefix>-<番号>）")
+	flag.IntVar(&opts.rooms, "rooms", 1, "room数")
+	flag.IntVar(&opts.clients, "clients", 10, "roomごとのクライアント数")
+	flag.Float64Var(&opts.rate, "rate", 2, "クライアントごとの1秒あたりのupdate数")
+	flag.IntVar(&opts.nodes, "nodes", 5, "クライアントごとに作成して動かすノード数")
+	flag.BoolVar(&opts.awareness, "awareness", true, "updateと一緒にカーソル位置のawarenessを送る")
+	flag.DurationVar(&opts.duration, "duration", 30*time.Second, "updateを送り続ける時間")
+	flag.DurationVar(&opts.drain, "drain", 3*time.Second, "送信を止めてから、届いていないupdateを待つ時間")
+	flag.StringVar(&opts.token, "token", "", "roomのトークン（?token= として付ける）")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if opts.rooms <= 0 || opts.clients <= 0 || opts.rate <= 0 || opts.nodes <= 0 || flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	s := &stats{pending: make(map[itemID]sentUpdate)}
+	start := time.Now()
+	run(ctx, opts, s)
+	report(opts, s, time.Since(start))
+}
+
+// run 全roomのクライアントを接続し、durationの間updateを送る
+func run(ctx context.Context, opts options, s *stats) {
+	// 全クライアントが接続してから送り始める（届くべきクライアント数を正しく数えるため）
+	var clients []*loadClient
+	for r := 0; r < opts.rooms; r++ {
+		room := fmt.Sprintf("%s-%d", opts.roomPrefix, r)
+		for i := 0; i < opts.clients; i++ {
+			c, err := dial(opts, room, s)
+			if err != nil {
+				s.failed.Add(1)
+				log.Printf("error connecting to %s: %v", room, err)
+				continue
+			}
+			s.connected.Add(1)
+			clients = append(clients, c)
+		}
+	}
+	peers := make(map[string]int)
+	for _, c := range clients {
+		peers[c.room]++
+	}
+	log.Printf("connected %d clients in %d rooms, sending updates for %s", len(clients), opts.rooms, opts.duration)
+
+	sendCtx, cancel := context.WithTimeout(ctx, opts.duration)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *loadClient) {
+			defer wg.Done()
+			c.sendLoop(sendCtx, opts, peers[c.room]-1)
+		}(c)
+	}
+	wg.Wait()
+
+	// 送信済みのupdateが届くのを待ってから切断する
+	select {
+	case <-time.After(opts.drain):
+	case <-ctx.Done():
+	}
+	for _, c := range clients {
+		c.close()
+	}
+}
+
+// loadClient 1つのYjsクライアント
+type loadClient struct {
+	conn  *websocket.Conn
+	room  string
+	id    uint64 // YjsのクライアントID
+	clock uint64
+	stats *stats
+
+	writeMutex sync.Mutex
+	done       chan struct{}
+}
+
+// dial roomに接続し、sync step 1を送って受信ループを開始する
+func dial(opts options, room string, s *stats) (*loadClient, error) {
+	url := strings.TrimSuffix(opts.url, "/") + "/ws/" + room
+	if opts.token != "" {
+		url += "?token=" + opts.token
+	}
+	conn, res, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		if res != nil && res.StatusCode != http.StatusSwitchingProtocols {
+			return nil, fmt.Errorf("%w (HTTP %d)", err, res.StatusCode)
+		}
+		return nil, err
+	}
+	c := &loadClient{
+		conn:  conn,
+		room:  room,
+		id:    uint64(rand.Uint32()),
+		stats: s,
+		done:  make(chan struct{}),
+	}
+	// 空のstate vector（y-websocketのクライアントが接続直後に送るもの）
+	if err := c.write(encodeSyncMessage(syncStep1, []byte{0})); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// readLoop 受信したupdateの遅延を記録する（sync step 2やawarenessなどは読み捨てる）
+func (c *loadClient) readLoop() {
+	defer close(c.done)
+	for {
+		_, msg, err := c.conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) && !strings.Contains(err.Error(), "use of closed network connection") {
+				c.stats.disconnect.Add(1)
+				log.Printf("client %d in %s disconnected: %v", c.id, c.room, err)
+			}
+			return
+		}
+		if client, clock, n, err := decodeUpdateRange(msg); err == nil && client != c.id {
+			c.stats.recordReceived(client, clock, n)
+		}
+	}
+}
+
+// sendLoop ノードを作成してから、ランダムに選んだノードを少しずつ動かすupdateを送り続ける
+// （ドラッグ中のReact Flowと同じく、同じキーへの書き込みが大半を占める）
+func (c *loadClient) sendLoop(ctx context.Context, opts options, peers int) {
+	interval := time.Duration(float64(time.Second) / opts.rate)
+	// クライアントが同時に送り始めないよう、最初の送信をずらす
+	select {
+	case <-time.After(time.Duration(rand.Int63n(int64(interval)))):
+	case <-ctx.Done():
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	type node struct {
+		key  string
+		x, y float64
+		last *itemID
+	}
+	nodes := make([]*node, opts.nodes)
+	for i := range nodes {
+		nodes[i] = &node{key: fmt.Sprintf("%d-%d", c.id, i), x: rand.Float64() * 1000, y: rand.Float64() * 1000}
+	}
+
+	for i := 0; ; i++ {
+		n := nodes[rand.Intn(len(nodes))]
+		if i < len(nodes) {
+			n = nodes[i]
+		}
+		n.x += rand.Float64()*20 - 10
+		n.y += rand.Float64()*20 - 10
+
+		id := itemID{client: c.id, clock: c.clock}
+		update := encodeNodeUpdate(id, n.key, nodeValue(n.key, "Node "+n.key, n.x, n.y), n.last)
+		msg := encodeSyncMessage(syncUpdate, update)
+		c.stats.recordSent(id, peers, len(msg))
+		if err := c.write(msg); err != nil {
+			log.Printf("error sending update from client %d in %s: %v", c.id, c.room, err)
+			return
+		}
+		c.clock++
+		n.last = &id
+
+		if opts.awareness {
+			state := awarenessState{
+				User:   map[string]string{"name": fmt.Sprintf("loadgen-%d", c.id)},
+				Cursor: map[string]float64{"x": n.x, "y": n.y},
+			}
+			if err := c.write(encodeAwarenessMessage(c.id, uint64(i), state)); err != nil {
+				return
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *loadClient) write(msg []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return c.conn.WriteMessage(websocket.BinaryMessage, msg)
+}
+
+// close クローズフレームを送って受信ループの終了を待つ
+func (c *loadClient) close() {
+	c.writeMutex.Lock()
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	c.writeMutex.Unlock()
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+	}
+	c.conn.Close()
+}
+
+// report 計測結果を表示する
+func report(opts options, s *stats, elapsed time.Duration) {
+	s.mutex.Lock()
+	latencies := s.latencies
+	s.mutex.Unlock()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	sent, expected, received := s.sent.Load(), s.expected.Load(), s.received.Load()
+	dropped := expected - received
+	dropRate := 0.0
+	if expected > 0 {
+		dropRate = float64(dropped) / float64(expected) * 100
+	}
+
+	fmt.Printf("clients:     %d connected, %d failed, %d disconnected (%d rooms x %d)\n",
+		s.connected.Load(), s.failed.Load(), s.disconnect.Load(), opts.rooms, opts.clients)
+	fmt.Printf("updates:     %d sent (%.1f/s, %d bytes)\n", sent, float64(sent)/elapsed.Seconds(), s.bytesSent.Load())
+	fmt.Printf("broadcasts:  %d received / %d expected, %d dropped (%.2f%%)\n", received, expected, dropped, dropRate)
+	if len(latencies) == 0 {
+		fmt.Println("latency:     no broadcasts received")
+		return
+	}
+	fmt.Printf("latency:     p50 %s, p90 %s, p99 %s, max %s\n",
+		percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99), percentile(latencies, 100))
+}
+
+// percentile ソート済みの遅延のパーセンタイル
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return sorted[i].Round(10 * time.Microsecond)
+}
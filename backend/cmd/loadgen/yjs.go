@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+)
+
+// y-websocketのメッセージ種別
+const (
+	messageSync      = 0
+	messageAwareness = 1
+
+	syncStep1  = 0
+	syncUpdate = 2
+)
+
+// lib0のany形式の型番号
+const (
+	anyFloat64 = 123
+	anyObject  = 118
+	anyString  = 119
+)
+
+// Yjsのcontentの種別とItemのフラグ
+const (
+	contentAny       = 8
+	flagOrigin       = 0x80
+	flagParentSub    = 0x20
+	nodesMapName     = "nodesById"
+	parentIsRootType = 1
+)
+
+func appendVarString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendVarBytes(b, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// appendAny lib0のany形式で値を書き込む（文字列・数値・オブジェクトのみ）
+// オブジェクトのキーの順序はYjsの結果に影響しないため、呼び出し側で固定した順に書き込む。
+func appendAny(b []byte, v any) []byte {
+	switch v := v.(type) {
+	case string:
+		b = append(b, anyString)
+		return appendVarString(b, v)
+	case float64:
+		b = append(b, anyFloat64)
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(v))
+	case []field:
+		b = append(b, anyObject)
+		b = binary.AppendUvarint(b, uint64(len(v)))
+		for _, f := range v {
+			b = appendVarString(b, f.key)
+			b = appendAny(b, f.value)
+		}
+		return b
+	default:
+		panic("unsupported value")
+	}
+}
+
+// field オブジェクトのキーと値（順序を保つためmapを使わない）
+type field struct {
+	key   string
+	value any
+}
+
+// nodeValue React FlowのNodeと同じ形の値
+func nodeValue(id, label string, x, y float64) []field {
+	return []field{
+		{"id", id},
+		{"type", "default"},
+		{"position", []field{{"x", x}, {"y", y}}},
+		{"data", []field{{"label", label}}},
+	}
+}
+
+// itemID YjsのID（クライアントID + clock）
+type itemID struct {
+	client uint64
+	clock  uint64
+}
+
+// encodeNodeUpdate nodesByIdのkeyにノードを書き込むv1形式のupdate
+// prevがあれば、同じキーへの前回の書き込みをoriginにして上書きし、前回のItemを削除する
+// （Y.Mapのsetと同じ形）。prevがなければ新しいキーとして書き込む。
+func encodeNodeUpdate(id itemID, key string, value []field, prev *itemID) []byte {
+	u := binary.AppendUvarint(nil, 1) // クライアント数
+	u = binary.AppendUvarint(u, 1)    // struct数
+	u = binary.AppendUvarint(u, id.client)
+	u = binary.AppendUvarint(u, id.clock)
+	if prev != nil {
+		u = append(u, contentAny|flagOrigin)
+		u = binary.AppendUvarint(u, prev.client)
+		u = binary.AppendUvarint(u, prev.clock)
+	} else {
+		u = append(u, contentAny|flagParentSub)
+		u = binary.AppendUvarint(u, parentIsRootType)
+		u = appendVarString(u, nodesMapName)
+		u = appendVarString(u, key)
+	}
+	u = binary.AppendUvarint(u, 1) // 値の数
+	u = appendAny(u, value)
+
+	// delete set
+	if prev == nil {
+		return binary.AppendUvarint(u, 0)
+	}
+	u = binary.AppendUvarint(u, 1)
+	u = binary.AppendUvarint(u, prev.client)
+	u = binary.AppendUvarint(u, 1)
+	u = binary.AppendUvarint(u, prev.clock)
+	return binary.AppendUvarint(u, 1)
+}
+
+// encodeSyncMessage syncメッセージ（step 1 / update）
+func encodeSyncMessage(kind uint64, payload []byte) []byte {
+	b := binary.AppendUvarint(nil, messageSync)
+	b = binary.AppendUvarint(b, kind)
+	return appendVarBytes(b, payload)
+}
+
+// awarenessState y-websocketのクライアントが送るawarenessの状態（カーソル位置）
+type awarenessState struct {
+	User   map[string]string  `json:"user"`
+	Cursor map[string]float64 `json:"cursor"`
+}
+
+// encodeAwarenessMessage 1クライアント分のawareness update
+func encodeAwarenessMessage(client, clock uint64, state awarenessState) []byte {
+	data, _ := json.Marshal(state)
+	u := binary.AppendUvarint(nil, 1)
+	u = binary.AppendUvarint(u, client)
+	u = binary.AppendUvarint(u, clock)
+	u = appendVarString(u, string(data))
+
+	b := binary.AppendUvarint(nil, messageAwareness)
+	return appendVarBytes(b, u)
+}
+
+var errNotUpdate = errors.New("not a sync update")
+
+// decodeUpdateRange 受信したsync updateに含まれる最初のクライアントのIDとclockの範囲を返す
+// loadgenが送るupdateのstructはすべて長さ1のため、サーバーがまとめて（coalesce）転送した
+// 場合もstruct数をclockの数として扱える。
+func decodeUpdateRange(msg []byte) (client, clock, n uint64, err error) {
+	var values [6]uint64
+	pos := 0
+	for i := range values {
+		v, m := binary.Uvarint(msg[pos:])
+		if m <= 0 {
+			return 0, 0, 0, errNotUpdate
+		}
+		values[i] = v
+		pos += m
+		if i == 1 && (values[0] != messageSync || values[1] != syncUpdate) {
+			return 0, 0, 0, errNotUpdate
+		}
+	}
+	// values: 種別, sync種別, updateの長さ, クライアント数, struct数, クライアントID
+	if values[3] == 0 || values[4] == 0 {
+		return 0, 0, 0, errNotUpdate
+	}
+	clock, m := binary.Uvarint(msg[pos:])
+	if m <= 0 {
+		return 0, 0, 0, errNotUpdate
+	}
+	return values[5], clock, values[4], nil
+}
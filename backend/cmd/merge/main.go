@@ -0,0 +1,62 @@
+// mergeコマンド: 分岐した2つのYDoc状態ファイルをオフラインでマージする
+// 状態ファイルはサーバーが保存した形式（フォーマットのヘッダー付き、または旧形式）で読み込み、
+// マージ結果も現在のフォーマットのヘッダーを付けて出力する。
+//
+//	./merge [--verify] stateA.bin stateB.bin > merged.bin
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"reactflow-yjs/backend/handlers"
+	"reactflow-yjs/backend/yjsutil"
+)
+
+func main() {
+	verify := flag.Bool("verify", false, "マージ結果を解析してノード数・エッジ数を表示する")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [--verify] stateA.bin stateB.bin > merged.bin\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// 状態ファイルを読み込む
+	states := make([][]byte, 0, flag.NArg())
+	for _, path := range flag.Args() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Error reading state: %v", err)
+		}
+		state, _, err := handlers.DecodePersisted(data)
+		if err != nil {
+			log.Fatalf("Error reading state %s: %v", path, err)
+		}
+		states = append(states, state)
+	}
+
+	merged, err := yjsutil.MergeUpdates(states...)
+	if err != nil {
+		log.Fatalf("Error merging states: %v", err)
+	}
+
+	// 検証結果は標準エラーに出力（標準出力はマージ結果のバイナリ）
+	if *verify {
+		info, err := yjsutil.InspectYjsDocument(merged)
+		if err != nil {
+			log.Fatalf("Error inspecting merged state: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "nodes: %d, edges: %d\n", info.Nodes, info.Edges)
+	}
+
+	if _, err := os.Stdout.Write(handlers.EncodePersisted(merged)); err != nil {
+		log.Fatalf("Error writing merged state: %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+// roomtokenコマンド: roomへの接続を許可するトークンを発行する
+//
+//	ROOM_TOKEN_SECRET=... ./roomtoken [--ttl 24h] [--access write|read|observe] room
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"reactflow-yjs/backend/handlers"
+)
+
+func main() {
+	ttl := flag.Duration("ttl", 24*time.Hour, "トークンの有効期間")
+	access := flag.String("access", "write", "権限（write: 読み書き、read: 閲覧のみ、observe: 閲覧専用のobserver）")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: ROOM_TOKEN_SECRET=... %s [--ttl 24h] [--access write|read|observe] room\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 || (*access != "write" && *access != "read" && *access != "observe") {
+		flag.Usage()
+		os.Exit(2)
+	}
+	secret := os.Getenv("ROOM_TOKEN_SECRET")
+	if secret == "" {
+		log.Fatal("ROOM_TOKEN_SECRET is not set")
+	}
+
+	fmt.Println(handlers.SignRoomToken([]byte(secret), flag.Arg(0), *access, time.Now().Add(*ttl)))
+}
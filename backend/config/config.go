@@ -0,0 +1,116 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 設定ファイル
+// CONFIG_FILEで指定したYAMLファイルのキー（環境変数の名前）と値を、環境変数として設定する。
+// 各パッケージは従来どおり環境変数から設定を読み込むため、設定ファイルと環境変数の名前は同じになる。
+// 同じ名前の環境変数が設定されている場合は環境変数を優先する。
+//
+//	PORT: 8080
+//	STORE_BACKEND: sqlite
+//	AUTOSAVE_INTERVAL: 30s
+//	ALLOWED_ORIGINS:
+//	  - https://flow.example.com
+//
+// 他のパッケージの設定を読み込む前に適用する必要があるため、パッケージの初期化時に読み込み、
+// 読み込めない場合は起動しない。
+
+// keyPattern 設定ファイルのキー（環境変数の名前）の形式
+var keyPattern = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+func init() {
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return
+	}
+	applied, err := Load(path)
+	if err != nil {
+		slog.Error("error loading config file", "path", path, "error", err)
+		os.Exit(1)
+	}
+	slog.Info("config file loaded", "path", path, "keys", applied)
+}
+
+// Load YAMLファイルの設定を、未設定の環境変数に設定する
+// 設定したキーの一覧を返す。値はスカラーか、スカラーのリスト（カンマ区切りにする）のみ。
+func Load(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []string
+	for key, value := range values {
+		if _, ok := os.LookupEnv(key); ok {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return nil, err
+		}
+		applied = append(applied, key)
+	}
+	sort.Strings(applied)
+	return applied, nil
+}
+
+// Parse YAMLの設定を環境変数の名前と値に変換する
+func Parse(data []byte) (map[string]string, error) {
+	var raw map[string]any
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(raw))
+	for key, v := range raw {
+		if !keyPattern.MatchString(key) {
+			return nil, fmt.Errorf("invalid key %q: keys must be environment variable names such as PORT", key)
+		}
+		value, err := formatValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// formatValue 設定値を環境変数の文字列にする
+func formatValue(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	case []any:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := formatValue(item)
+			if err != nil {
+				return "", err
+			}
+			if _, ok := item.([]any); ok {
+				return "", fmt.Errorf("nested lists are not supported")
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value of type %T", v)
+	}
+}
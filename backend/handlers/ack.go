@@ -0,0 +1,55 @@
+package handlers
+
+// 永続化のACK
+// 有効にすると、updateを含む状態の保存が完了したときに、そのupdateを送ったクライアントへ
+// "persisted" の制御メッセージを送信する。保存はまとめて行われるため、ACKも保存1回ごとに
+// クライアント単位でまとめ、countにそのクライアントのupdate数を入れる。
+var persistAcks = envBool("PERSIST_ACKS", false)
+
+// trackPendingAck 保存待ちのupdateを記録する（stateMutexを保持して呼び出す）
+func (r *Room) trackPendingAck(c *client) {
+	if !persistAcks || c == nil {
+		return
+	}
+	if r.pendingAcks == nil {
+		r.pendingAcks = make(map[*client]int)
+	}
+	r.pendingAcks[c]++
+}
+
+// takePendingAcks 保存待ちのupdateを取り出す（stateMutexを保持して呼び出す）
+func (r *Room) takePendingAcks() map[*client]int {
+	batch := r.pendingAcks
+	r.pendingAcks = nil
+	return batch
+}
+
+// restorePendingAcks 保存に失敗したupdateを保存待ちに戻す
+func (r *Room) restorePendingAcks(batch map[*client]int) {
+	if len(batch) == 0 {
+		return
+	}
+	r.stateMutex.Lock()
+	defer r.stateMutex.Unlock()
+	for c, n := range batch {
+		if r.pendingAcks == nil {
+			r.pendingAcks = make(map[*client]int)
+		}
+		r.pendingAcks[c] += n
+	}
+}
+
+// sendAcks 保存が完了したupdateをクライアントごとにまとめて通知する
+func (r *Room) sendAcks(batch map[*client]int) {
+	if len(batch) == 0 {
+		return
+	}
+	r.clientsMutex.RLock()
+	defer r.clientsMutex.RUnlock()
+	for c, n := range batch {
+		// 切断済みのクライアントには送らない
+		if r.clients[c] {
+			c.sendControl(controlMessage{Type: "persisted", Count: n})
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"reactflow-yjs/backend/yjsutil"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// 管理APIのAPIキー（未設定の場合、管理APIは無効）
+var adminAPIKey = os.Getenv("ADMIN_API_KEY")
+
+func init() {
+	if adminAPIKey == "" {
+		logger.Warn("ADMIN_API_KEY is not set, admin API is disabled")
+	}
+}
+
+// 状態のプレビューとして返す最大バイト数
+const adminStatePreviewBytes = 256
+
+// RoomSummary 管理APIのroom一覧の要素
+type RoomSummary struct {
+	Name      string `json:"name"`
+	Clients   int    `json:"clients"`
+	StateSize int    `json:"stateSize"`
+	Active    bool   `json:"active"`
+}
+
+// RoomDetail 管理APIのroomの詳細
+type RoomDetail struct {
+	RoomSummary
+	Nodes        int    `json:"nodes"`
+	Edges        int    `json:"edges"`
+	StatePreview string `json:"statePreview"`
+}
+
+// AdminAuth 管理APIのAPIキーを検証するミドルウェア
+// "Authorization: Bearer <key>" または "X-API-Key: <key>" で指定する。
+// ADMIN_API_KEYが未設定の場合は認証なしで公開しないよう、すべて拒否する。
+func AdminAuth() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if adminAPIKey == "" {
+				return echo.NewHTTPError(http.StatusServiceUnavailable, "admin API is disabled")
+			}
+			if !adminKeyValid(c.Request()) {
+				return echo.NewHTTPError(http.StatusUnauthorized, "invalid API key")
+			}
+			return next(c)
+		}
+	}
+}
+
+// adminKeyValid リクエストにADMIN_API_KEYのAPIキーが付いているかどうか（未設定の場合は常にfalse）
+func adminKeyValid(r *http.Request) bool {
+	if adminAPIKey == "" {
+		return false
+	}
+	key := r.Header.Get("X-API-Key")
+	if auth := r.Header.Get(echo.HeaderAuthorization); strings.HasPrefix(auth, "Bearer ") {
+		key = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(key), []byte(adminAPIKey)) == 1
+}
+
+// RegisterAdminRoutes 管理APIのルートを登録する
+func RegisterAdminRoutes(g *echo.Group) {
+	g.Use(AdminAuth())
+	g.GET("/status", HandleRooms)
+	g.GET("/rooms", HandleListRooms)
+	g.GET("/rooms/:room", HandleGetRoom)
+	g.GET("/rooms/:room/subdocs", HandleListSubdocs)
+	g.DELETE("/rooms/:room", HandleDeleteRoom)
+	g.POST("/rooms/:room/snapshot", HandleSnapshotRoom)
+	g.GET("/rooms/:room/snapshots", HandleListSnapshots)
+	g.POST("/rooms/:room/snapshots", HandleCreateSnapshot)
+	g.POST("/rooms/:room/snapshots/:ts/restore", HandleRestoreSnapshot)
+	g.POST("/rooms/:room/restore", HandleRestoreRoom)
+	g.GET("/rooms/:room/clients", HandleListClients)
+	g.DELETE("/rooms/:room/clients/:id", HandleDisconnectClient)
+	g.POST("/rooms/:room/notice", HandleRoomNotice)
+	g.GET("/rooms/:room/lock", HandleGetRoomLock)
+	g.POST("/rooms/:room/lock", HandleLockRoom)
+	g.DELETE("/rooms/:room/lock", HandleUnlockRoom)
+	g.GET("/backup", HandleBackup)
+	g.POST("/restore", HandleRestoreBackup)
+}
+
+// findRoom 使用中のroomを返す（なければnil）
+func findRoom(name string) *Room {
+	roomsMutex.Lock()
+	defer roomsMutex.Unlock()
+	return rooms[name]
+}
+
+// state roomの共有状態
+func (r *Room) state() []byte {
+	r.stateMutex.RLock()
+	defer r.stateMutex.RUnlock()
+	return r.sharedState
+}
+
+// HandleListRooms 使用中のroomと状態が保存されているroomの一覧を返す
+func HandleListRooms(c echo.Context) error {
+	summaries := make(map[string]*RoomSummary)
+	for _, room := range activeRooms() {
+		summaries[room.name] = &RoomSummary{
+			Name:      room.name,
+			Clients:   room.clientCount(),
+			StateSize: len(room.state()),
+			Active:    true,
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), storeTimeout)
+	defer cancel()
+	names, err := stateStore.List(ctx)
+	if err != nil {
+		logger.Error("error listing persisted rooms", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to list persisted rooms")
+	}
+	for _, name := range names {
+		if _, ok := summaries[name]; ok {
+			continue
+		}
+		data, err := loadPersisted(ctx, name)
+		if err != nil {
+			logger.Error("error loading state", "room", name, "error", err)
+		}
+		summaries[name] = &RoomSummary{Name: name, StateSize: len(data)}
+	}
+
+	list := make([]*RoomSummary, 0, len(summaries))
+	for _, s := range summaries {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return c.JSON(http.StatusOK, list)
+}
+
+// HandleGetRoom roomの詳細と状態のプレビュー（16進数）を返す
+func HandleGetRoom(c echo.Context) error {
+	name := c.Param("room")
+	if !validRoomName(name) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid room name")
+	}
+
+	detail := RoomDetail{RoomSummary: RoomSummary{Name: name}}
+	var data []byte
+	if room := findRoom(name); room != nil {
+		data = room.state()
+		detail.Clients = room.clientCount()
+		detail.Active = true
+	} else {
+		ctx, cancel := context.WithTimeout(c.Request().Context(), storeTimeout)
+		defer cancel()
+		var err error
+		if data, err = loadPersisted(ctx, name); err != nil {
+			logger.Error("error loading state", "room", name, "error", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to load room state")
+		}
+		if data == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "room not found")
+		}
+	}
+
+	detail.StateSize = len(data)
+	detail.StatePreview = hex.EncodeToString(data[:min(len(data), adminStatePreviewBytes)])
+	if len(data) > 0 {
+		if info, err := yjsutil.InspectYjsDocument(data); err == nil {
+			detail.Nodes = info.Nodes
+			detail.Edges = info.Edges
+		}
+	}
+	return c.JSON(http.StatusOK, detail)
+}
+
+// HandleDeleteRoom roomの全クライアントを切断し、保存済みの状態を削除する
+func HandleDeleteRoom(c echo.Context) error {
+	name := c.Param("room")
+	if !validRoomName(name) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid room name")
+	}
+	if err := deleteRoom(name); err != nil {
+		logger.Error("error deleting room", "room", name, "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete room")
+	}
+	// ページ（サブドキュメント）の状態も削除する
+	if name == parentRoomName(name) {
+		ctx, cancel := context.WithTimeout(c.Request().Context(), storeTimeout)
+		defer cancel()
+		if err := deleteSubdocRooms(ctx, name); err != nil {
+			logger.Error("error deleting subdocuments", "room", name, "error", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete subdocuments")
+		}
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// HandleSnapshotRoom 自動保存を待たずにroomの状態を保存する
+func HandleSnapshotRoom(c echo.Context) error {
+	name := c.Param("room")
+	if !validRoomName(name) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid room name")
+	}
+	room := findRoom(name)
+	if room == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "room is not active")
+	}
+	if err := room.saveState(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save room state")
+	}
+	return c.JSON(http.StatusOK, map[string]any{"name": name, "stateSize": len(room.state())})
+}
+
+// RestoreRequest POST /rooms/:room/restore のリクエスト
+type RestoreRequest struct {
+	Snapshot int64 `json:"snapshot"` // 復元するスナップショットのID（タイムスタンプ）
+}
+
+// HandleRestoreRoom roomの状態をリクエストで指定したスナップショットの内容に戻す
+func HandleRestoreRoom(c echo.Context) error {
+	name := c.Param("room")
+	if !validRoomName(name) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid room name")
+	}
+	var req RestoreRequest
+	if err := c.Bind(&req); err != nil || req.Snapshot <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "snapshot id is required")
+	}
+	return restoreRoom(c, name, req.Snapshot)
+}
+
+// restoreRoom スナップショットを復元し、結果に応じたレスポンスを返す
+func restoreRoom(c echo.Context, name string, ts int64) error {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), storeTimeout)
+	defer cancel()
+	switch err := restoreSnapshot(ctx, name, ts); {
+	case err == nil:
+		return c.NoContent(http.StatusNoContent)
+	case errors.Is(err, os.ErrNotExist):
+		return echo.NewHTTPError(http.StatusNotFound, "snapshot not found")
+	case errors.Is(err, errSnapshotsUnsupported):
+		return echo.NewHTTPError(http.StatusNotImplemented, err.Error())
+	default:
+		logger.Error("error restoring snapshot", "room", name, "snapshot", ts, "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to restore snapshot")
+	}
+}
+
+// ClientInfo 管理APIのクライアント一覧の要素
+type ClientInfo struct {
+	ID          uint64    `json:"id"`
+	User        string    `json:"user,omitempty"`
+	RemoteAddr  string    `json:"remoteAddr"`
+	ReadOnly    bool      `json:"readOnly"`
+	Observer    bool      `json:"observer"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	LastSeen    time.Time `json:"lastSeen"`
+}
+
+// HandleListClients roomに接続中のクライアントの一覧（接続した順）を返す
+func HandleListClients(c echo.Context) error {
+	name := c.Param("room")
+	if !validRoomName(name) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid room name")
+	}
+	room := findRoom(name)
+	if room == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "room is not active")
+	}
+
+	clients := room.clientList()
+	list := make([]ClientInfo, 0, len(clients))
+	for _, cl := range clients {
+		list = append(list, ClientInfo{
+			ID:          cl.id,
+			User:        cl.user,
+			RemoteAddr:  cl.conn.RemoteAddr().String(),
+			ReadOnly:    cl.readOnly,
+			Observer:    cl.observer,
+			ConnectedAt: cl.connectedAt,
+			LastSeen:    time.Unix(0, cl.lastSeen.Load()),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return c.JSON(http.StatusOK, list)
+}
+
+// HandleDisconnectClient roomのクライアントを1008で切断する
+// クライアントは自動で再接続するため、状態のずれた接続をやり直させるのに使う。
+func HandleDisconnectClient(c echo.Context) error {
+	name := c.Param("room")
+	if !validRoomName(name) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid room name")
+	}
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid client id")
+	}
+	room := findRoom(name)
+	if room == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "room is not active")
+	}
+
+	for _, cl := range room.clientList() {
+		if cl.id == id {
+			cl.log.Info("disconnecting client by admin request")
+			cl.closeWithCode(websocket.ClosePolicyViolation, "disconnected by administrator")
+			return c.NoContent(http.StatusNoContent)
+		}
+	}
+	return echo.NewHTTPError(http.StatusNotFound, "client not found")
+}
+
+// NoticeRequest POST /rooms/:room/notice のリクエスト
+type NoticeRequest struct {
+	Message string `json:"message"`
+}
+
+// HandleRoomNotice roomの全クライアントにサーバーからのお知らせを送信する
+func HandleRoomNotice(c echo.Context) error {
+	name := c.Param("room")
+	if !validRoomName(name) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid room name")
+	}
+	var req NoticeRequest
+	if err := c.Bind(&req); err != nil || strings.TrimSpace(req.Message) == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "message is required")
+	}
+	room := findRoom(name)
+	if room == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "room is not active")
+	}
+
+	clients := room.clientList()
+	for _, cl := range clients {
+		cl.sendControl(controlMessage{Type: "notice", Message: req.Message})
+	}
+	logger.Info("notice sent to room", "room", name, "clients", len(clients))
+	return c.JSON(http.StatusOK, map[string]any{"name": name, "clients": len(clients)})
+}
+
+// loadPersisted 保存済みの状態を読み込み、フォーマットのヘッダーを取り除く（なければnil）
+// updateログに圧縮されていないupdateが残っていればマージする
+func loadPersisted(ctx context.Context, name string) ([]byte, error) {
+	data, err := stateStore.Load(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		if data, _, err = DecodePersisted(data); err != nil {
+			return nil, err
+		}
+	}
+	data, _, err = mergeLoggedUpdates(ctx, name, data)
+	return data, err
+}
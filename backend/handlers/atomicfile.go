@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// writeFileAtomic 一時ファイルに書き込んでからリネームし、ファイルを原子的に置き換える
+// 書き込み途中でプロセスが落ちても、元のファイルが壊れることはない
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	// リネームが原子的になるよう、同じディレクトリ（同じファイルシステム）に一時ファイルを作る
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // リネーム後は存在しないので何もしない
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		// Windowsでは既存のファイルへのリネームが失敗することがあるため、削除してから再試行
+		if runtime.GOOS != "windows" {
+			return err
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Rename(tmpPath, path); err != nil {
+			return err
+		}
+	}
+
+	// ディレクトリエントリの更新も永続化する（対応していない環境では無視）
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWriteFileAtomicKeepsOldFileOnPartialWrite(t *testing.T) {
+	store := useTempStore(t)
+	ctx := context.Background()
+	old := EncodePersisted(mapSetUpdate(1, 0, "nodesById", "a", "old"))
+	if err := store.Save(ctx, "atomic-test", old); err != nil {
+		t.Fatal(err)
+	}
+
+	// 書き込み途中でプロセスが落ちた場合と同じく、途中までの一時ファイルを残す
+	path := store.path("atomic-test")
+	newState := EncodePersisted(mapSetUpdate(1, 1, "nodesById", "b", "new"))
+	partial := filepath.Join(filepath.Dir(path), filepath.Base(path)+".123456.tmp")
+	if err := os.WriteFile(partial, newState[:len(newState)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := store.Load(ctx, "atomic-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(old) {
+		t.Fatalf("Load = %x, want the old state %x", data, old)
+	}
+	names, err := store.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"atomic-test"}) {
+		t.Fatalf("List = %v, want only the saved room", names)
+	}
+
+	// 次の書き込みは残った一時ファイルの影響を受けない
+	if err := store.Save(ctx, "atomic-test", newState); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := store.Load(ctx, "atomic-test"); string(data) != string(newState) {
+		t.Fatalf("Load after save = %x, want %x", data, newState)
+	}
+}
+
+func TestWriteFileAtomicFailureLeavesNoTempFile(t *testing.T) {
+	dir := t.TempDir()
+	// 置き換え先がディレクトリのため、リネームに失敗する
+	path := filepath.Join(dir, "target")
+	if err := os.MkdirAll(filepath.Join(path, "child"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeFileAtomic(path, []byte("data"), 0644); err == nil {
+		t.Fatal("writeFileAtomic succeeded, want error")
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if len(matches) > 0 {
+		t.Fatalf("temporary files left behind: %v", matches)
+	}
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		t.Fatalf("target was replaced: %v", err)
+	}
+}
@@ -0,0 +1,308 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 編集の監査ログ
+// AUDIT_LOGが有効な場合、クライアントから受け取って適用したupdateごとに、時刻、room、
+// トークンのユーザー、クライアント、接続元、サイズを記録し、APIから参照できるようにする。
+// 記録は受信ループを止めないよう1つのゴルーチンでまとめて書き込む。
+// 書き込み待ちが満杯の場合は少しだけ待ち、それでも空かなければ破棄してメトリクスに数える。
+// 監査のための記録なので、roomの状態を削除しても監査ログは削除しない。
+var (
+	auditLogEnabled = envBool("AUDIT_LOG", false)
+	// 書き込み待ちの記録の最大数（超えた場合はauditEnqueueTimeoutだけ待ってから記録を破棄する）
+	auditQueueSize = envInt("AUDIT_QUEUE_SIZE", 1024)
+)
+
+// auditEnqueueTimeout 書き込み待ちが満杯の場合に、記録を破棄するまで待つ時間
+// 受信ループを止める時間を抑えつつ、書き込みの一時的な遅れでは記録を失わないようにする。
+const auditEnqueueTimeout = 100 * time.Millisecond
+
+// 監査ログの参照で1回に返す記録の数
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// AuditEntry 適用したupdateの記録
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Room       string    `json:"room"`
+	User       string    `json:"user,omitempty"` // トークンのユーザーID（認証なしの場合は空）
+	ClientID   uint64    `json:"clientId"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"` // 接続元（GET /api/rooms/:room/historyでは返さない）
+	Bytes      int       `json:"bytes"`
+}
+
+// AuditStore 監査ログを保存できる永続化バックエンド
+// StateStoreがこのインターフェースも実装している場合に監査ログを記録する。
+type AuditStore interface {
+	AppendAudit(ctx context.Context, entries []AuditEntry) error
+	// ListAudit roomのsince以降の記録（古い順、最大limit件）
+	ListAudit(ctx context.Context, room string, since time.Time, limit int) ([]AuditEntry, error)
+}
+
+// auditQueue 書き込み待ちの記録
+var auditQueue chan AuditEntry
+
+func init() {
+	if !auditLogEnabled {
+		return
+	}
+	auditQueue = make(chan AuditEntry, auditQueueSize)
+	go auditWriter()
+}
+
+// auditStore 監査ログに対応した永続化バックエンド（無効または未対応の場合はnil）
+func auditStore() AuditStore {
+	if !auditLogEnabled {
+		return nil
+	}
+	s, _ := stateStore.(AuditStore)
+	return s
+}
+
+// recordAudit クライアントのupdateを適用したことを記録する
+func (c *client) recordAudit(update []byte) {
+	if auditStore() == nil {
+		return
+	}
+	entry := AuditEntry{
+		Time:       time.Now(),
+		Room:       c.room.name,
+		User:       c.user,
+		ClientID:   c.id,
+		RemoteAddr: c.ip,
+		Bytes:      len(update),
+	}
+	select {
+	case auditQueue <- entry:
+		return
+	default:
+	}
+	timer := time.NewTimer(auditEnqueueTimeout)
+	defer timer.Stop()
+	select {
+	case auditQueue <- entry:
+	case <-timer.C:
+		metricAuditDropped.Inc()
+		c.log.Warn("audit queue full, entry dropped", "bytes", len(update))
+	}
+}
+
+// auditWriter 書き込み待ちの記録をまとめて書き込む
+func auditWriter() {
+	for entry := range auditQueue {
+		entries := []AuditEntry{entry}
+	drain:
+		for len(entries) < cap(auditQueue) {
+			select {
+			case e := <-auditQueue:
+				entries = append(entries, e)
+			default:
+				break drain
+			}
+		}
+
+		store := auditStore()
+		if store == nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		if err := store.AppendAudit(ctx, entries); err != nil {
+			logger.Error("error writing audit log", "entries", len(entries), "error", err)
+		}
+		cancel()
+	}
+}
+
+// HandleRoomHistory roomの監査ログを返す
+// ?since= でRFC3339形式の時刻かUnix時刻（秒）以降に絞り込み、?limit= で件数を指定する。
+// 認可はWebSocketの接続と同じく行う。roomのトークンを持つ全員が参照できるため、接続元のアドレスは返さない。
+func HandleRoomHistory(c echo.Context) error {
+	name, _, err := authorizeRoomAPI(c)
+	if err != nil {
+		return err
+	}
+	store := auditStore()
+	if store == nil {
+		return echo.NewHTTPError(http.StatusNotImplemented, "audit log is disabled or not supported by the state store")
+	}
+
+	var since time.Time
+	if v := c.QueryParam("since"); v != "" {
+		if since, err = parseSince(v); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid since, use RFC 3339 or Unix seconds")
+		}
+	}
+	limit := defaultAuditLimit
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid limit")
+		}
+		limit = min(n, maxAuditLimit)
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), storeTimeout)
+	defer cancel()
+	entries, err := store.ListAudit(ctx, name, since, limit)
+	if err != nil {
+		logger.Error("error reading audit log", "room", name, "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to read audit log")
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+	for i := range entries {
+		entries[i].RemoteAddr = ""
+	}
+	return c.JSON(http.StatusOK, entries)
+}
+
+// parseSince RFC3339形式の時刻かUnix時刻（秒）を読み込む
+func parseSince(v string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// auditPath roomの監査ログのパス（audit/<room>.jsonl）
+func (s *FileStore) auditPath(room string) string {
+	return filepath.Join(s.dir, "audit", room+".jsonl")
+}
+
+// AppendAudit 記録をroomごとのファイルに1行ずつJSONで追記する
+func (s *FileStore) AppendAudit(ctx context.Context, entries []AuditEntry) error {
+	s.auditMutex.Lock()
+	defer s.auditMutex.Unlock()
+
+	if err := os.MkdirAll(filepath.Join(s.dir, "audit"), 0755); err != nil {
+		return err
+	}
+	byRoom := make(map[string][]byte)
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		byRoom[entry.Room] = append(append(byRoom[entry.Room], line...), '\n')
+	}
+	for room, data := range byRoom {
+		f, err := os.OpenFile(s.auditPath(room), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListAudit roomの監査ログのファイルから、since以降の記録を読み込む
+func (s *FileStore) ListAudit(ctx context.Context, room string, since time.Time, limit int) ([]AuditEntry, error) {
+	s.auditMutex.Lock()
+	defer s.auditMutex.Unlock()
+
+	f, err := os.Open(s.auditPath(room))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() && len(entries) < limit {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// 書き込み途中で落ちた行などは読み飛ばす
+			continue
+		}
+		if !entry.Time.Before(since) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// createAuditTable 監査ログのテーブルがなければ作成する
+func createAuditTable(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS ydoc_audit (
+	room TEXT NOT NULL,
+	time BIGINT NOT NULL,
+	user_id TEXT NOT NULL,
+	client_id BIGINT NOT NULL,
+	remote_addr TEXT NOT NULL,
+	bytes BIGINT NOT NULL
+)`); err != nil {
+		return fmt.Errorf("creating ydoc_audit table: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS ydoc_audit_room_time ON ydoc_audit (room, time)`); err != nil {
+		return fmt.Errorf("creating ydoc_audit index: %w", err)
+	}
+	return nil
+}
+
+// AppendAudit 記録をydoc_auditテーブルに追加する（時刻はUnix時刻のナノ秒）
+func (s *SQLStore) AppendAudit(ctx context.Context, entries []AuditEntry) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, e := range entries {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO ydoc_audit (room, time, user_id, client_id, remote_addr, bytes) VALUES ($1, $2, $3, $4, $5, $6)`,
+			e.Room, e.Time.UnixNano(), e.User, int64(e.ClientID), e.RemoteAddr, e.Bytes); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ListAudit ydoc_auditテーブルからroomのsince以降の記録を読み込む
+func (s *SQLStore) ListAudit(ctx context.Context, room string, since time.Time, limit int) ([]AuditEntry, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT time, user_id, client_id, remote_addr, bytes FROM ydoc_audit
+WHERE room = $1 AND time >= $2 ORDER BY time LIMIT $3`, room, since.UnixNano(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var (
+			t        int64
+			clientID int64
+		)
+		entry := AuditEntry{Room: room}
+		if err := rows.Scan(&t, &entry.User, &clientID, &entry.RemoteAddr, &entry.Bytes); err != nil {
+			return nil, err
+		}
+		entry.Time = time.Unix(0, t)
+		entry.ClientID = uint64(clientID)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRoomHistoryAuthorization(t *testing.T) {
+	store := useTempStore(t)
+	const name = "history-auth"
+	entry := AuditEntry{Time: time.Now(), Room: name, User: "alice", ClientID: 1, RemoteAddr: "192.0.2.1:1234", Bytes: 10}
+	if err := store.AppendAudit(context.Background(), []AuditEntry{entry}); err != nil {
+		t.Fatal(err)
+	}
+
+	secret := []byte("test-secret")
+	prevSecret, prevAuthorizer, prevEnabled := roomTokenSecret, authorizer, auditLogEnabled
+	roomTokenSecret, authorizer, auditLogEnabled = secret, authorizeRoomToken, true
+	t.Cleanup(func() { roomTokenSecret, authorizer, auditLogEnabled = prevSecret, prevAuthorizer, prevEnabled })
+
+	e := echo.New()
+	e.GET("/api/rooms/:room/history", HandleRoomHistory)
+	get := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest("GET", "/api/rooms/"+name+"/history"+query, nil))
+		return rec
+	}
+
+	if rec := get(""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without token: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	rec := get("?token=" + SignRoomToken(secret, name, "read", time.Now().Add(time.Hour)))
+	var entries []AuditEntry
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &entries) != nil || len(entries) != 1 {
+		t.Fatalf("read token: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if entries[0].User != "alice" || entries[0].RemoteAddr != "" {
+		t.Errorf("entry = %+v, want user without remote address", entries[0])
+	}
+}
+
+func TestRecordAuditDropsWhenQueueFull(t *testing.T) {
+	useTempStore(t)
+	prevEnabled, prevQueue := auditLogEnabled, auditQueue
+	auditLogEnabled, auditQueue = true, make(chan AuditEntry, 1)
+	t.Cleanup(func() { auditLogEnabled, auditQueue = prevEnabled, prevQueue })
+
+	c := newTestClient(newTestRoom("audit-full"))
+	c.ip = "192.0.2.1"
+	c.recordAudit([]byte{1, 2, 3})
+	if entry := <-auditQueue; entry.RemoteAddr != "192.0.2.1" || entry.Bytes != 3 {
+		t.Errorf("entry = %+v, want remote address from the client's IP", entry)
+	}
+
+	// 書き込み待ちが満杯のままなら、少し待ってから破棄してメトリクスに数える
+	c.recordAudit([]byte{1})
+	dropped := testutil.ToFloat64(metricAuditDropped)
+	start := time.Now()
+	c.recordAudit([]byte{2})
+	if elapsed := time.Since(start); elapsed < auditEnqueueTimeout {
+		t.Errorf("dropped after %s, want to wait %s", elapsed, auditEnqueueTimeout)
+	}
+	if got := testutil.ToFloat64(metricAuditDropped); got != dropped+1 {
+		t.Errorf("dropped entries = %v, want %v", got, dropped+1)
+	}
+
+	// 待っている間に空けば破棄しない
+	go func() {
+		time.Sleep(auditEnqueueTimeout / 4)
+		<-auditQueue
+	}()
+	c.recordAudit([]byte{3})
+	if got := testutil.ToFloat64(metricAuditDropped); got != dropped+1 {
+		t.Errorf("dropped entries = %v after the queue drained, want %v", got, dropped+1)
+	}
+}
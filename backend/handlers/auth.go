@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// roomの認可
+// WebSocketのアップグレード前に、Authorizationヘッダー（Bearer）、?token=、または
+// Sec-WebSocket-Protocol（"access_token, <token>"）のトークンを検証する。
+// ROOM_TOKEN_SECRETが未設定の場合は認可を行わない。
+
+// roomトークンの署名鍵
+var roomTokenSecret = []byte(os.Getenv("ROOM_TOKEN_SECRET"))
+
+var (
+	// errMissingToken トークンが指定されていない
+	errMissingToken = errors.New("missing token")
+	// errInvalidToken トークンの形式・署名が不正、または期限切れ
+	errInvalidToken = errors.New("invalid or expired token")
+	// errRoomNotPermitted トークンが別のroom用
+	errRoomNotPermitted = errors.New("token is not valid for this room")
+)
+
+// tokenSubprotocol ブラウザからヘッダーを指定できない場合に、トークンの前に指定するサブプロトコル
+// new WebSocket(url, ["access_token", token]) のように指定し、サーバーはこのサブプロトコルを選択して応答する。
+const tokenSubprotocol = "access_token"
+
+// closeTokenExpired 接続中にトークンの有効期限が切れた場合のクローズコード
+const closeTokenExpired = 4401
+
+// Grant 認可されたアクセスの内容
+type Grant struct {
+	User     string    // ユーザーID（トークンに含まれない場合は空）
+	ReadOnly bool      // 閲覧のみ（updateは適用しない）
+	Observer bool      // 閲覧専用のobserver（REDACT_FIELDSを取り除いた内容のみ受け取る、常に閲覧のみ）
+	Expires  time.Time // トークンの有効期限（ゼロ値の場合は期限なし）
+	Admin    bool      // roomのトークンではなくADMIN_API_KEYで認可された（HTTP APIのみ）
+}
+
+// トークンのaccessの値
+const (
+	accessWrite   = "write"   // 読み書き（省略時）
+	accessRead    = "read"    // 閲覧のみ
+	accessObserve = "observe" // 閲覧専用のobserver
+)
+
+// applyAccess トークンのaccessの値をGrantに反映する（未知の値はエラー）
+func (g *Grant) applyAccess(access string) error {
+	switch access {
+	case "", accessWrite:
+	case accessRead:
+		g.ReadOnly = true
+	case accessObserve:
+		g.Observer = true
+	default:
+		return errInvalidToken
+	}
+	return nil
+}
+
+// Authorizer 接続前にリクエストがroomにアクセスできるかを判定する
+// 拒否する場合はエラーを返す（errRoomNotPermittedの場合は403、それ以外は401）。
+type Authorizer func(r *http.Request, room string) (Grant, error)
+
+// authorizer 使用中のAuthorizer（ROOM_TOKEN_SECRETが設定されていればHMACトークン）
+var authorizer Authorizer
+
+func init() {
+	if len(roomTokenSecret) > 0 {
+		authorizer = authorizeRoomToken
+	}
+}
+
+// SetAuthorizer roomの認可処理を設定する（nilの場合は認可なし、サーバー起動前に呼び出す）
+func SetAuthorizer(a Authorizer) {
+	authorizer = a
+}
+
+// authorizeRequest 設定されたAuthorizerでリクエストを検証し、エラーをHTTPエラーに変換する
+// サブドキュメントのroomは親のroomの権限で接続できる。
+// observerは伏せたフィールドのない内容を書き戻せないよう、常に閲覧のみにする。
+func authorizeRequest(r *http.Request, room string) (Grant, error) {
+	if authorizer == nil {
+		return Grant{}, nil
+	}
+	grant, err := authorizer(r, parentRoomName(room))
+	if err != nil {
+		if errors.Is(err, errRoomNotPermitted) {
+			return Grant{}, echo.NewHTTPError(http.StatusForbidden, err.Error())
+		}
+		return Grant{}, echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+	if grant.Observer {
+		grant.ReadOnly = true
+	}
+	return grant, nil
+}
+
+// authorizeRoomAPI roomごとのHTTP APIのリクエストを、WebSocketの接続と同じく検証する
+// room名の形式とALLOWED_ROOM_PATTERNSを確認してから、Authorizerで権限を判定する。
+// ADMIN_API_KEYのAPIキーが付いている場合は、roomのトークンなしで管理者として許可する（管理APIの別名用）。
+func authorizeRoomAPI(c echo.Context) (string, Grant, error) {
+	name := c.Param("room")
+	if !validRoomName(name) {
+		return "", Grant{}, echo.NewHTTPError(http.StatusBadRequest, "invalid room name")
+	}
+	if !roomAllowed(name) {
+		return "", Grant{}, echo.NewHTTPError(http.StatusForbidden, "room is not allowed")
+	}
+	if adminKeyValid(c.Request()) {
+		return name, Grant{Admin: true}, nil
+	}
+	grant, err := authorizeRequest(c.Request(), name)
+	if err != nil {
+		return "", Grant{}, err
+	}
+	return name, grant, nil
+}
+
+// authorizeRoomWrite authorizeRoomAPIに加えて、閲覧のみのトークンを拒否する（roomの状態を変更するAPI用）
+// roomの認可が設定されていない場合は誰でも通ってしまうため、ADMIN_API_KEYのAPIキーを必要とする。
+func authorizeRoomWrite(c echo.Context) (string, Grant, error) {
+	name, grant, err := authorizeRoomAPI(c)
+	if err != nil {
+		return "", Grant{}, err
+	}
+	if grant.Admin {
+		return name, grant, nil
+	}
+	if authorizer == nil {
+		return "", Grant{}, echo.NewHTTPError(http.StatusUnauthorized, "room authorization is not configured, use ADMIN_API_KEY")
+	}
+	if grant.ReadOnly {
+		return "", Grant{}, echo.NewHTTPError(http.StatusForbidden, "token is read-only")
+	}
+	return name, grant, nil
+}
+
+// roomTokenClaims トークンに含める内容
+type roomTokenClaims struct {
+	Room   string `json:"room"`
+	Exp    int64  `json:"exp"`              // 有効期限（Unix時刻）
+	Access string `json:"access,omitempty"` // "write"（省略時）、"read"、"observe"
+}
+
+// SignRoomToken roomへの接続を許可するトークンを作成する
+// accessは "write"（空の場合も同じ）、"read"（閲覧のみ）、"observe"（閲覧専用のobserver）。
+// 形式: base64url(JSON) + "." + base64url(HMAC-SHA256(base64url(JSON)))
+func SignRoomToken(secret []byte, room, access string, expires time.Time) string {
+	claims, _ := json.Marshal(roomTokenClaims{Room: room, Exp: expires.Unix(), Access: access})
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signRoomToken(secret, payload))
+}
+
+func signRoomToken(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// requestToken リクエストからトークンを取り出す
+// Authorizationヘッダー、Sec-WebSocket-Protocol、?token= の順に参照する
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get(echo.HeaderAuthorization); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if protocols := websocket.Subprotocols(r); len(protocols) >= 2 && protocols[0] == tokenSubprotocol {
+		return protocols[1]
+	}
+	return r.URL.Query().Get("token")
+}
+
+// authorizeRoomToken HMAC署名付きのroomトークンを検証する
+func authorizeRoomToken(r *http.Request, room string) (Grant, error) {
+	token := requestToken(r)
+	if token == "" {
+		return Grant{}, errMissingToken
+	}
+
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return Grant{}, errInvalidToken
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, signRoomToken(roomTokenSecret, payload)) {
+		return Grant{}, errInvalidToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return Grant{}, errInvalidToken
+	}
+	var claims roomTokenClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return Grant{}, errInvalidToken
+	}
+	if time.Now().Unix() >= claims.Exp {
+		return Grant{}, errInvalidToken
+	}
+	if claims.Room != room {
+		return Grant{}, errRoomNotPermitted
+	}
+	grant := Grant{Expires: time.Unix(claims.Exp, 0)}
+	if err := grant.applyAccess(claims.Access); err != nil {
+		return Grant{}, err
+	}
+	return grant, nil
+}
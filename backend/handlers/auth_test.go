@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuthorizeRequestAccess(t *testing.T) {
+	secret := []byte("test-secret")
+	prevSecret, prevAuthorizer := roomTokenSecret, authorizer
+	roomTokenSecret, authorizer = secret, authorizeRoomToken
+	t.Cleanup(func() { roomTokenSecret, authorizer = prevSecret, prevAuthorizer })
+
+	tests := []struct {
+		access             string
+		readOnly, observer bool
+	}{
+		{access: "", readOnly: false, observer: false},
+		{access: "write", readOnly: false, observer: false},
+		{access: "read", readOnly: true, observer: false},
+		// observerは伏せたフィールドを書き戻さないよう、常に閲覧のみ
+		{access: "observe", readOnly: true, observer: true},
+	}
+	for _, tt := range tests {
+		token := SignRoomToken(secret, "room", tt.access, time.Now().Add(time.Hour))
+		// クエリパラメータ（?role=）ではobserverかどうかは変わらない
+		r := httptest.NewRequest("GET", "/ws/room?role=writer&token="+token, nil)
+		grant, err := authorizeRequest(r, "room")
+		if err != nil {
+			t.Fatalf("access %q: %v", tt.access, err)
+		}
+		if grant.ReadOnly != tt.readOnly || grant.Observer != tt.observer {
+			t.Errorf("access %q: grant = %+v, want readOnly=%v observer=%v", tt.access, grant, tt.readOnly, tt.observer)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/ws/room?token="+SignRoomToken(secret, "room", "admin", time.Now().Add(time.Hour)), nil)
+	if _, err := authorizeRequest(r, "room"); err == nil {
+		t.Error("unknown access was accepted")
+	}
+}
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// awarenessの状態がこの時間更新されない場合、サーバーが削除を通知する
+// （y-protocolsのクライアントは通常15秒ごとに状態を更新する）
+var awarenessTTL = envDuration("AWARENESS_TTL", 30*time.Second)
+
+func init() {
+	if awarenessTTL > 0 {
+		go awarenessSweeper()
+	}
+}
+
+// awarenessEntry awarenessのクライアント1つ分の状態
+type awarenessEntry struct {
+	clock   uint64
+	state   string // JSON
+	updated time.Time
+	owner   *client // この状態を送信した接続
+}
+
+// awarenessStore roomごとのawareness状態（YjsのclientID -> 状態）
+type awarenessStore struct {
+	entries map[uint64]*awarenessEntry
+	mutex   sync.Mutex
+}
+
+// awarenessUpdateEntry awareness updateに含まれる1件分
+type awarenessUpdateEntry struct {
+	clientID uint64
+	clock    uint64
+	state    string
+}
+
+// decodeAwarenessUpdate awareness update（varUint8Arrayの中身）をデコード
+func decodeAwarenessUpdate(update []byte) ([]awarenessUpdateEntry, error) {
+	count, n := readVarUint(update)
+	if n == 0 {
+		return nil, errMalformedMessage
+	}
+	pos := n
+	entries := make([]awarenessUpdateEntry, 0, min(int(count), len(update)))
+	for i := uint64(0); i < count; i++ {
+		clientID, n := readVarUint(update[pos:])
+		if n == 0 {
+			return nil, errMalformedMessage
+		}
+		pos += n
+		clock, n := readVarUint(update[pos:])
+		if n == 0 {
+			return nil, errMalformedMessage
+		}
+		pos += n
+		state, n := readVarUint8Array(update[pos:])
+		if n == 0 {
+			return nil, errMalformedMessage
+		}
+		pos += n
+		entries = append(entries, awarenessUpdateEntry{clientID: clientID, clock: clock, state: string(state)})
+	}
+	return entries, nil
+}
+
+// encodeAwarenessMessage awareness update（タイプ1）のメッセージを作成
+func encodeAwarenessMessage(entries []awarenessUpdateEntry) []byte {
+	update := appendVarUint(nil, uint64(len(entries)))
+	for _, e := range entries {
+		update = appendVarUint(update, e.clientID)
+		update = appendVarUint(update, e.clock)
+		update = appendVarUint8Array(update, []byte(e.state))
+	}
+	buf := appendVarUint(nil, messageAwareness)
+	return appendVarUint8Array(buf, update)
+}
+
+// apply クライアントから受信したawareness updateを反映
+func (s *awarenessStore) apply(owner *client, entries []awarenessUpdateEntry, now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, e := range entries {
+		current, ok := s.entries[e.clientID]
+		if ok && current.clock > e.clock {
+			continue
+		}
+		if e.state == "null" {
+			delete(s.entries, e.clientID)
+			continue
+		}
+		s.entries[e.clientID] = &awarenessEntry{clock: e.clock, state: e.state, updated: now, owner: owner}
+	}
+}
+
+// expire ttlを超えて更新されていない状態を削除し、削除通知用のエントリを返す
+func (s *awarenessStore) expire(now time.Time, ttl time.Duration) []awarenessUpdateEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var removed []awarenessUpdateEntry
+	for clientID, e := range s.entries {
+		if now.Sub(e.updated) >= ttl {
+			// クロックを進めたnullの状態が削除を表す
+			removed = append(removed, awarenessUpdateEntry{clientID: clientID, clock: e.clock + 1, state: "null"})
+			delete(s.entries, clientID)
+		}
+	}
+	return removed
+}
+
+// removeOwnedBy 接続が送信した状態をすべて削除し、削除通知用のエントリを返す
+func (s *awarenessStore) removeOwnedBy(owner *client) []awarenessUpdateEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var removed []awarenessUpdateEntry
+	for clientID, e := range s.entries {
+		if e.owner == owner {
+			removed = append(removed, awarenessUpdateEntry{clientID: clientID, clock: e.clock + 1, state: "null"})
+			delete(s.entries, clientID)
+		}
+	}
+	return removed
+}
+
+// snapshot 現在のすべての状態
+func (s *awarenessStore) snapshot() []awarenessUpdateEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entries := make([]awarenessUpdateEntry, 0, len(s.entries))
+	for clientID, e := range s.entries {
+		entries = append(entries, awarenessUpdateEntry{clientID: clientID, clock: e.clock, state: e.state})
+	}
+	return entries
+}
+
+// handleAwarenessMessage awarenessメッセージ（タイプ1）を処理
+func (c *client) handleAwarenessMessage(msg []byte) {
+	_, n := readVarUint(msg)
+	update, m := readVarUint8Array(msg[n:])
+	if m == 0 {
+		return
+	}
+	entries, err := decodeAwarenessUpdate(update)
+	if err != nil {
+		c.log.Warn("invalid awareness update", "error", err)
+		return
+	}
+	c.room.awareness.apply(c, entries, time.Now())
+}
+
+// sendAwarenessStates roomの現在のawareness状態をクライアントに送信
+// 接続直後やクエリ（タイプ3）への応答として使用する
+func (c *client) sendAwarenessStates() {
+	if entries := c.room.awareness.snapshot(); len(entries) > 0 {
+		c.enqueue(encodeAwarenessMessage(entries))
+	}
+}
+
+// clearAwareness 切断したクライアントのawareness状態を削除し、残りのクライアントに通知
+// これがないと、切断したユーザーのカーソルが残り続ける
+func (c *client) clearAwareness() {
+	if removed := c.room.awareness.removeOwnedBy(c); len(removed) > 0 {
+		c.broadcastMessage(encodeAwarenessMessage(removed))
+	}
+}
+
+// broadcastAll roomの全クライアントにメッセージを送信
+func (r *Room) broadcastAll(msg []byte) {
+	r.clientsMutex.RLock()
+	defer r.clientsMutex.RUnlock()
+
+	for c := range r.clients {
+		if c.enqueue(msg) {
+			metricBroadcasts.WithLabelValues(r.name).Inc()
+		} else {
+			metricBroadcastDropped.WithLabelValues(r.name).Inc()
+		}
+	}
+}
+
+// awarenessSweeper 定期的に古いawareness状態を削除し、roomに通知
+// クライアントが削除メッセージを送らずに落ちた場合のカーソルの残留を防ぐ
+func awarenessSweeper() {
+	interval := awarenessTTL / 2
+	if interval > 5*time.Second {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		for _, room := range activeRooms() {
+			room.expireAwareness(now, awarenessTTL)
+		}
+	}
+}
+
+// expireAwareness ttlを超えて更新されていない状態を削除し、roomの全クライアントに通知
+func (r *Room) expireAwareness(now time.Time, ttl time.Duration) {
+	if removed := r.awareness.expire(now, ttl); len(removed) > 0 {
+		logger.Debug("removing stale awareness states", "room", r.name, "count", len(removed))
+		r.broadcastAll(encodeAwarenessMessage(removed))
+	}
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestStaleAwarenessRemoved(t *testing.T) {
+	const ttl = 50 * time.Millisecond
+
+	room := newTestRoom("awareness-test")
+	stale := newTestClient(room)
+	fresh := newTestClient(room)
+	peer := newTestClient(room)
+
+	send := func(c *client, clientID, clock uint64) {
+		t.Helper()
+		msg := encodeAwarenessMessage([]awarenessUpdateEntry{{clientID: clientID, clock: clock, state: `{"cursor":{"x":1,"y":2}}`}})
+		if err := c.handleMessage(msg); err != nil {
+			t.Fatalf("handleMessage: %v", err)
+		}
+	}
+	send(stale, 10, 3)
+	send(fresh, 20, 1)
+	time.Sleep(ttl)
+	// TTLの間に更新したクライアントの状態は残る
+	send(fresh, 20, 2)
+
+	drain := func(c *client) {
+		for len(c.send) > 0 {
+			<-c.send
+		}
+	}
+	for _, c := range []*client{stale, fresh, peer} {
+		drain(c)
+	}
+
+	room.expireAwareness(time.Now(), ttl)
+
+	entries := room.awareness.snapshot()
+	if len(entries) != 1 || entries[0].clientID != 20 {
+		t.Fatalf("awareness states after expiry = %+v, want only client 20", entries)
+	}
+
+	// 落ちたクライアントを含む全員に、クロックを進めたnullの状態で削除を通知する
+	for _, c := range []*client{stale, fresh, peer} {
+		if len(c.send) != 1 {
+			t.Fatalf("got %d messages, want 1 removal", len(c.send))
+		}
+		msg := <-c.send
+		_, n := readVarUint(msg)
+		update, _ := readVarUint8Array(msg[n:])
+		removed, err := decodeAwarenessUpdate(update)
+		if err != nil {
+			t.Fatalf("decodeAwarenessUpdate: %v", err)
+		}
+		want := awarenessUpdateEntry{clientID: 10, clock: 4, state: "null"}
+		if len(removed) != 1 || removed[0] != want {
+			t.Errorf("removal = %+v, want %+v", removed, want)
+		}
+	}
+
+	// 既に削除した状態は再び通知しない
+	room.expireAwareness(time.Now(), ttl)
+	if len(peer.send) != 0 {
+		t.Errorf("removal was sent again")
+	}
+}
+
+func TestAwarenessDoesNotChangeDocumentState(t *testing.T) {
+	useTempStore(t)
+	room := newTestRoom("awareness-state-test")
+	writer := newTestClient(room)
+	peer := newTestClient(room)
+
+	if err := writer.handleMessage(encodeSyncMessage(syncUpdate, mapSetUpdate(1, 0, "nodesById", "a", "x"))); err != nil {
+		t.Fatalf("handleMessage: %v", err)
+	}
+	state := room.state()
+	if len(state) == 0 {
+		t.Fatal("update was not applied")
+	}
+	for len(peer.send) > 0 {
+		<-peer.send
+	}
+
+	msg := encodeAwarenessMessage([]awarenessUpdateEntry{{clientID: 1, clock: 1, state: `{"cursor":{"x":1,"y":2}}`}})
+	if err := writer.handleMessage(msg); err != nil {
+		t.Fatalf("handleMessage: %v", err)
+	}
+
+	// awarenessは他のクライアントに転送するだけで、ドキュメントにはマージしない
+	if !bytes.Equal(room.state(), state) {
+		t.Fatalf("document state changed after an awareness message: %x -> %x", state, room.state())
+	}
+	if len(peer.send) != 1 || !bytes.Equal(<-peer.send, msg) {
+		t.Fatal("awareness message was not forwarded as is")
+	}
+}
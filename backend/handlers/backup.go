@@ -0,0 +1,329 @@
+package handlers
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// バックアップ
+// 全roomの状態とスナップショットをtar.gzの1ファイルにまとめて書き出し、別の環境や
+// 永続化バックエンドに戻せるようにする。アーカイブの構成は次のとおり（状態はヘッダーなしのYjsのupdate）。
+//
+//	manifest.json                     フォーマットのバージョン、作成時刻、roomの一覧
+//	rooms/<room>/state.bin            roomの状態
+//	rooms/<room>/snapshots.json       スナップショットの情報の一覧
+//	rooms/<room>/snapshots/<ts>.bin   スナップショットの状態
+const backupFormatVersion = 1
+
+// errUnsupportedBackup 未対応（新しいバージョン）またはバックアップではないアーカイブ
+var errUnsupportedBackup = errors.New("unsupported backup archive")
+
+// BackupManifest バックアップの先頭に置く情報
+type BackupManifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	Rooms     []string  `json:"rooms"`
+}
+
+// BackupResult バックアップ・リストアしたroomとスナップショットの数
+type BackupResult struct {
+	Rooms     int `json:"rooms"`
+	Snapshots int `json:"snapshots"`
+}
+
+// WriteBackup 使用中のroomと保存済みのroomの状態とスナップショットをwに書き出す
+// 使用中のroomはメモリ上の最新の状態を書き出す。
+func WriteBackup(ctx context.Context, w io.Writer) (BackupResult, error) {
+	var result BackupResult
+	names, err := backupRoomNames(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	manifest, err := json.Marshal(BackupManifest{Version: backupFormatVersion, CreatedAt: time.Now().UTC(), Rooms: names})
+	if err != nil {
+		return result, err
+	}
+	if err := writeBackupFile(tw, "manifest.json", manifest); err != nil {
+		return result, err
+	}
+	for _, name := range names {
+		n, err := backupRoom(ctx, tw, name)
+		if err != nil {
+			return result, fmt.Errorf("room %s: %w", name, err)
+		}
+		result.Rooms++
+		result.Snapshots += n
+	}
+	if err := tw.Close(); err != nil {
+		return result, err
+	}
+	return result, gz.Close()
+}
+
+// backupRoomNames バックアップするroom名の一覧（名前の順）
+func backupRoomNames(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+	defer cancel()
+	names, err := stateStore.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		seen[name] = true
+	}
+	for _, room := range activeRooms() {
+		if !seen[room.name] {
+			seen[room.name] = true
+			names = append(names, room.name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// backupRoom roomの状態とスナップショットを書き出し、書き出したスナップショットの数を返す
+func backupRoom(ctx context.Context, tw *tar.Writer, name string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+	defer cancel()
+
+	// 一覧の取得後に削除されたroomは空の状態として書き出す
+	state, err := loadRoomState(ctx, name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	dir := path.Join("rooms", name)
+	if err := writeBackupFile(tw, path.Join(dir, "state.bin"), state); err != nil {
+		return 0, err
+	}
+
+	store := snapshotStore()
+	if store == nil {
+		return 0, nil
+	}
+	snapshots, err := store.ListSnapshots(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	infos := make([]SnapshotInfo, 0, len(snapshots))
+	states := make([][]byte, 0, len(snapshots))
+	for _, s := range snapshots {
+		data, err := store.LoadSnapshot(ctx, name, s.Timestamp)
+		if err != nil {
+			return 0, err
+		}
+		if data == nil {
+			continue
+		}
+		if data, _, err = DecodePersisted(data); err != nil {
+			return 0, fmt.Errorf("snapshot %d: %w", s.Timestamp, err)
+		}
+		s.Size = len(data)
+		infos = append(infos, s)
+		states = append(states, data)
+	}
+	list, err := json.Marshal(infos)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeBackupFile(tw, path.Join(dir, "snapshots.json"), list); err != nil {
+		return 0, err
+	}
+	for i, s := range infos {
+		if err := writeBackupFile(tw, path.Join(dir, "snapshots", fmt.Sprintf("%d.bin", s.Timestamp)), states[i]); err != nil {
+			return 0, err
+		}
+	}
+	return len(infos), nil
+}
+
+// writeBackupFile アーカイブにファイルを1つ追加する
+func writeBackupFile(tw *tar.Writer, name string, data []byte) error {
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// RestoreBackup WriteBackupで書き出したアーカイブからroomの状態とスナップショットを戻す
+// 使用中のroomは現在の状態をバックアップの内容に戻すupdateを適用する（スナップショットの復元と同じ）。
+// スナップショットは同じidのものがあれば上書きする。永続化バックエンドがスナップショットに
+// 対応していない場合は、状態だけを戻す。
+func RestoreBackup(ctx context.Context, r io.Reader) (BackupResult, error) {
+	var result BackupResult
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return result, fmt.Errorf("%w: %v", errUnsupportedBackup, err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	if err := readBackupManifest(tr); err != nil {
+		return result, err
+	}
+	// roomごとのスナップショットの情報（snapshots.jsonは各スナップショットより前にある）
+	infos := make(map[string]map[int64]SnapshotInfo)
+	skipSnapshots := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return result, err
+		}
+
+		name, file, ok := splitBackupPath(hdr.Name)
+		if !ok {
+			logger.Warn("ignoring unknown file in backup", "path", hdr.Name)
+			continue
+		}
+		switch {
+		case file == "state.bin":
+			if err := restoreBackupState(ctx, name, data); err != nil {
+				return result, fmt.Errorf("room %s: %w", name, err)
+			}
+			result.Rooms++
+		case file == "snapshots.json":
+			var list []SnapshotInfo
+			if err := json.Unmarshal(data, &list); err != nil {
+				return result, fmt.Errorf("room %s: invalid snapshots.json: %w", name, err)
+			}
+			infos[name] = make(map[int64]SnapshotInfo, len(list))
+			for _, s := range list {
+				infos[name][s.Timestamp] = s
+			}
+		case strings.HasPrefix(file, "snapshots/") && strings.HasSuffix(file, ".bin"):
+			ts, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(file, "snapshots/"), ".bin"), 10, 64)
+			if err != nil || ts <= 0 {
+				logger.Warn("ignoring unknown file in backup", "path", hdr.Name)
+				continue
+			}
+			if snapshotStore() == nil {
+				if !skipSnapshots {
+					logger.Warn("state store does not support snapshots, skipping snapshots in backup")
+					skipSnapshots = true
+				}
+				continue
+			}
+			info, ok := infos[name][ts]
+			if !ok {
+				info = SnapshotInfo{Timestamp: ts}
+			}
+			if err := restoreBackupSnapshot(ctx, name, info, data); err != nil {
+				return result, fmt.Errorf("room %s snapshot %d: %w", name, ts, err)
+			}
+			result.Snapshots++
+		default:
+			logger.Warn("ignoring unknown file in backup", "path", hdr.Name)
+		}
+	}
+}
+
+// readBackupManifest アーカイブの先頭のmanifest.jsonを読み込み、バージョンを確認する
+func readBackupManifest(tr *tar.Reader) error {
+	hdr, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUnsupportedBackup, err)
+	}
+	if hdr.Name != "manifest.json" {
+		return fmt.Errorf("%w: manifest.json not found", errUnsupportedBackup)
+	}
+	var manifest BackupManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return fmt.Errorf("%w: invalid manifest.json: %v", errUnsupportedBackup, err)
+	}
+	if manifest.Version < 1 || manifest.Version > backupFormatVersion {
+		return fmt.Errorf("%w: version %d", errUnsupportedBackup, manifest.Version)
+	}
+	logger.Info("restoring backup", "version", manifest.Version, "createdAt", manifest.CreatedAt, "rooms", len(manifest.Rooms))
+	return nil
+}
+
+// splitBackupPath アーカイブ内のパス（rooms/<room>/<file>）をroom名とファイル名に分ける
+func splitBackupPath(p string) (room, file string, ok bool) {
+	rest, ok := strings.CutPrefix(p, "rooms/")
+	if !ok {
+		return "", "", false
+	}
+	room, file, ok = strings.Cut(rest, "/")
+	if !ok || !validRoomName(room) {
+		return "", "", false
+	}
+	return room, file, true
+}
+
+// restoreBackupState roomの状態をバックアップの内容に戻す（空の状態は戻さない）
+func restoreBackupState(ctx context.Context, name string, state []byte) error {
+	if len(state) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+	defer cancel()
+	return replaceRoomState(ctx, name, state)
+}
+
+// restoreBackupSnapshot スナップショットを保存する
+func restoreBackupSnapshot(ctx context.Context, name string, info SnapshotInfo, state []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+	defer cancel()
+	return snapshotStore().SaveSnapshot(ctx, name, info, EncodePersisted(state))
+}
+
+// HandleBackup 全roomのバックアップ（tar.gz）を返す
+func HandleBackup(c echo.Context) error {
+	// 書き出しを始めた後はステータスを変えられないため、失敗した場合は途中で打ち切る
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/gzip")
+	res.Header().Set(echo.HeaderContentDisposition,
+		fmt.Sprintf("attachment; filename=%q", "floweditor-backup-"+time.Now().UTC().Format("20060102-150405")+".tar.gz"))
+	res.WriteHeader(http.StatusOK)
+	result, err := WriteBackup(c.Request().Context(), res)
+	if err != nil {
+		logger.Error("error writing backup", "error", err)
+		return nil
+	}
+	logger.Info("backup written", "rooms", result.Rooms, "snapshots", result.Snapshots)
+	return nil
+}
+
+// HandleRestoreBackup リクエストボディのバックアップ（tar.gz）から全roomを戻す
+func HandleRestoreBackup(c echo.Context) error {
+	result, err := RestoreBackup(c.Request().Context(), c.Request().Body)
+	switch {
+	case err == nil:
+		logger.Info("backup restored", "rooms", result.Rooms, "snapshots", result.Snapshots)
+		return c.JSON(http.StatusOK, result)
+	case errors.Is(err, errUnsupportedBackup):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	default:
+		logger.Error("error restoring backup", "rooms", result.Rooms, "snapshots", result.Snapshots, "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to restore backup")
+	}
+}
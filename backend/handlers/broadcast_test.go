@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"reactflow-yjs/backend/yjsutil"
+
+	"github.com/gorilla/websocket"
+)
+
+// countingConn 受信したバイト数（圧縮後の、ネットワーク上のバイト数）を数える接続
+type countingConn struct {
+	net.Conn
+	read *atomic.Int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+// benchmarkFlowState nodes個のノードを持つフロー図の状態
+func benchmarkFlowState(b *testing.B, nodes int) []byte {
+	b.Helper()
+	updates := make([][]byte, nodes)
+	for i := range updates {
+		id := fmt.Sprintf("node-%d", i)
+		value := fmt.Sprintf(`{"id":%q,"type":"default","position":{"x":%d,"y":%d},"data":{"label":"Node %d"}}`, id, i%20*180, i/20*120, i)
+		updates[i] = mapSetUpdate(1, uint64(i), "nodesById", id, value)
+	}
+	state, err := yjsutil.MergeUpdates(updates...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return state
+}
+
+// BenchmarkBroadcast roomのN個のクライアントに1つのメッセージを送り、全員が受信するまでの時間と
+// 受信したバイト数（wire-B/op、全クライアントの合計）を計測する
+//
+//	go test -run '^$' -bench Broadcast ./handlers
+func BenchmarkBroadcast(b *testing.B) {
+	messages := []struct {
+		name string
+		msg  []byte
+	}{
+		// 1つのノードを動かすupdate
+		{"update", encodeSyncMessage(syncUpdate, mapSetUpdate(2, 0, "nodesById", "node-0", `{"id":"node-0","position":{"x":10,"y":20}}`))},
+		// 300ノードのフロー図の状態（接続時や再同期時に送る）
+		{"state-300-nodes", encodeSyncMessage(syncStep2, benchmarkFlowState(b, 300))},
+	}
+	for _, m := range messages {
+		for _, compress := range []bool{false, true} {
+			for _, clients := range []int{1, 10, 50} {
+				b.Run(fmt.Sprintf("%s/compress=%v/clients=%d", m.name, compress, clients), func(b *testing.B) {
+					benchmarkBroadcast(b, m.msg, clients, compress)
+				})
+			}
+		}
+	}
+}
+
+func benchmarkBroadcast(b *testing.B, msg []byte, clients int, compress bool) {
+	useTempStore(b)
+	name := fmt.Sprintf("bench-%d", time.Now().UnixNano())
+	forgetRooms(b, name)
+	url := newTestServer(b)
+
+	var wire atomic.Int64
+	received := make(chan struct{}, clients)
+	dialer := websocket.Dialer{
+		EnableCompression: compress,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return countingConn{Conn: conn, read: &wire}, nil
+		},
+	}
+	for i := 0; i < clients; i++ {
+		conn, _, err := dialer.Dial(url+"/ws/"+name, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+		go func() {
+			for {
+				_, data, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				if len(data) == len(msg) {
+					received <- struct{}{}
+				}
+			}
+		}()
+	}
+	waitFor(b, 5*time.Second, "clients to join", func() bool { return roomClients(name) == clients })
+	room := findRoom(name)
+	// 接続時のメッセージを受信し終えてから計測する
+	time.Sleep(50 * time.Millisecond)
+
+	wire.Store(0)
+	b.SetBytes(int64(len(msg) * clients))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		room.broadcastAll(msg)
+		for j := 0; j < clients; j++ {
+			<-received
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(wire.Load())/float64(b.N), "wire-B/op")
+}
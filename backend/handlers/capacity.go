@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 接続数の上限
+// サーバー全体のWebSocket接続数をMAX_CONNECTIONSまでに制限し、roomごとの上限
+// （MAX_CLIENTS_PER_ROOM）に達したroomへの接続はROOM_FULL_WAITの間だけ空きを待たせる。
+// 待っても空かない場合は、再接続までの目安（ROOM_FULL_RETRY_AFTER）を伝えて1013で閉じる。
+var (
+	// サーバー全体の最大接続数（0以下で無制限）
+	maxConnections = envInt("MAX_CONNECTIONS", 0)
+	// 満員のroomで空きを待つ最大時間（0で待たない）
+	roomFullWait = envDuration("ROOM_FULL_WAIT", 0)
+	// 満員で接続できなかったクライアントに伝える、再接続までの目安
+	roomFullRetryAfter = envDuration("ROOM_FULL_RETRY_AFTER", 10*time.Second)
+)
+
+const (
+	// roomFullPollInterval 満員のroomの空きを確認する間隔
+	roomFullPollInterval = 500 * time.Millisecond
+	// roomFullNoticeInterval 待機中のクライアントに状況を送る間隔
+	// （y-websocketはメッセージが30秒届かないと接続を切るため、それより短くする）
+	roomFullNoticeInterval = 10 * time.Second
+)
+
+// activeConnections サーバー全体の接続数（アップグレード前に予約する）
+var activeConnections atomic.Int64
+
+// acquireConnection 接続数の枠を予約する（MAX_CONNECTIONSに達していればfalse）
+func acquireConnection() bool {
+	if n := activeConnections.Add(1); maxConnections > 0 && n > int64(maxConnections) {
+		activeConnections.Add(-1)
+		return false
+	}
+	return true
+}
+
+// releaseConnection 予約した接続数の枠を返す
+func releaseConnection() {
+	activeConnections.Add(-1)
+}
+
+// retryAfterSeconds 再接続までの目安（秒、Retry-Afterヘッダーと制御メッセージに使う）
+func retryAfterSeconds() int {
+	return max(1, int(roomFullRetryAfter.Round(time.Second).Seconds()))
+}
+
+// retryAfterHeader Retry-Afterヘッダーの値
+func retryAfterHeader() string {
+	return strconv.Itoa(retryAfterSeconds())
+}
+
+// joinRoomWaiting roomに参加する。満員の場合はROOM_FULL_WAITの間、空くのを待つ
+// 待機中は送信ループが動いていないため、状況の通知は接続に直接書き込む。
+func joinRoomWaiting(name string, c *client) (*Room, error) {
+	room, err := joinRoom(name, c)
+	if !errors.Is(err, errRoomFull) || roomFullWait <= 0 {
+		return room, err
+	}
+
+	c.log.Info("room is full, waiting for a free slot", "wait", roomFullWait)
+	deadline := time.Now().Add(roomFullWait)
+	ticker := time.NewTicker(roomFullPollInterval)
+	defer ticker.Stop()
+	var lastNotice time.Time
+	for now := range ticker.C {
+		if now.Sub(lastNotice) >= roomFullNoticeInterval {
+			lastNotice = now
+			c.conn.SetWriteDeadline(now.Add(writeWait))
+			notice := controlMessage{Type: "room-full-waiting", Message: "The room is full, waiting for a free slot", ExpiresIn: int(deadline.Sub(now).Seconds())}
+			if err := c.writeBinary(encodeControlMessage(notice)); err != nil {
+				// 待っている間にクライアントが切断した
+				return nil, err
+			}
+		}
+		if shuttingDown.Load() {
+			return nil, errRoomFull
+		}
+		if room, err = joinRoom(name, c); !errors.Is(err, errRoomFull) {
+			return room, err
+		}
+		if now.After(deadline) {
+			return nil, errRoomFull
+		}
+	}
+	return nil, errRoomFull
+}
+
+// rejectRoomFull 満員で参加できなかったクライアントに再接続までの目安を伝えて1013で閉じる
+// y-websocketは自動で再接続するため、目安は制御メッセージに対応したクライアントのみが使う。
+func (c *client) rejectRoomFull() {
+	metricRejectedConnections.WithLabelValues("room_full").Inc()
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	c.writeBinary(encodeControlMessage(controlMessage{Type: "room-full", Message: "The room is full", ExpiresIn: retryAfterSeconds()}))
+	c.closeWithCode(websocket.CloseTryAgainLater, fmt.Sprintf("room is full, retry after %ds", retryAfterSeconds()))
+}
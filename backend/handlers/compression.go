@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"compress/flate"
+
+	"github.com/gorilla/websocket"
+)
+
+// permessage-deflateの圧縮の設定
+// 小さなメッセージ（awarenessやカーソル移動のupdateなど）は圧縮してもほとんど小さくならず、
+// CPUを使うだけなので、WS_COMPRESSION_THRESHOLDバイト以上のメッセージのみ圧縮する。
+var (
+	// 圧縮レベル（1: 最速 〜 9: 最小、-2: ハフマン符号化のみ）
+	wsCompressionLevel = envInt("WS_COMPRESSION_LEVEL", flate.BestSpeed)
+	// 圧縮するメッセージの最小バイト数
+	wsCompressionThreshold = envInt("WS_COMPRESSION_THRESHOLD", 1024)
+)
+
+func init() {
+	if wsCompressionLevel < flate.HuffmanOnly || wsCompressionLevel > flate.BestCompression {
+		logger.Warn("invalid WS_COMPRESSION_LEVEL, using default", "value", wsCompressionLevel, "default", flate.BestSpeed)
+		wsCompressionLevel = flate.BestSpeed
+	}
+}
+
+// writeBinary バイナリメッセージを書き込む（WS_COMPRESSION_THRESHOLD未満のメッセージは圧縮しない）
+// 圧縮はネゴシエーションに成功した接続でのみ行われる
+func (c *client) writeBinary(msg []byte) error {
+	c.conn.EnableWriteCompression(wsCompression && len(msg) >= wsCompressionThreshold)
+	return c.conn.WriteMessage(websocket.BinaryMessage, msg)
+}
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// messageControl サーバーからの制御メッセージのタイプ
+// y-websocketが使用する 0〜3 と重ならない値を使う。
+// 対応していないクライアントは未知のメッセージとして無視する。
+const messageControl = 100
+
+// controlMessage 制御メッセージの内容（JSONとして送信）
+type controlMessage struct {
+	Type    string `json:"type"`
+	Message string `json:"message,omitempty"`
+	// 期限までの秒数（アイドルの警告など）
+	ExpiresIn int `json:"expiresIn,omitempty"`
+	// まとめて通知する件数（永続化のACK）
+	Count int `json:"count,omitempty"`
+}
+
+var (
+	// 全roomに共通のウェルカムメッセージ
+	welcomeMessage = os.Getenv("WELCOME_MESSAGE")
+	// room別のウェルカムメッセージ（room名 -> メッセージ）
+	roomWelcomeMessages = make(map[string]string)
+)
+
+func init() {
+	// room別のメッセージはJSONファイル（{"room": "message"}）から読み込む
+	path := os.Getenv("WELCOME_MESSAGES_FILE")
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logger.Error("error loading welcome messages", "error", err)
+		return
+	}
+	if err := json.Unmarshal(data, &roomWelcomeMessages); err != nil {
+		logger.Error("error parsing welcome messages", "error", err)
+	}
+}
+
+// welcomeMessageFor roomのウェルカムメッセージ（room別の設定を優先）
+func welcomeMessageFor(room string) string {
+	if msg, ok := roomWelcomeMessages[room]; ok {
+		return msg
+	}
+	return welcomeMessage
+}
+
+// encodeControlMessage 制御メッセージをバイナリフレームにエンコード
+func encodeControlMessage(msg controlMessage) []byte {
+	payload, _ := json.Marshal(msg)
+	buf := appendVarUint(nil, messageControl)
+	buf = appendVarUint(buf, uint64(len(payload)))
+	return append(buf, payload...)
+}
+
+// sendControl クライアントに制御メッセージを送信
+func (c *client) sendControl(msg controlMessage) {
+	if !c.enqueue(encodeControlMessage(msg)) {
+		c.log.Warn("control message dropped", "control_type", msg.Type)
+	}
+}
+
+// handleControl クライアントからの制御メッセージを処理
+func (c *client) handleControl(msg controlMessage) {
+	switch msg.Type {
+	case "request-writer", "release-writer":
+		c.handleWriterControl(msg)
+	case "keepalive":
+		// 操作の時刻を更新してアイドルタイムアウトを延長する
+		c.touch()
+	}
+}
+
+// sendWelcome 設定されていればウェルカムメッセージを送信
+func (c *client) sendWelcome() {
+	if msg := welcomeMessageFor(c.room.name); msg != "" {
+		c.sendControl(controlMessage{Type: "welcome", Message: msg})
+	}
+}
+
+// decodeControlMessage クライアントからの制御メッセージをデコード
+func decodeControlMessage(msg []byte) (controlMessage, bool) {
+	var ctrl controlMessage
+	msgType, n := readVarUint(msg)
+	if n == 0 || msgType != messageControl {
+		return ctrl, false
+	}
+	length, m := readVarUint(msg[n:])
+	if m == 0 || uint64(len(msg)-n-m) < length {
+		return ctrl, false
+	}
+	payload := msg[n+m : n+m+int(length)]
+	if err := json.Unmarshal(payload, &ctrl); err != nil {
+		return ctrl, false
+	}
+	return ctrl, true
+}
@@ -0,0 +1,44 @@
+package handlers
+
+// 永続化の縮退モード
+// 状態を保存できなくなった（ディスクフル、権限など）roomは、メモリ上の状態で共同編集を
+// 続けたまま縮退モードに入り、クライアントに保存されていないことを通知する。
+// 縮退中は更新ごとの保存を行わず、自動保存のたびに保存を再試行して、成功したら復帰する。
+
+// setDegraded roomの縮退モードを切り替え、変化があればroomの全クライアントに通知する
+func (r *Room) setDegraded(degraded bool, cause error) {
+	if r.degraded.Swap(degraded) == degraded {
+		return
+	}
+	if degraded {
+		logger.Warn("room entered degraded mode, changes are kept in memory only", "room", r.name, "error", cause)
+	} else {
+		logger.Info("room left degraded mode, state is being saved again", "room", r.name)
+	}
+
+	r.clientsMutex.RLock()
+	defer r.clientsMutex.RUnlock()
+	for c := range r.clients {
+		c.sendDegradedStatus()
+	}
+}
+
+// sendDegradedStatus クライアントにroomの縮退モードの状態を送信
+func (c *client) sendDegradedStatus() {
+	if c.room.degraded.Load() {
+		c.sendControl(controlMessage{Type: "persistence-degraded", Message: "Changes are not being saved"})
+	} else {
+		c.sendControl(controlMessage{Type: "persistence-restored"})
+	}
+}
+
+// degradedRoomCount 縮退モードのroomの数
+func degradedRoomCount() int {
+	n := 0
+	for _, room := range activeRooms() {
+		if room.degraded.Load() {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/labstack/echo/v4"
+)
+
+// HandleDiff リクエストボディのstate vectorに対して、roomの状態のうちクライアントにない差分を
+// Yjsのupdateとして返す（WebSocketのsync step 1 / step 2と同じ内容）
+// オフラインだったクライアントがWebSocketの接続前に（または接続せずに）追いつくためと、
+// ポーリングで状態を取得する連携のためのもの。
+// ボディが空の場合は状態全体を返す。認可はWebSocketの接続と同じく行い、トークンがobserverの場合は
+// REDACT_FIELDSを取り除く。
+func HandleDiff(c echo.Context) error {
+	name, grant, err := authorizeRoomAPI(c)
+	if err != nil {
+		return err
+	}
+
+	stateVector, err := io.ReadAll(io.LimitReader(c.Request().Body, int64(maxUpdateBytes)+1))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to read request body")
+	}
+	if len(stateVector) > maxUpdateBytes {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "state vector too large")
+	}
+	if len(stateVector) == 0 {
+		// 空のstate vector（クライアント0件）
+		stateVector = []byte{0}
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), storeTimeout)
+	defer cancel()
+	state, err := loadRoomState(ctx, name)
+	if os.IsNotExist(err) {
+		return echo.NewHTTPError(http.StatusNotFound, "room not found")
+	}
+	if err != nil {
+		logger.Error("error loading state", "room", name, "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load room state")
+	}
+
+	msg, err := encodeSyncStep2(state, stateVector)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid state vector")
+	}
+	_, update, _ := decodeSyncMessage(msg)
+	update, ok := transformUpdate(Recipient{Room: name, Observer: grant.Observer}, update)
+	if !ok {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to prepare update")
+	}
+	return c.Blob(http.StatusOK, echo.MIMEOctetStream, update)
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// 設定ファイル（CONFIG_FILE）の値を、環境変数を読み込む前に環境変数として設定する
+	_ "reactflow-yjs/backend/config"
+)
+
+var (
+	// 読み込めなかった環境変数（起動時にConfigErrorで確認する）
+	configErrors      []error
+	configErrorsMutex sync.Mutex
+)
+
+// invalidEnv 読み込めなかった環境変数を記録する
+func invalidEnv(name, value string, err error) {
+	logger.Error("invalid environment variable", "name", name, "value", value, "error", err)
+	configErrorsMutex.Lock()
+	configErrors = append(configErrors, fmt.Errorf("invalid %s %q: %w", name, value, err))
+	configErrorsMutex.Unlock()
+}
+
+// ConfigError 読み込めなかった環境変数があればエラーを返す
+// 設定の誤りに気付かずにデフォルト値で動き続けないよう、起動時に確認して終了する。
+func ConfigError() error {
+	configErrorsMutex.Lock()
+	defer configErrorsMutex.Unlock()
+	return errors.Join(configErrors...)
+}
+
+// envString 環境変数を読み込む（未設定の場合はデフォルト値）
+func envString(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// ParseList カンマ区切りの設定値を分割（空の要素は除く）
+func ParseList(v string) []string {
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// envDuration 環境変数から時間（"30s"などの形式）を読み込む
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		invalidEnv(name, v, err)
+		return def
+	}
+	return d
+}
+
+// envInt 環境変数から整数を読み込む
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		invalidEnv(name, v, err)
+		return def
+	}
+	return n
+}
+
+// envBool 環境変数から真偽値（"true", "1" など）を読み込む
+func envBool(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		invalidEnv(name, v, err)
+		return def
+	}
+	return b
+}
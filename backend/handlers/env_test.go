@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInvalidEnvIsConfigError(t *testing.T) {
+	configErrorsMutex.Lock()
+	prev := configErrors
+	configErrors = nil
+	configErrorsMutex.Unlock()
+	t.Cleanup(func() {
+		configErrorsMutex.Lock()
+		configErrors = prev
+		configErrorsMutex.Unlock()
+	})
+
+	t.Setenv("TEST_INTERVAL", "30")
+	t.Setenv("TEST_LIMIT", "10")
+	if d := envDuration("TEST_INTERVAL", time.Minute); d != time.Minute {
+		t.Errorf("envDuration = %s, want default", d)
+	}
+	if n := envInt("TEST_LIMIT", 5); n != 10 {
+		t.Errorf("envInt = %d, want 10", n)
+	}
+
+	err := ConfigError()
+	if err == nil || !strings.Contains(err.Error(), "TEST_INTERVAL") || strings.Contains(err.Error(), "TEST_LIMIT") {
+		t.Errorf("ConfigError() = %v, want only TEST_INTERVAL", err)
+	}
+}
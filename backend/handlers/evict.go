@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"context"
+	"time"
+)
+
+// 使われていないroomの破棄
+// 全クライアントが切断したroomはROOM_IDLE_TTLの間メモリに残し（再接続時に読み込み直さない）、
+// 経過したら一覧から取り除く。次に接続したときは保存済みの状態から読み込み直す。
+var (
+	// 空のroomをメモリに残す時間（0以下の場合は最後のクライアントの切断時に取り除く）
+	roomIdleTTL = envDuration("ROOM_IDLE_TTL", time.Hour)
+	// 破棄するときに保存済みの状態とスナップショットも削除するかどうか
+	roomEvictPersistence = envBool("ROOM_EVICT_PERSISTENCE", false)
+)
+
+// roomEvictInterval 破棄するroomを確認する間隔
+const roomEvictInterval = time.Minute
+
+func init() {
+	go roomEvictor()
+}
+
+// roomEvictor 定期的に空のままROOM_IDLE_TTLが経過したroomを破棄する
+func roomEvictor() {
+	ticker := time.NewTicker(roomEvictInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		evictIdleRooms(time.Now(), roomIdleTTL)
+	}
+}
+
+// evictIdleRooms 空のままttlが経過したroomを破棄する
+// 参加処理中のroomはjoiningで数えるため、接続中・接続しようとしているクライアントがいるroomは破棄されない。
+// 保存できていない変更があるroomや縮退モードのroomは、メモリ上の状態を失わないよう保存できるまで残す
+// （自動保存が保存し直す）。保存の確認は保存中に待たされるため、roomsMutexの外で行う。
+// 一覧から取り除くのはroomsMutexを保持して行い、保存済みの状態の削除はロックを外してから行う。
+func evictIdleRooms(now time.Time, ttl time.Duration) {
+	var candidates []*Room
+	roomsMutex.Lock()
+	for _, room := range rooms {
+		if room.idle(now, ttl) {
+			candidates = append(candidates, room)
+		}
+	}
+	roomsMutex.Unlock()
+
+	var saved []*Room
+	for _, room := range candidates {
+		if room.degraded.Load() || room.unsaved() {
+			logger.Debug("keeping idle room with unsaved changes", "room", room.name)
+			continue
+		}
+		saved = append(saved, room)
+	}
+
+	var evicted []*Room
+	roomsMutex.Lock()
+	for _, room := range saved {
+		// 確認している間に参加・削除されたroomは破棄しない
+		if rooms[room.name] == room && room.idle(now, ttl) {
+			room.evict()
+			evicted = append(evicted, room)
+		}
+	}
+	roomsMutex.Unlock()
+
+	for _, room := range evicted {
+		room.removeEvictedState()
+	}
+}
+
+// idle 空のままttlが経過しているかどうか（roomsMutexを保持して呼び出す）
+func (r *Room) idle(now time.Time, ttl time.Duration) bool {
+	if r.joining > 0 || r.clientCount() > 0 || r.deleting.Load() || r.idleSince.IsZero() {
+		return false
+	}
+	return now.Sub(r.idleSince) >= ttl
+}
+
+// 保存済みの状態を削除中のroom（room名 -> 削除が終わったら閉じるチャネル、roomsMutexで保護）
+// 削除が終わる前に同じ名前のroomを読み込むと、削除される前の状態を読み込んでしまうため、
+// joinRoomは読み込みの前にこれを待つ。
+var evictingRooms = make(map[string]chan struct{})
+
+// evict roomを一覧から取り除く（roomsMutexを保持して呼び出す）
+// ROOM_EVICT_PERSISTENCEが有効な場合は、ロックを外してからremoveEvictedStateを呼び出すこと。
+func (r *Room) evict() {
+	delete(rooms, r.name)
+	forgetRoomMetrics(r.name)
+
+	if !roomEvictPersistence {
+		logger.Info("room evicted from memory", "room", r.name)
+		return
+	}
+	evictingRooms[r.name] = make(chan struct{})
+}
+
+// removeEvictedState 取り除いたroomの保存済みの状態とスナップショットを削除する
+// （ROOM_EVICT_PERSISTENCEが無効の場合は何もしない）
+func (r *Room) removeEvictedState() {
+	roomsMutex.Lock()
+	done, ok := evictingRooms[r.name]
+	roomsMutex.Unlock()
+	if !ok {
+		return
+	}
+	defer func() {
+		roomsMutex.Lock()
+		delete(evictingRooms, r.name)
+		roomsMutex.Unlock()
+		close(done)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if err := stateStore.Delete(ctx, r.name); err != nil {
+		logger.Error("error deleting state of evicted room", "room", r.name, "error", err)
+	}
+	if store := snapshotStore(); store != nil {
+		snapshots, err := store.ListSnapshots(ctx, r.name)
+		if err != nil {
+			logger.Error("error listing snapshots of evicted room", "room", r.name, "error", err)
+		}
+		for _, s := range snapshots {
+			if err := store.DeleteSnapshot(ctx, r.name, s.Timestamp); err != nil {
+				logger.Error("error deleting snapshot of evicted room", "room", r.name, "snapshot", s.Timestamp, "error", err)
+			}
+		}
+	}
+	logger.Info("room evicted with its persisted state", "room", r.name)
+}
@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// blockingDeleteStore 削除をreleaseが閉じられるまで止めるStateStore
+type blockingDeleteStore struct {
+	StateStore
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingDeleteStore) Delete(ctx context.Context, room string) error {
+	close(s.started)
+	<-s.release
+	return s.StateStore.Delete(ctx, room)
+}
+
+// failingSaveStore failがtrueの間、保存に失敗するStateStore
+type failingSaveStore struct {
+	StateStore
+	fail atomic.Bool
+}
+
+func (s *failingSaveStore) Save(ctx context.Context, room string, data []byte) error {
+	if s.fail.Load() {
+		return errors.New("disk full")
+	}
+	return s.StateStore.Save(ctx, room, data)
+}
+
+func TestUnsavedRoomNotEvicted(t *testing.T) {
+	store := &failingSaveStore{StateStore: useTempStore(t)}
+	store.fail.Store(true)
+	stateStore = store
+	prev := roomIdleTTL
+	roomIdleTTL = 0
+	t.Cleanup(func() { roomIdleTTL = prev })
+	forgetRooms(t, "unsaved-room")
+
+	room := newTestRoom("unsaved-room")
+	room.sharedState = mapSetUpdate(1, 0, "nodesById", "a", "x")
+	c := newTestClient(room)
+	roomsMutex.Lock()
+	rooms[room.name] = room
+	roomsMutex.Unlock()
+
+	// 最後のクライアントが抜けても、保存できなければTTLに関係なく残す
+	room.removeClient(c)
+	if findRoom(room.name) != room {
+		t.Fatal("room was evicted although its state could not be saved")
+	}
+	if !room.degraded.Load() {
+		t.Fatal("room is not degraded after the failed save")
+	}
+	evictIdleRooms(time.Now().Add(time.Hour), 0)
+	if findRoom(room.name) != room {
+		t.Fatal("degraded room was evicted")
+	}
+
+	// 保存できるようになれば、次の確認で破棄する
+	store.fail.Store(false)
+	if err := room.saveState(); err != nil {
+		t.Fatal(err)
+	}
+	evictIdleRooms(time.Now().Add(time.Hour), 0)
+	if findRoom(room.name) != nil {
+		t.Fatal("room was not evicted after its state was saved")
+	}
+	data, err := loadPersisted(context.Background(), room.name)
+	if err != nil || !bytes.Equal(data, room.state()) {
+		t.Fatalf("persisted state = %x (%v), want the room's state", data, err)
+	}
+}
+
+func TestEvictSkipsRoomWithUnsavedChanges(t *testing.T) {
+	useTempStore(t)
+	forgetRooms(t, "dirty-room")
+
+	room := newTestRoom("dirty-room")
+	room.sharedState = mapSetUpdate(1, 0, "nodesById", "a", "x")
+	room.idleSince = time.Now().Add(-time.Hour)
+	roomsMutex.Lock()
+	rooms[room.name] = room
+	roomsMutex.Unlock()
+
+	evictIdleRooms(time.Now(), time.Minute)
+	if findRoom(room.name) != room {
+		t.Fatal("room with unsaved changes was evicted")
+	}
+}
+
+func TestEvictDeletesStateOutsideRoomsMutex(t *testing.T) {
+	store := &blockingDeleteStore{
+		StateStore: useTempStore(t),
+		started:    make(chan struct{}),
+		release:    make(chan struct{}),
+	}
+	stateStore = store
+	prev := roomEvictPersistence
+	roomEvictPersistence = true
+	t.Cleanup(func() { roomEvictPersistence = prev })
+	forgetRooms(t, "evicted-room", "other-room")
+
+	ctx := context.Background()
+	if err := store.Save(ctx, "evicted-room", EncodePersisted(mapSetUpdate(1, 0, "nodesById", "a", "x"))); err != nil {
+		t.Fatal(err)
+	}
+	room := newTestRoom("evicted-room")
+	room.idleSince = time.Now().Add(-roomIdleTTL)
+	roomsMutex.Lock()
+	rooms[room.name] = room
+	roomsMutex.Unlock()
+
+	evicted := make(chan struct{})
+	go func() {
+		evictIdleRooms(time.Now(), roomIdleTTL)
+		close(evicted)
+	}()
+	<-store.started
+
+	// 削除中も他のroomには参加できる
+	done := make(chan error, 1)
+	go func() {
+		_, err := joinRoom("other-room", &client{send: make(chan []byte, 16), log: logger})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("joinRoom(other-room): %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("joinRoom(other-room) blocked while an evicted room was being deleted")
+	}
+
+	// 同じ名前のroomは削除が終わってから読み込むため、削除前の状態を読み込まない
+	c := &client{send: make(chan []byte, 16), log: logger}
+	go func() {
+		_, err := joinRoom("evicted-room", c)
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("joinRoom(evicted-room) returned before the evicted state was deleted")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(store.release)
+	<-evicted
+	if err := <-done; err != nil {
+		t.Fatalf("joinRoom(evicted-room): %v", err)
+	}
+	if state := c.room.state(); len(state) != 0 {
+		t.Fatalf("rejoined room loaded %d bytes of evicted state", len(state))
+	}
+}
+
+func TestIdleRoomEvictedAndReloaded(t *testing.T) {
+	useTempStore(t)
+	forgetRooms(t, "idle-evict-test")
+	url := newTestServer(t)
+	const ttl = 50 * time.Millisecond
+
+	conn := dialRoom(t, url, "idle-evict-test")
+	update := mapSetUpdate(1, 0, "nodesById", "a", "x")
+	if err := conn.WriteMessage(websocket.BinaryMessage, encodeSyncMessage(syncUpdate, update)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, time.Second, "update to be applied", func() bool {
+		room := findRoom("idle-evict-test")
+		return room != nil && len(room.state()) > 0
+	})
+	room := findRoom("idle-evict-test")
+	conn.Close()
+	waitFor(t, time.Second, "client to leave", func() bool { return room.clientCount() == 0 })
+
+	// TTLが経過するまでは残す
+	waitFor(t, time.Second, "room to become idle", func() bool {
+		roomsMutex.Lock()
+		defer roomsMutex.Unlock()
+		return !room.idleSince.IsZero()
+	})
+	evictIdleRooms(time.Now(), time.Hour)
+	if findRoom("idle-evict-test") != room {
+		t.Fatal("room was evicted before the TTL")
+	}
+	time.Sleep(ttl)
+	evictIdleRooms(time.Now(), ttl)
+	if findRoom("idle-evict-test") != nil {
+		t.Fatal("idle room was not evicted after the TTL")
+	}
+
+	// 再接続すると保存済みの状態から読み込み直す
+	conn = dialRoom(t, url, "idle-evict-test")
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	subtype, payload, err := decodeSyncMessage(msg)
+	if err != nil || subtype != syncStep2 || !bytes.Equal(payload, room.state()) {
+		t.Fatalf("first message after reload = %x, want sync step 2 with the saved state", msg)
+	}
+	if reloaded := findRoom("idle-evict-test"); reloaded == nil || reloaded == room {
+		t.Fatal("room was not reloaded")
+	}
+}
@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"reactflow-yjs/backend/yjsutil"
+
+	"github.com/labstack/echo/v4"
+)
+
+// フロー図のエクスポート
+// サーバー側でデコードしたノードとエッジを、Markdownに埋め込んだり他のグラフツールに
+// 読み込んだりできるテキスト形式（Mermaid / GraphML / DOT）に変換する。
+// ラベルはノードの data.label（なければid）、エッジの label を使う。
+// 存在しないノードを参照するエッジは出力しない。
+
+// exportFormat エクスポート形式
+type exportFormat struct {
+	contentType string
+	encode      func(g *exportGraph) []byte
+}
+
+// exportFormats 対応しているエクスポート形式（?format=の値）
+var exportFormats = map[string]exportFormat{
+	"mermaid": {"text/plain; charset=UTF-8", encodeMermaid},
+	"graphml": {"application/xml; charset=UTF-8", encodeGraphML},
+	"dot":     {"text/vnd.graphviz; charset=UTF-8", encodeDOT},
+}
+
+// exportGraph エクスポートするグラフ（ノードとエッジはidの順）
+type exportGraph struct {
+	name  string
+	nodes []exportNode
+	edges []exportEdge
+}
+
+type exportNode struct {
+	id, label string
+	x, y      float64
+}
+
+type exportEdge struct {
+	id, source, target, label string
+}
+
+// newExportGraph フロー図からエクスポートするグラフを作成
+func newExportGraph(flow *Flow) *exportGraph {
+	g := &exportGraph{name: flow.Room}
+	ids := make(map[string]bool, len(flow.Nodes))
+	for _, v := range flow.Nodes {
+		node, _ := v.(map[string]any)
+		id, _ := node["id"].(string)
+		if id == "" || ids[id] {
+			continue
+		}
+		ids[id] = true
+		n := exportNode{id: id, label: id}
+		if data, ok := node["data"].(map[string]any); ok {
+			if label := labelString(data["label"]); label != "" {
+				n.label = label
+			}
+		}
+		if pos, ok := node["position"].(map[string]any); ok {
+			n.x, n.y = toFloat(pos["x"]), toFloat(pos["y"])
+		}
+		g.nodes = append(g.nodes, n)
+	}
+
+	for _, v := range flow.Edges {
+		edge, _ := v.(map[string]any)
+		e := exportEdge{label: labelString(edge["label"])}
+		e.id, _ = edge["id"].(string)
+		e.source, _ = edge["source"].(string)
+		e.target, _ = edge["target"].(string)
+		if !ids[e.source] || !ids[e.target] {
+			continue
+		}
+		g.edges = append(g.edges, e)
+	}
+	return g
+}
+
+// labelString ラベルの値を文字列にする（文字列以外の数値などもそのまま表示する）
+func labelString(v any) string {
+	switch v := v.(type) {
+	case nil, yjsutil.Undefined:
+		return ""
+	case string:
+		return v
+	case map[string]any, []any:
+		// React Flowではラベルに要素も指定できるが、テキストとしては表現できない
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// toFloat 数値を float64 にする（数値でなければ0）
+func toFloat(v any) float64 {
+	switch v := v.(type) {
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	case yjsutil.BigInt64:
+		return float64(v)
+	default:
+		return 0
+	}
+}
+
+// encodeMermaid Mermaidのフローチャート
+// Mermaidのidに使えない文字を避けるため、ノードはn0, n1, ...という連番のidにする。
+func encodeMermaid(g *exportGraph) []byte {
+	var b bytes.Buffer
+	b.WriteString("flowchart TD\n")
+	ids := make(map[string]string, len(g.nodes))
+	for i, n := range g.nodes {
+		ids[n.id] = "n" + strconv.Itoa(i)
+		fmt.Fprintf(&b, "    %s[\"%s\"]\n", ids[n.id], mermaidEscape(n.label))
+	}
+	for _, e := range g.edges {
+		if e.label != "" {
+			fmt.Fprintf(&b, "    %s -->|\"%s\"| %s\n", ids[e.source], mermaidEscape(e.label), ids[e.target])
+		} else {
+			fmt.Fprintf(&b, "    %s --> %s\n", ids[e.source], ids[e.target])
+		}
+	}
+	return b.Bytes()
+}
+
+// mermaidEscaper 引用符で囲んだMermaidのラベルで特別な意味を持つ文字をエンティティにする
+var mermaidEscaper = strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;", "\r\n", "<br>", "\n", "<br>")
+
+func mermaidEscape(s string) string {
+	return mermaidEscaper.Replace(s)
+}
+
+// graphML GraphMLの文書
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   graphMLGraph `xml:"graph"`
+}
+
+type graphMLKey struct {
+	ID   string `xml:"id,attr"`
+	For  string `xml:"for,attr"`
+	Name string `xml:"attr.name,attr"`
+	Type string `xml:"attr.type,attr"`
+}
+
+type graphMLGraph struct {
+	ID          string        `xml:"id,attr"`
+	EdgeDefault string        `xml:"edgedefault,attr"`
+	Nodes       []graphMLNode `xml:"node"`
+	Edges       []graphMLEdge `xml:"edge"`
+}
+
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	ID     string        `xml:"id,attr,omitempty"`
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+// encodeGraphML GraphML（ノードのラベルと座標、エッジのラベルを属性として出力）
+func encodeGraphML(g *exportGraph) []byte {
+	doc := graphML{
+		Xmlns: "http://graphml.graphdrawing.org/xmlns",
+		Keys: []graphMLKey{
+			{ID: "label", For: "node", Name: "label", Type: "string"},
+			{ID: "x", For: "node", Name: "x", Type: "double"},
+			{ID: "y", For: "node", Name: "y", Type: "double"},
+			{ID: "edgeLabel", For: "edge", Name: "label", Type: "string"},
+		},
+		Graph: graphMLGraph{ID: g.name, EdgeDefault: "directed"},
+	}
+	for _, n := range g.nodes {
+		doc.Graph.Nodes = append(doc.Graph.Nodes, graphMLNode{ID: n.id, Data: []graphMLData{
+			{Key: "label", Value: n.label},
+			{Key: "x", Value: strconv.FormatFloat(n.x, 'f', -1, 64)},
+			{Key: "y", Value: strconv.FormatFloat(n.y, 'f', -1, 64)},
+		}})
+	}
+	for _, e := range g.edges {
+		edge := graphMLEdge{ID: e.id, Source: e.source, Target: e.target}
+		if e.label != "" {
+			edge.Data = []graphMLData{{Key: "edgeLabel", Value: e.label}}
+		}
+		doc.Graph.Edges = append(doc.Graph.Edges, edge)
+	}
+
+	data, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		// 文字列と数値だけの構造体なので失敗しない
+		panic(err)
+	}
+	return append(append([]byte(xml.Header), data...), '\n')
+}
+
+// encodeDOT GraphvizのDOT（有向グラフ）
+func encodeDOT(g *exportGraph) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "digraph %s {\n", dotQuote(g.name))
+	for _, n := range g.nodes {
+		fmt.Fprintf(&b, "  %s [label=%s];\n", dotQuote(n.id), dotQuote(n.label))
+	}
+	for _, e := range g.edges {
+		fmt.Fprintf(&b, "  %s -> %s", dotQuote(e.source), dotQuote(e.target))
+		if e.label != "" {
+			fmt.Fprintf(&b, " [label=%s]", dotQuote(e.label))
+		}
+		b.WriteString(";\n")
+	}
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+// dotEscaper DOTの引用符で囲んだ文字列のエスケープ
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\r\n", `\n`, "\n", `\n`)
+
+func dotQuote(s string) string {
+	return `"` + dotEscaper.Replace(s) + `"`
+}
+
+// HandleExportFlow roomのフロー図を?format=（mermaid / graphml / dot）の形式で返す
+// 認可はGET /api/rooms/:room/flowと同じく行う。
+func HandleExportFlow(c echo.Context) error {
+	format, ok := exportFormats[c.QueryParam("format")]
+	if !ok {
+		names := make([]string, 0, len(exportFormats))
+		for name := range exportFormats {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return echo.NewHTTPError(http.StatusBadRequest, "format must be one of: "+strings.Join(names, ", "))
+	}
+	name, grant, err := authorizeRoomAPI(c)
+	if err != nil {
+		return err
+	}
+	flow, err := roomFlow(c, name, grant)
+	if err != nil {
+		return err
+	}
+	return c.Blob(http.StatusOK, format.contentType, format.encode(newExportGraph(flow)))
+}
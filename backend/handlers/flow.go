@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sort"
+
+	"reactflow-yjs/backend/yjsutil"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Flow roomのフロー図（フロントエンドのnodesById / edgesByIdの内容）
+type Flow struct {
+	Room  string `json:"room"`
+	Nodes []any  `json:"nodes"` // React FlowのNode（idの順）
+	Edges []any  `json:"edges"` // React FlowのEdge（idの順）
+}
+
+// loadRoomState 使用中のroomの状態、なければ保存済みの状態を返す（どちらもなければos.ErrNotExist）
+func loadRoomState(ctx context.Context, name string) ([]byte, error) {
+	if room := findRoom(name); room != nil {
+		return room.state(), nil
+	}
+	data, err := loadPersisted(ctx, name)
+	if err == nil && data == nil {
+		err = os.ErrNotExist
+	}
+	return data, err
+}
+
+// decodeFlow YDocの状態からフロー図を取り出す
+func decodeFlow(name string, state []byte) (*Flow, error) {
+	flow := &Flow{Room: name, Nodes: []any{}, Edges: []any{}}
+	if len(state) == 0 {
+		return flow, nil
+	}
+	doc, err := yjsutil.DecodeDocument(state)
+	if err != nil {
+		return nil, err
+	}
+	flow.Nodes = sortedValues(doc.Map("nodesById"))
+	flow.Edges = sortedValues(doc.Map("edgesById"))
+	return flow, nil
+}
+
+// sortedValues マップの値をキーの順に並べる（出力を安定させるため）
+func sortedValues(m map[string]any) []any {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	values := make([]any, 0, len(keys))
+	for _, key := range keys {
+		values = append(values, m[key])
+	}
+	return values
+}
+
+// HandleGetFlow roomのフロー図をノードとエッジのJSONで返す
+// Yjsのクライアントを使わずに、CIやドキュメント生成などから現在の図を参照するためのもの。
+// 認可はWebSocketの接続と同じく行い、トークンがobserverの場合はREDACT_FIELDSを取り除く。
+func HandleGetFlow(c echo.Context) error {
+	name, grant, err := authorizeRoomAPI(c)
+	if err != nil {
+		return err
+	}
+	flow, err := roomFlow(c, name, grant)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, flow)
+}
+
+// roomFlow 認可済みのリクエストのroomのフロー図を読み込む（エラーはHTTPのエラーとして返す）
+// observerの場合はREDACT_FIELDSを取り除いた状態からデコードする。
+func roomFlow(c echo.Context, name string, grant Grant) (*Flow, error) {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), storeTimeout)
+	defer cancel()
+	state, err := loadRoomState(ctx, name)
+	if os.IsNotExist(err) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "room not found")
+	}
+	if err != nil {
+		logger.Error("error loading state", "room", name, "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to load room state")
+	}
+	state, ok := transformUpdate(Recipient{Room: name, Observer: grant.Observer}, state)
+	if !ok {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to prepare room state")
+	}
+
+	flow, err := decodeFlow(name, state)
+	if err != nil {
+		logger.Error("error decoding flow", "room", name, "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to decode room state")
+	}
+	return flow, nil
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// nodeSetUpdate nodesByIdのkeyに {"id": key, "data": {"label": label, "secret": secret}} を書き込むv1形式のupdate
+func nodeSetUpdate(client uint64, key, label, secret string) []byte {
+	appendString := func(b []byte, s string) []byte {
+		return appendVarUint8Array(append(b, 119), []byte(s))
+	}
+	u := appendVarUint(nil, 1) // クライアント数
+	u = appendVarUint(u, 1)    // struct数
+	u = appendVarUint(u, client)
+	u = appendVarUint(u, 0)
+	u = append(u, 8|0x20) // ContentAny、parentSubあり
+	u = appendVarUint(u, 1)
+	u = appendVarUint8Array(u, []byte("nodesById"))
+	u = appendVarUint8Array(u, []byte(key))
+	u = appendVarUint(u, 1)
+	u = append(u, 118) // オブジェクト
+	u = appendVarUint(u, 2)
+	u = appendVarUint8Array(u, []byte("id"))
+	u = appendString(u, key)
+	u = appendVarUint8Array(u, []byte("data"))
+	u = append(u, 118)
+	u = appendVarUint(u, 2)
+	u = appendVarUint8Array(u, []byte("label"))
+	u = appendString(u, label)
+	u = appendVarUint8Array(u, []byte("secret"))
+	u = appendString(u, secret)
+	return appendVarUint(u, 0) // 削除なし
+}
+
+func TestGetFlowAuthorization(t *testing.T) {
+	store := useTempStore(t)
+	const name = "flow-auth"
+	if err := store.Save(context.Background(), name, nodeSetUpdate(1, "n1", "Start", "s3cret")); err != nil {
+		t.Fatal(err)
+	}
+
+	secret := []byte("test-secret")
+	prevSecret, prevAuthorizer, prevFields := roomTokenSecret, authorizer, redactFields
+	roomTokenSecret, authorizer, redactFields = secret, authorizeRoomToken, []string{"data.secret"}
+	RegisterTransform(name, redactForObservers)
+	t.Cleanup(func() {
+		roomTokenSecret, authorizer, redactFields = prevSecret, prevAuthorizer, prevFields
+		transformsMutex.Lock()
+		delete(transforms, name)
+		transformsMutex.Unlock()
+	})
+
+	e := echo.New()
+	e.GET("/api/rooms/:room/flow", HandleGetFlow)
+	get := func(query string) (int, *Flow) {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest("GET", "/api/rooms/"+name+"/flow"+query, nil))
+		if rec.Code != http.StatusOK {
+			return rec.Code, nil
+		}
+		var flow Flow
+		if err := json.Unmarshal(rec.Body.Bytes(), &flow); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, &flow
+	}
+	dataOf := func(flow *Flow) map[string]any {
+		if len(flow.Nodes) != 1 {
+			t.Fatalf("nodes = %v, want 1 node", flow.Nodes)
+		}
+		node, _ := flow.Nodes[0].(map[string]any)
+		data, _ := node["data"].(map[string]any)
+		return data
+	}
+	expires := time.Now().Add(time.Hour)
+
+	if code, _ := get(""); code != http.StatusUnauthorized {
+		t.Errorf("without token: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code, _ := get("?token=" + SignRoomToken(secret, "other", "", expires)); code != http.StatusForbidden {
+		t.Errorf("token for another room: status = %d, want %d", code, http.StatusForbidden)
+	}
+
+	code, flow := get("?token=" + SignRoomToken(secret, name, "", expires))
+	if code != http.StatusOK {
+		t.Fatalf("writer token: status = %d", code)
+	}
+	if data := dataOf(flow); data["secret"] != "s3cret" {
+		t.Errorf("writer token: data = %v, want secret", data)
+	}
+
+	code, flow = get("?token=" + SignRoomToken(secret, name, "observe", expires))
+	if code != http.StatusOK {
+		t.Fatalf("observer token: status = %d", code)
+	}
+	data := dataOf(flow)
+	if _, ok := data["secret"]; ok || data["label"] != "Start" {
+		t.Errorf("observer token: data = %v, want label without secret", data)
+	}
+}
+
+func TestExportFlowAuthorization(t *testing.T) {
+	store := useTempStore(t)
+	const name = "export-auth"
+	if err := store.Save(context.Background(), name, nodeSetUpdate(1, "n1", "Start", "s3cret")); err != nil {
+		t.Fatal(err)
+	}
+
+	secret := []byte("test-secret")
+	prevSecret, prevAuthorizer := roomTokenSecret, authorizer
+	roomTokenSecret, authorizer = secret, authorizeRoomToken
+	t.Cleanup(func() { roomTokenSecret, authorizer = prevSecret, prevAuthorizer })
+
+	e := echo.New()
+	e.GET("/api/rooms/:room/export", HandleExportFlow)
+	get := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest("GET", "/api/rooms/"+name+"/export?format=mermaid"+query, nil))
+		return rec
+	}
+
+	if rec := get(""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without token: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	rec := get("&token=" + SignRoomToken(secret, name, "read", time.Now().Add(time.Hour)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("read token: status = %d", rec.Code)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, "Start") {
+		t.Errorf("read token: body = %q, want node label", body)
+	}
+}
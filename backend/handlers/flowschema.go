@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"reactflow-yjs/backend/yjsutil"
+)
+
+// フロー図のスキーマ検証
+// FLOW_VALIDATIONが有効な場合、クライアントのupdateをマージした後のnodesById / edgesByIdを検証し、
+// 必須のフィールドがない、存在しないノードを参照するエッジがある、ノード数が上限を超えるなど、
+// 図を壊すupdateは適用も転送もせずに拒否する。
+// 同時編集の結果（ノードの削除と同時に張られたエッジなど）で既に違反がある状態でも編集を続けられるよう、
+// マージ前の状態になかった違反を新たに生むupdateのみを拒否する。
+// 状態全体をデコードするため、updateごとのコストは状態のサイズに比例する。
+var (
+	flowValidation = envBool("FLOW_VALIDATION", false)
+	// ノード数の上限（0以下の場合は制限しない）
+	flowMaxNodes = envInt("FLOW_MAX_NODES", 0)
+)
+
+// flowValidationError updateがフロー図のスキーマに違反する
+type flowValidationError struct {
+	violations []string
+}
+
+func (e *flowValidationError) Error() string {
+	return "flow validation failed: " + strings.Join(e.violations, "; ")
+}
+
+// validateFlowUpdate マージ後の状態がマージ前になかったスキーマ違反を含んでいればエラーを返す
+func validateFlowUpdate(prev, merged []byte) error {
+	before, beforeNodes, err := flowViolations(prev)
+	if err != nil {
+		return err
+	}
+	after, afterNodes, err := flowViolations(merged)
+	if err != nil {
+		return err
+	}
+
+	var added []string
+	for v := range after {
+		if !before[v] {
+			added = append(added, v)
+		}
+	}
+	if flowMaxNodes > 0 && afterNodes > flowMaxNodes && afterNodes > beforeNodes {
+		added = append(added, fmt.Sprintf("too many nodes (%d, max %d)", afterNodes, flowMaxNodes))
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	sort.Strings(added)
+	return &flowValidationError{violations: added}
+}
+
+// flowViolations 状態に含まれるノードとエッジのスキーマ違反と、ノード数を返す
+func flowViolations(state []byte) (map[string]bool, int, error) {
+	violations := make(map[string]bool)
+	if len(state) == 0 {
+		return violations, 0, nil
+	}
+	doc, err := yjsutil.DecodeDocument(state)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	nodes := doc.Map(yjsutil.NodesMapName)
+	for key, v := range nodes {
+		node, ok := v.(map[string]any)
+		if !ok {
+			violations[fmt.Sprintf("node %q is not an object", key)] = true
+			continue
+		}
+		if id, _ := node["id"].(string); id != key {
+			violations[fmt.Sprintf("node %q has a mismatched id", key)] = true
+		}
+		position, _ := node["position"].(map[string]any)
+		if !isNumber(position["x"]) || !isNumber(position["y"]) {
+			violations[fmt.Sprintf("node %q has no valid position", key)] = true
+		}
+	}
+
+	for key, v := range doc.Map(yjsutil.EdgesMapName) {
+		edge, ok := v.(map[string]any)
+		if !ok {
+			violations[fmt.Sprintf("edge %q is not an object", key)] = true
+			continue
+		}
+		if id, _ := edge["id"].(string); id != key {
+			violations[fmt.Sprintf("edge %q has a mismatched id", key)] = true
+		}
+		for _, end := range []string{"source", "target"} {
+			id, _ := edge[end].(string)
+			if _, ok := nodes[id]; !ok {
+				violations[fmt.Sprintf("edge %q has a %s that is not an existing node", key, end)] = true
+			}
+		}
+	}
+	return violations, len(nodes), nil
+}
+
+// isNumber lib0のany形式から読み込んだ値が数値かどうか
+func isNumber(v any) bool {
+	switch v.(type) {
+	case int64, float64, yjsutil.BigInt64:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeUpdateRejected updateをスキーマ違反で拒否したクライアントを切断するクローズコード
+const closeUpdateRejected = 4422
+
+// rejectUpdateCloseDelay 拒否を伝える制御メッセージを送ってから切断するまでの時間
+const rejectUpdateCloseDelay = time.Second
+
+// rejectUpdate スキーマ違反で拒否したことをクライアントに伝えて切断する
+// クライアントのYDocには拒否した変更が残っているため、接続を続けると同期がずれたままになる。
+// 再接続しても同じ変更を送ってくるので、クライアントには再読み込みを促す。
+// 切断までに届いたupdateは適用しない。
+func (c *client) rejectUpdate(err *flowValidationError) {
+	if !c.rejected.CompareAndSwap(false, true) {
+		return
+	}
+	c.log.Warn("update rejected by flow validation", "error", err)
+	metricRejectedUpdates.WithLabelValues(c.room.name).Inc()
+	c.sendControl(controlMessage{Type: "update-rejected", Message: strings.Join(err.violations, "; ")})
+	time.AfterFunc(rejectUpdateCloseDelay, func() {
+		c.closeWithCode(closeUpdateRejected, "update rejected")
+	})
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// 永続化ファイルのフォーマット
+//
+//	v0: ヘッダーなし。Yjs updateのバイナリをそのまま保存（旧形式）
+//	v1: マジック "YFLW" + バージョン（varuint） + Yjs update（v1形式）
+const currentFormatVersion = 1
+
+// persistenceMagic バージョン付きファイルの先頭に付けるマジックバイト
+var persistenceMagic = []byte("YFLW")
+
+// errUnsupportedFormat 未対応（新しいバージョン）のフォーマット
+var errUnsupportedFormat = errors.New("unsupported persistence format version")
+
+// EncodePersisted 保存する状態に現在のフォーマットのヘッダーを付ける（cmd/mergeからも使う）
+func EncodePersisted(state []byte) []byte {
+	buf := append([]byte(nil), persistenceMagic...)
+	buf = appendVarUint(buf, currentFormatVersion)
+	return append(buf, state...)
+}
+
+// DecodePersisted 保存されたファイルを読み込み、バージョンに応じて状態を取り出す（cmd/mergeからも使う）
+// 旧形式（v0）はそのまま現在の形式として扱う。未知の新しいバージョンはエラーを返す。
+func DecodePersisted(data []byte) ([]byte, int, error) {
+	if !bytes.HasPrefix(data, persistenceMagic) {
+		return data, 0, nil
+	}
+
+	version, n := readVarUint(data[len(persistenceMagic):])
+	if n == 0 {
+		return nil, 0, fmt.Errorf("%w: missing version", errUnsupportedFormat)
+	}
+	payload := data[len(persistenceMagic)+n:]
+
+	switch version {
+	case 1:
+		return payload, 1, nil
+	default:
+		return nil, int(version), fmt.Errorf("%w: %d (supported: %d)", errUnsupportedFormat, version, currentFormatVersion)
+	}
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ヘルスチェック
+// /healthz はプロセスが応答できるか（liveness）、/readyz は永続化バックエンドとpub/subに
+// 接続でき、新しい接続を受け付けられるか（readiness）を返す。
+
+// readyCheckTimeout readinessの確認1つあたりの最大時間
+const readyCheckTimeout = 2 * time.Second
+
+// HealthChecker 接続できるか確認できる永続化バックエンドまたはBroker
+type HealthChecker interface {
+	Check(ctx context.Context) error
+}
+
+// ReadyStatus /readyz の応答
+type ReadyStatus struct {
+	Status  string            `json:"status"` // "ready" または "not ready"
+	Rooms   int               `json:"rooms"`  // メモリ上のroomの数
+	Clients int               `json:"clients"`
+	Checks  map[string]string `json:"checks"` // 確認した項目 -> "ok" またはエラー
+}
+
+// HandleHealthz プロセスが応答できることを返す（liveness）
+func HandleHealthz(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// HandleReadyz 永続化バックエンドとpub/subを確認し、接続を受け付けられるかを返す（readiness）
+// 終了処理中や確認に失敗した場合は503を返し、ロードバランサーから外させる。
+func HandleReadyz(c echo.Context) error {
+	status := ReadyStatus{Status: "ready", Checks: make(map[string]string)}
+	for _, room := range activeRooms() {
+		status.Rooms++
+		status.Clients += room.clientCount()
+	}
+
+	check := func(name string, v any) {
+		checker, ok := v.(HealthChecker)
+		if !ok {
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request().Context(), readyCheckTimeout)
+		defer cancel()
+		if err := checker.Check(ctx); err != nil {
+			logger.Warn("readiness check failed", "check", name, "error", err)
+			status.Checks[name] = err.Error()
+			status.Status = "not ready"
+			return
+		}
+		status.Checks[name] = "ok"
+	}
+	check("store", stateStore)
+	if broker != nil {
+		check("pubsub", broker)
+	}
+	if shuttingDown.Load() {
+		status.Checks["shutdown"] = "server is shutting down"
+		status.Status = "not ready"
+	}
+
+	if status.Status != "ready" {
+		return c.JSON(http.StatusServiceUnavailable, status)
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+// Check 保存先のディレクトリに書き込めるか確認する
+func (s *FileStore) Check(ctx context.Context) error {
+	f, err := os.CreateTemp(s.dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+// Check データベースに接続できるか確認する
+func (s *SQLStore) Check(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// Check Redisに接続できるか確認する
+func (s *RedisStore) Check(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
+
+// Check バケットにアクセスできるか確認する
+func (s *S3Store) Check(ctx context.Context) error {
+	exists, err := s.client.BucketExists(ctx, s.bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("bucket does not exist: %s", s.bucket)
+	}
+	return nil
+}
+
+// Check Redisに接続できるか確認する
+func (b *RedisBroker) Check(ctx context.Context) error {
+	return b.client.Ping(ctx).Err()
+}
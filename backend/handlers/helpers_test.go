@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+func TestMain(m *testing.M) {
+	// テスト中のログは出力しない（go test -v の場合のみ出力する）
+	flag.Parse()
+	if !testing.Verbose() {
+		logger = slog.New(slog.NewJSONHandler(io.Discard, nil))
+	}
+	os.Exit(m.Run())
+}
+
+// mapSetUpdate ルートのY.Map（mapName）のkeyに文字列を書き込むv1形式のupdate
+// clientのclockから始まる新しいItemを1つだけ含む（Y.Map.setで新しいキーを書き込んだ場合と同じ形）。
+func mapSetUpdate(client, clock uint64, mapName, key, value string) []byte {
+	u := appendVarUint(nil, 1) // クライアント数
+	u = appendVarUint(u, 1)    // struct数
+	u = appendVarUint(u, client)
+	u = appendVarUint(u, clock)
+	u = append(u, 8|0x20) // ContentAny、parentSubあり
+	u = appendVarUint(u, 1)
+	u = appendVarUint8Array(u, []byte(mapName))
+	u = appendVarUint8Array(u, []byte(key))
+	u = appendVarUint(u, 1)
+	u = append(u, 119) // 文字列
+	u = appendVarUint8Array(u, []byte(value))
+	return appendVarUint(u, 0) // 削除なし
+}
+
+// useTempStore テスト中の永続化バックエンドを一時ディレクトリのFileStoreにする
+func useTempStore(t testing.TB) *FileStore {
+	t.Helper()
+	prev := stateStore
+	store := NewFileStore(t.TempDir())
+	stateStore = store
+	t.Cleanup(func() { stateStore = prev })
+	return store
+}
+
+// newTestRoom roomの一覧に登録せずにRoomを作成する
+func newTestRoom(name string) *Room {
+	return &Room{
+		name:      name,
+		clients:   make(map[*client]bool),
+		awareness: awarenessStore{entries: make(map[uint64]*awarenessEntry)},
+	}
+}
+
+// newTestClient room（newTestRoomで作成したもの）に接続したクライアント
+// WebSocketの接続は持たないため、送信したメッセージはsendから読み出す。
+func newTestClient(room *Room) *client {
+	c := &client{
+		send:          make(chan []byte, 16),
+		room:          room,
+		log:           logger,
+		updateLimiter: newUpdateLimiter(),
+	}
+	room.clients[c] = true
+	return c
+}
+
+// newTestServer WebSocketのエンドポイントだけを持つテスト用のサーバーを起動し、ws://のURLを返す
+func newTestServer(t testing.TB) string {
+	t.Helper()
+	e := echo.New()
+	e.GET("/ws/:room", HandleWebSocket)
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// dialRoom テスト用のサーバーのroomに接続する
+func dialRoom(t *testing.T, url, room string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url+"/ws/"+room, nil)
+	if err != nil {
+		t.Fatalf("dial %s: %v", room, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// waitFor condが真になるまで待つ（timeoutを過ぎたらテストを失敗させる）
+func waitFor(t testing.TB, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// roomClients 使用中のroomに接続しているクライアント数（roomがなければ0）
+func roomClients(name string) int {
+	if room := findRoom(name); room != nil {
+		return room.clientCount()
+	}
+	return 0
+}
+
+// loadStoredState 永続化バックエンドに保存されている状態（updateログをマージしたもの）
+func loadStoredState(t *testing.T, name string) []byte {
+	t.Helper()
+	ctx := context.Background()
+	data, err := stateStore.Load(ctx, name)
+	if err != nil {
+		t.Fatalf("Load(%s): %v", name, err)
+	}
+	if data != nil {
+		if data, _, err = DecodePersisted(data); err != nil {
+			t.Fatalf("DecodePersisted(%s): %v", name, err)
+		}
+	}
+	state, _, err := mergeLoggedUpdates(ctx, name, data)
+	if err != nil {
+		t.Fatalf("mergeLoggedUpdates(%s): %v", name, err)
+	}
+	return state
+}
+
+// controlTypes クライアントに送信された制御メッセージのタイプを、送信された順に取り出す
+func controlTypes(c *client) []string {
+	var types []string
+	for {
+		select {
+		case msg := <-c.send:
+			if ctrl, ok := decodeControlMessage(msg); ok {
+				types = append(types, ctrl.Type)
+			}
+		default:
+			return types
+		}
+	}
+}
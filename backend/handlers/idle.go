@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 接続のアイドルタイムアウト
+// ドキュメントを編集しないまま開きっぱなしのタブ（閲覧のみ等）を切断する。
+// 操作として数えるのはsyncのupdateとkeepaliveの制御メッセージのみで、awareness（カーソル位置）や
+// ping/pongは開いているだけのタブからも送られ続けるため数えない。
+// 送信頻度を制限するレート制限とは別の仕組み。
+var (
+	connectionIdleTimeout = envDuration("CONNECTION_IDLE_TIMEOUT", 24*time.Hour)
+	// 切断の何分前に警告の制御メッセージを送るか（0で無効）
+	idleWarningBefore = envDuration("IDLE_WARNING_BEFORE", 5*time.Minute)
+)
+
+func init() {
+	if connectionIdleTimeout > 0 {
+		go idleReaper()
+	}
+}
+
+// touch クライアントが最後に操作した（updateまたはkeepaliveを送った）時刻を記録
+func (c *client) touch() {
+	c.lastSeen.Store(time.Now().UnixNano())
+	c.idleWarned.Store(false)
+}
+
+// idleFor 最後に操作してからの経過時間
+func (c *client) idleFor(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, c.lastSeen.Load()))
+}
+
+// idleReaper 定期的に全roomを走査し、アイドルタイムアウトを超えたクライアントを切断
+func idleReaper() {
+	interval := connectionIdleTimeout / 2
+	if idleWarningBefore > 0 && idleWarningBefore/2 < interval {
+		interval = idleWarningBefore / 2
+	}
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		for _, room := range activeRooms() {
+			for _, c := range room.clientList() {
+				c.checkIdle(now)
+			}
+		}
+	}
+}
+
+// checkIdle アイドルタイムアウトを超えたクライアントを切断し、切断が近ければ一度だけ警告する
+// 警告の判定もtouchの時刻で行うため、awarenessを送り続けているだけのタブにも警告が届く。
+func (c *client) checkIdle(now time.Time) {
+	idle := c.idleFor(now)
+	switch {
+	case idle >= connectionIdleTimeout:
+		c.log.Info("closing idle connection")
+		c.closeWithCode(websocket.CloseGoingAway, "idle timeout")
+	case idleWarningBefore > 0 && idle >= connectionIdleTimeout-idleWarningBefore && !c.idleWarned.Load():
+		// 編集するかkeepaliveを送れば切断されない
+		c.idleWarned.Store(true)
+		c.sendControl(controlMessage{
+			Type:      "idle-warning",
+			Message:   "You will be disconnected due to inactivity",
+			ExpiresIn: int((connectionIdleTimeout - idle).Seconds()),
+		})
+	}
+}
+
+// closeWithCode クローズフレームを送信して接続を閉じる
+// 受信ループがエラーで終了し、通常のクリーンアップが行われる
+func (c *client) closeWithCode(code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	c.conn.Close()
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTouchOnlyOnActivity(t *testing.T) {
+	room := newTestRoom("idle-test")
+	c := newTestClient(room)
+	// 更新は閲覧のみとして破棄させる（アイドルタイムアウトの判定だけを確認する）
+	c.readOnly = true
+
+	stale := time.Now().Add(-time.Hour).UnixNano()
+	tests := []struct {
+		name    string
+		msg     []byte
+		touched bool
+	}{
+		{"awareness", encodeAwarenessMessage([]awarenessUpdateEntry{{clientID: 1, clock: 1, state: `{"cursor":{"x":1,"y":2}}`}}), false},
+		{"query awareness", appendVarUint(nil, messageQueryAwareness), false},
+		{"sync step 1", encodeSyncStep1(nil), false},
+		{"sync update", encodeSyncMessage(syncUpdate, mapSetUpdate(1, 0, "nodesById", "a", "x")), true},
+		{"keepalive", encodeControlMessage(controlMessage{Type: "keepalive"}), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c.lastSeen.Store(stale)
+			c.idleWarned.Store(true)
+			if err := c.handleMessage(tt.msg); err != nil {
+				t.Fatalf("handleMessage: %v", err)
+			}
+			if touched := c.lastSeen.Load() != stale; touched != tt.touched {
+				t.Errorf("touched = %v, want %v", touched, tt.touched)
+			}
+			// 操作すれば警告を送り直せるようになる
+			if warned := c.idleWarned.Load(); warned == tt.touched {
+				t.Errorf("idleWarned = %v, want %v", warned, !tt.touched)
+			}
+		})
+	}
+}
+
+func TestIdleWarningIgnoresAwareness(t *testing.T) {
+	room := newTestRoom("idle-warning-test")
+	c := newTestClient(room)
+	now := time.Now()
+	c.lastSeen.Store(now.Add(-connectionIdleTimeout + idleWarningBefore/2).UnixNano())
+
+	// カーソルを動かし続けても、警告の対象のまま
+	for i := 0; i < 3; i++ {
+		msg := encodeAwarenessMessage([]awarenessUpdateEntry{{clientID: 1, clock: uint64(i), state: `{"cursor":{"x":1,"y":2}}`}})
+		if err := c.handleMessage(msg); err != nil {
+			t.Fatalf("handleMessage: %v", err)
+		}
+	}
+	c.checkIdle(now)
+	c.checkIdle(now)
+
+	var warnings int
+	for len(c.send) > 0 {
+		if ctrl, ok := decodeControlMessage(<-c.send); ok && ctrl.Type == "idle-warning" {
+			warnings++
+		}
+	}
+	if warnings != 1 {
+		t.Fatalf("got %d idle warnings, want 1", warnings)
+	}
+
+	// keepaliveを送れば警告の対象から外れる
+	if err := c.handleMessage(encodeControlMessage(controlMessage{Type: "keepalive"})); err != nil {
+		t.Fatalf("handleMessage: %v", err)
+	}
+	c.checkIdle(time.Now())
+	if len(c.send) > 0 {
+		t.Fatalf("unexpected message after keepalive")
+	}
+}
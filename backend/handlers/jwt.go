@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWTによるroomの認可
+// JWT_SECRET（HS256）または JWT_PUBLIC_KEY_FILE（RS256、PEM形式の公開鍵）を設定すると有効になり、
+// ROOM_TOKEN_SECRETのHMACトークンより優先される。
+
+// roomClaims JWTに必要なクレーム
+type roomClaims struct {
+	Room   string `json:"room"`
+	Access string `json:"access"` // "write"（省略時）、"read"、"observe"
+	jwt.RegisteredClaims
+}
+
+func init() {
+	a, err := newJWTAuthorizer(os.Getenv("JWT_SECRET"), os.Getenv("JWT_PUBLIC_KEY_FILE"))
+	if err != nil {
+		fatal("invalid JWT configuration", "error", err)
+	}
+	if a != nil {
+		authorizer = a
+	}
+}
+
+// newJWTAuthorizer JWTを検証するAuthorizerを作成する（どちらも未設定の場合はnil）
+func newJWTAuthorizer(secret, publicKeyFile string) (Authorizer, error) {
+	var key any
+	var method string
+	switch {
+	case secret != "" && publicKeyFile != "":
+		return nil, errors.New("set either JWT_SECRET or JWT_PUBLIC_KEY_FILE, not both")
+	case secret != "":
+		key, method = []byte(secret), jwt.SigningMethodHS256.Alg()
+	case publicKeyFile != "":
+		pem, err := os.ReadFile(publicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if key, err = jwt.ParseRSAPublicKeyFromPEM(pem); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", publicKeyFile, err)
+		}
+		method = jwt.SigningMethodRS256.Alg()
+	default:
+		return nil, nil
+	}
+	return jwtAuthorizer(key, method), nil
+}
+
+// jwtAuthorizer アップグレード前のリクエストのJWTを検証するAuthorizer
+// トークンは "Authorization: Bearer <token>" ヘッダー、Sec-WebSocket-Protocol
+// （"access_token, <token>"）、または ?token= で指定する。
+// 必要なクレーム:
+//   - sub:    ユーザーID（空でないこと）
+//   - room:   接続を許可するroom名（パスの :room と一致すること）
+//   - exp:    有効期限（必須、接続中に切れた場合は4401で切断する）
+//   - access: "write"（省略時）、"read"（閲覧のみ）、"observe"（閲覧専用のobserver）
+//
+// 検証に失敗した場合はすべて401で拒否する。
+func jwtAuthorizer(key any, method string) Authorizer {
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{method}), jwt.WithExpirationRequired())
+	return func(r *http.Request, room string) (Grant, error) {
+		raw := requestToken(r)
+		if raw == "" {
+			return Grant{}, errMissingToken
+		}
+
+		var claims roomClaims
+		if _, err := parser.ParseWithClaims(raw, &claims, func(*jwt.Token) (any, error) { return key, nil }); err != nil {
+			return Grant{}, errInvalidToken
+		}
+		if claims.Subject == "" {
+			return Grant{}, errInvalidToken
+		}
+		if claims.Room != room {
+			// roomの不一致も401として扱う
+			return Grant{}, errInvalidToken
+		}
+
+		grant := Grant{User: claims.Subject, Expires: claims.ExpiresAt.Time}
+		if err := grant.applyAccess(claims.Access); err != nil {
+			return Grant{}, err
+		}
+		return grant, nil
+	}
+}
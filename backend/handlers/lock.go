@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// roomのロック（プレゼンテーションモード）
+// APIでroomをロックすると、ロックの保持者（ユーザーIDまたはクライアントID）以外の
+// updateを破棄し、クライアントには制御メッセージで編集できないことを通知する。
+// デザインレビューなどで、ファシリテーターだけが図を操作するためのもの。
+// ロックは解除するか期限が切れるまで続き、roomが使用中でなくても保持する（インスタンスごと）。
+var roomLockTTL = envDuration("ROOM_LOCK_TTL", time.Hour)
+
+func init() {
+	if roomLockTTL <= 0 {
+		fatal("ROOM_LOCK_TTL must be positive", "value", roomLockTTL)
+	}
+}
+
+// RoomLock roomのロックの情報
+type RoomLock struct {
+	Holder    string    `json:"holder,omitempty"`   // 保持者のユーザーID
+	ClientID  uint64    `json:"clientId,omitempty"` // 保持者のクライアントID（ユーザーIDがない場合）
+	LockedAt  time.Time `json:"lockedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// heldBy クライアントがロックの保持者かどうか
+func (l *RoomLock) heldBy(c *client) bool {
+	return (l.Holder != "" && l.Holder == c.user) || (l.ClientID != 0 && l.ClientID == c.id)
+}
+
+var (
+	// ロック中のroom（room名 -> ロック）
+	roomLocks      = make(map[string]*RoomLock)
+	roomLocksMutex sync.Mutex
+)
+
+// lockRoom roomをロックする（ロック済みの場合は置き換える）
+func lockRoom(name string, lock RoomLock) *RoomLock {
+	l := &lock
+	roomLocksMutex.Lock()
+	roomLocks[name] = l
+	roomLocksMutex.Unlock()
+
+	// 期限が切れたら、置き換えられていなければ解除する
+	time.AfterFunc(time.Until(l.ExpiresAt), func() {
+		roomLocksMutex.Lock()
+		expired := roomLocks[name] == l
+		if expired {
+			delete(roomLocks, name)
+		}
+		roomLocksMutex.Unlock()
+		if expired {
+			logger.Info("room lock expired", "room", name, "holder", l.Holder, "client_id", l.ClientID)
+			notifyRoomLock(name)
+		}
+	})
+
+	logger.Info("room locked", "room", name, "holder", l.Holder, "client_id", l.ClientID, "expires_at", l.ExpiresAt)
+	notifyRoomLock(name)
+	return l
+}
+
+// unlockRoom roomのロックを解除する（ロックされていなければfalse）
+func unlockRoom(name string) bool {
+	roomLocksMutex.Lock()
+	_, ok := roomLocks[name]
+	delete(roomLocks, name)
+	roomLocksMutex.Unlock()
+	if ok {
+		logger.Info("room unlocked", "room", name)
+		notifyRoomLock(name)
+	}
+	return ok
+}
+
+// roomLock roomのロック（ロックされていなければnil）
+func roomLock(name string) *RoomLock {
+	roomLocksMutex.Lock()
+	defer roomLocksMutex.Unlock()
+	return roomLocks[name]
+}
+
+// lockAllows クライアントのupdateをロックが許可するかどうか
+func (c *client) lockAllows() bool {
+	l := roomLock(c.room.name)
+	return l == nil || l.heldBy(c)
+}
+
+// notifyRoomLock 使用中のroomの全クライアントにロックの状態を通知
+func notifyRoomLock(name string) {
+	room := findRoom(name)
+	if room == nil {
+		return
+	}
+	for _, c := range room.clientList() {
+		c.sendLockStatus()
+	}
+}
+
+// sendLockStatus クライアントにroomのロックの状態を送信
+// 保持者には room-lock-holder、それ以外には room-locked を送る。
+func (c *client) sendLockStatus() {
+	l := roomLock(c.room.name)
+	c.lockDeniedNotified.Store(l != nil && !l.heldBy(c))
+	switch {
+	case l == nil:
+		c.sendControl(controlMessage{Type: "room-unlocked"})
+	case l.heldBy(c):
+		c.sendControl(controlMessage{Type: "room-lock-holder", ExpiresIn: int(time.Until(l.ExpiresAt).Round(time.Second).Seconds())})
+	default:
+		c.sendControl(controlMessage{
+			Type:      "room-locked",
+			Message:   "The room is locked by " + l.lockHolderName(),
+			ExpiresIn: int(time.Until(l.ExpiresAt).Round(time.Second).Seconds()),
+		})
+	}
+}
+
+// lockHolderName 通知に使う保持者の表示名
+func (l *RoomLock) lockHolderName() string {
+	if l.Holder != "" {
+		return l.Holder
+	}
+	return "another client"
+}
+
+// replaceableBy トークンのユーザーがロックを置き換え・解除できるかどうか
+// ユーザーIDで保持していないロック（クライアントIDのみ）は、編集できる全員が置き換え・解除できる。
+// ADMIN_API_KEYで認可されたリクエストは保持者に関係なく置き換え・解除できる。
+func (l *RoomLock) replaceableBy(grant Grant) bool {
+	return grant.Admin || l.Holder == "" || l.Holder == grant.User
+}
+
+// LockRequest POST /api/rooms/:room/lock のリクエスト
+type LockRequest struct {
+	Holder   string `json:"holder"` // 省略時はトークンのユーザーID
+	ClientID uint64 `json:"clientId"`
+	TTL      string `json:"ttl"` // "30m" など（省略時はROOM_LOCK_TTL）
+}
+
+// HandleLockRoom roomをロックし、保持者以外の編集を止める
+// 閲覧のみでないトークンが必要で、他のユーザーが保持しているロックは置き換えられない。
+func HandleLockRoom(c echo.Context) error {
+	name, grant, err := authorizeRoomWrite(c)
+	if err != nil {
+		return err
+	}
+	var req LockRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	}
+	if req.Holder == "" && req.ClientID == 0 {
+		req.Holder = grant.User
+	}
+	if req.Holder == "" && req.ClientID == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "holder or clientId is required")
+	}
+	ttl := roomLockTTL
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid ttl")
+		}
+		ttl = d
+	}
+	if l := roomLock(name); l != nil && !l.replaceableBy(grant) {
+		return echo.NewHTTPError(http.StatusConflict, "room is locked by "+l.lockHolderName())
+	}
+
+	now := time.Now()
+	l := lockRoom(name, RoomLock{Holder: req.Holder, ClientID: req.ClientID, LockedAt: now, ExpiresAt: now.Add(ttl)})
+	return c.JSON(http.StatusOK, l)
+}
+
+// HandleGetRoomLock roomのロックを返す
+func HandleGetRoomLock(c echo.Context) error {
+	name, _, err := authorizeRoomAPI(c)
+	if err != nil {
+		return err
+	}
+	l := roomLock(name)
+	if l == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "room is not locked")
+	}
+	return c.JSON(http.StatusOK, l)
+}
+
+// HandleUnlockRoom roomのロックを解除する（他のユーザーが保持しているロックは、管理API以外からは解除できない）
+func HandleUnlockRoom(c echo.Context) error {
+	name, grant, err := authorizeRoomWrite(c)
+	if err != nil {
+		return err
+	}
+	l := roomLock(name)
+	if l == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "room is not locked")
+	}
+	if !l.replaceableBy(grant) {
+		return echo.NewHTTPError(http.StatusForbidden, "room is locked by "+l.lockHolderName())
+	}
+	if !unlockRoom(name) {
+		return echo.NewHTTPError(http.StatusNotFound, "room is not locked")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestRoomLockAPIAuthorization(t *testing.T) {
+	const name = "lock-auth"
+	// ?user= をユーザーID、?access=read を閲覧のみとして認可する
+	prevAuthorizer := authorizer
+	authorizer = func(r *http.Request, room string) (Grant, error) {
+		return Grant{User: r.URL.Query().Get("user"), ReadOnly: r.URL.Query().Get("access") == "read"}, nil
+	}
+	t.Cleanup(func() {
+		authorizer = prevAuthorizer
+		unlockRoom(name)
+	})
+
+	e := echo.New()
+	e.GET("/api/rooms/:room/lock", HandleGetRoomLock)
+	e.POST("/api/rooms/:room/lock", HandleLockRoom)
+	e.DELETE("/api/rooms/:room/lock", HandleUnlockRoom)
+	do := func(method, query, body string) int {
+		req := httptest.NewRequest(method, "/api/rooms/"+name+"/lock?"+query, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := do("POST", "user=alice&access=read", `{}`); code != http.StatusForbidden {
+		t.Errorf("lock with read-only token: status = %d, want %d", code, http.StatusForbidden)
+	}
+	if code := do("POST", "user=alice", `{"ttl": "1m"}`); code != http.StatusOK {
+		t.Fatalf("lock: status = %d", code)
+	}
+	if l := roomLock(name); l == nil || l.Holder != "alice" {
+		t.Fatalf("lock = %+v, want held by the token's user", l)
+	}
+	if code := do("GET", "user=bob&access=read", ""); code != http.StatusOK {
+		t.Errorf("get with read-only token: status = %d", code)
+	}
+
+	// 他のユーザーのロックは置き換えも解除もできない
+	if code := do("POST", "user=bob", `{}`); code != http.StatusConflict {
+		t.Errorf("lock held by another user: status = %d, want %d", code, http.StatusConflict)
+	}
+	if code := do("DELETE", "user=bob", ""); code != http.StatusForbidden {
+		t.Errorf("unlock held by another user: status = %d, want %d", code, http.StatusForbidden)
+	}
+	if code := do("DELETE", "user=alice", ""); code != http.StatusNoContent {
+		t.Errorf("unlock by holder: status = %d, want %d", code, http.StatusNoContent)
+	}
+	if l := roomLock(name); l != nil {
+		t.Errorf("lock = %+v after unlock", l)
+	}
+}
+
+func TestRoomLockAPIAdminKey(t *testing.T) {
+	const name = "lock-admin"
+	prevAuthorizer, prevKey := authorizer, adminAPIKey
+	authorizer, adminAPIKey = nil, "admin-key"
+	t.Cleanup(func() {
+		authorizer, adminAPIKey = prevAuthorizer, prevKey
+		unlockRoom(name)
+	})
+
+	e := echo.New()
+	e.POST("/api/rooms/:room/lock", HandleLockRoom)
+	e.DELETE("/api/rooms/:room/lock", HandleUnlockRoom)
+	RegisterAdminRoutes(e.Group("/api/v1"))
+	do := func(method, path, key, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// roomの認可が設定されていなければ、ロックと解除には管理APIキーが必要
+	if code := do("POST", "/api/rooms/"+name+"/lock", "", `{"holder": "mallory"}`); code != http.StatusUnauthorized {
+		t.Errorf("lock without key: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	lockRoom(name, RoomLock{Holder: "alice", ExpiresAt: time.Now().Add(time.Minute)})
+	if code := do("DELETE", "/api/rooms/"+name+"/lock", "", ""); code != http.StatusUnauthorized {
+		t.Errorf("unlock without key: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	// 管理APIキーがあれば、保持者に関係なく置き換え・解除できる
+	if code := do("POST", "/api/v1/rooms/"+name+"/lock", "admin-key", `{"holder": "bob"}`); code != http.StatusOK {
+		t.Fatalf("admin lock: status = %d", code)
+	}
+	if l := roomLock(name); l == nil || l.Holder != "bob" {
+		t.Fatalf("lock = %+v, want replaced by the admin", l)
+	}
+	if code := do("DELETE", "/api/v1/rooms/"+name+"/lock", "admin-key", ""); code != http.StatusNoContent {
+		t.Errorf("admin unlock: status = %d, want %d", code, http.StatusNoContent)
+	}
+	if l := roomLock(name); l != nil {
+		t.Errorf("lock = %+v after admin unlock", l)
+	}
+}
+
+func TestRoomLockedNoticeOncePerLockChange(t *testing.T) {
+	const name = "lock-notice"
+	forgetRooms(t, name)
+	t.Cleanup(func() { unlockRoom(name) })
+	room := newTestRoom(name)
+	c := newTestClient(room)
+	roomsMutex.Lock()
+	rooms[name] = room
+	roomsMutex.Unlock()
+	update := encodeSyncMessage(syncUpdate, mapSetUpdate(9, 0, "nodesById", "n1", "a"))
+
+	// ロックしたときに通知し、以降の破棄したupdateでは通知しない
+	lockRoom(name, RoomLock{Holder: "alice", ExpiresAt: time.Now().Add(time.Minute)})
+	for i := 0; i < 3; i++ {
+		if err := c.handleMessage(update); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := controlTypes(c); !reflect.DeepEqual(got, []string{"room-locked"}) {
+		t.Errorf("notices while locked = %v, want one room-locked", got)
+	}
+	if len(room.state()) != 0 {
+		t.Fatal("update from a client without the lock was applied")
+	}
+
+	// ロックが変わると改めて1回だけ通知する
+	lockRoom(name, RoomLock{Holder: "bob", ExpiresAt: time.Now().Add(time.Minute)})
+	for i := 0; i < 3; i++ {
+		c.handleMessage(update)
+	}
+	if got := controlTypes(c); !reflect.DeepEqual(got, []string{"room-locked"}) {
+		t.Errorf("notices after the lock changed = %v, want one room-locked", got)
+	}
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// logger サーバー全体で使う構造化ロガー（JSON形式）
+// 出力レベルは環境変数 LOG_LEVEL（debug|info|warn|error、デフォルトinfo）で指定する。
+// 他のパッケージ変数の初期化中にも使われるため、slog.Defaultもここで差し替える。
+var logger = newLogger()
+
+func newLogger() *slog.Logger {
+	var level slog.Level
+	v := os.Getenv("LOG_LEVEL")
+	invalid := v != "" && level.UnmarshalText([]byte(strings.TrimSpace(v))) != nil
+	if invalid {
+		level = slog.LevelInfo
+	}
+
+	l := slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	slog.SetDefault(l)
+	if invalid {
+		l.Warn("invalid LOG_LEVEL, using info", "value", v)
+	}
+	return l
+}
+
+// logUpdatePreview LOG_LEVEL=debugのとき、受信したupdateの先頭を16進数でログに出すかどうか
+// updateにはドキュメントの内容（ノードのラベルなど）がそのまま含まれるため、デフォルトでは出さない。
+var logUpdatePreview = envBool("LOG_UPDATE_PREVIEW", false)
+
+// clientLogger 接続ごとのログに付ける項目（room、クライアントID、接続元、ユーザー）を設定したロガー
+// client_idで同じ接続のログをまとめて追えるようにする。
+func clientLogger(room string, c *client) *slog.Logger {
+	attrs := []any{"room", room, "client_id", c.id, "remote_addr", c.ip}
+	if c.user != "" {
+		attrs = append(attrs, "user", c.user)
+	}
+	return logger.With(attrs...)
+}
+
+// fatal エラーを出力して終了する（設定の誤りなど、起動を続けられない場合に使う）
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// AccessLog アクセスログをslogで出力するミドルウェア（Echo標準のLoggerの代わり）
+func AccessLog() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+			if err != nil {
+				// ステータスコードを確定させるため、ここでエラーハンドラーを呼ぶ
+				c.Error(err)
+			}
+
+			req := c.Request()
+			attrs := []any{
+				"method", req.Method,
+				"uri", redactedURI(req.URL),
+				"status", c.Response().Status,
+				"remote_addr", c.RealIP(),
+				"bytes", c.Response().Size,
+				"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if room := c.Param("room"); room != "" {
+				attrs = append(attrs, "room", room)
+			}
+			if err != nil {
+				attrs = append(attrs, "error", err)
+			}
+			// 数秒ごとに届くヘルスチェックはデバッグ時のみ出力する
+			if isHealthCheck(c.Path()) && c.Response().Status < 400 {
+				logger.Debug("request", attrs...)
+			} else {
+				logger.Info("request", attrs...)
+			}
+			return nil
+		}
+	}
+}
+
+// isHealthCheck ヘルスチェックのパスかどうか
+func isHealthCheck(path string) bool {
+	return path == "/healthz" || path == "/readyz"
+}
+
+// redactedURI アクセスログに出力するURI（?token= のトークンは伏せる）
+func redactedURI(u *url.URL) string {
+	q := u.Query()
+	if !q.Has("token") {
+		return u.RequestURI()
+	}
+	q.Set("token", "REDACTED")
+	redacted := *u
+	redacted.RawQuery = q.Encode()
+	return redacted.RequestURI()
+}
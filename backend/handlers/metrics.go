@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheusのメトリクス
+var (
+	metricConnectedClients = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "floweditor_connected_clients",
+		Help: "Number of connected WebSocket clients.",
+	}, []string{"room"})
+
+	metricRejectedConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "floweditor_connections_rejected_total",
+		Help: "Number of WebSocket connections rejected because of connection limits.",
+	}, []string{"reason"})
+
+	metricMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "floweditor_messages_total",
+		Help: "Number of messages received from clients.",
+	}, []string{"room", "type"})
+
+	metricBroadcasts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "floweditor_broadcast_messages_total",
+		Help: "Number of messages queued to clients by broadcasts.",
+	}, []string{"room"})
+
+	metricUpdateBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "floweditor_update_bytes",
+		Help:    "Size of Yjs updates received from clients in bytes.",
+		Buckets: prometheus.ExponentialBuckets(64, 4, 8),
+	})
+
+	metricBroadcastDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "floweditor_broadcast_dropped_total",
+		Help: "Number of broadcast messages not delivered because the client's send buffer was full.",
+	}, []string{"room"})
+
+	metricSlowClients = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "floweditor_slow_clients_disconnected_total",
+		Help: "Number of clients disconnected because they could not keep up with broadcasts.",
+	}, []string{"room"})
+
+	metricSlowClientResyncs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "floweditor_slow_clients_resynced_total",
+		Help: "Number of times a client that fell behind was resent the full state instead of the missed messages.",
+	}, []string{"room"})
+
+	metricRejectedUpdates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "floweditor_updates_rejected_total",
+		Help: "Number of updates rejected by flow schema validation.",
+	}, []string{"room"})
+
+	metricStateBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "floweditor_state_bytes",
+		Help: "Size of the room's shared Yjs state in bytes.",
+	}, []string{"room"})
+
+	metricSaveDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "floweditor_save_duration_seconds",
+		Help:    "Time taken to persist a room's state.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	metricAuditDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "floweditor_audit_dropped_total",
+		Help: "Audit log entries dropped because the write queue was full.",
+	})
+
+	metricActiveRooms = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "floweditor_active_rooms",
+		Help: "Number of rooms held in memory.",
+	}, func() float64 { return float64(len(activeRooms())) })
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricConnectedClients,
+		metricRejectedConnections,
+		metricMessages,
+		metricBroadcasts,
+		metricUpdateBytes,
+		metricBroadcastDropped,
+		metricSlowClients,
+		metricSlowClientResyncs,
+		metricRejectedUpdates,
+		metricStateBytes,
+		metricSaveDuration,
+		metricAuditDropped,
+		metricActiveRooms,
+	)
+}
+
+// MetricsHandler Prometheusのメトリクスを返すハンドラー
+func MetricsHandler() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.Handler())
+}
+
+// messageTypeLabel メッセージタイプのラベル（ラベルの種類が増えすぎないよう既知のもの以外はまとめる）
+func messageTypeLabel(msgType uint64) string {
+	switch msgType {
+	case messageSync:
+		return "sync"
+	case messageAwareness:
+		return "awareness"
+	case messageAuth:
+		return "auth"
+	case messageQueryAwareness:
+		return "query_awareness"
+	case messageControl:
+		return "control"
+	default:
+		return "other"
+	}
+}
+
+// forgetRoomMetrics 取り除いたroomのメトリクスを削除する
+func forgetRoomMetrics(name string) {
+	metricBroadcasts.DeleteLabelValues(name)
+	metricConnectedClients.DeleteLabelValues(name)
+	metricStateBytes.DeleteLabelValues(name)
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// 接続を許可するOrigin（カンマ区切り）
+// "https://app.example.com" のような完全一致のほか、"https://*.example.com" や
+// "*.example.com"（スキームを問わない）のようにサブドメインのワイルドカードも指定できる。
+// 未設定の場合、すべて許可するのは GO_ENV=development のときのみで、それ以外は
+// 同じホストから配信したページ（OriginのホストがHostヘッダーと一致する）からの接続のみ許可する。
+var (
+	allowedOrigins = ParseList(os.Getenv("ALLOWED_ORIGINS"))
+	allowAnyOrigin = len(allowedOrigins) == 0 && os.Getenv("GO_ENV") == "development"
+)
+
+func init() {
+	switch {
+	case allowAnyOrigin:
+		logger.Warn("ALLOWED_ORIGINS is not set, WebSocket connections are accepted from any origin (GO_ENV=development)")
+	case len(allowedOrigins) == 0:
+		logger.Info("ALLOWED_ORIGINS is not set, WebSocket connections are accepted from the same host only")
+	}
+}
+
+// checkOrigin WebSocketのアップグレード時にOriginヘッダーを検証する
+// Originヘッダーのないリクエスト（ブラウザ以外のクライアント）は許可する。
+func checkOrigin(r *http.Request) bool {
+	if allowAnyOrigin {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	// 他のサイトのページから接続させない（クロスサイトWebSocketハイジャック対策）
+	if len(allowedOrigins) == 0 && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, pattern := range allowedOrigins {
+		if originMatches(pattern, u) {
+			return true
+		}
+	}
+	logger.Warn("rejected websocket connection", "origin", origin, "remote_addr", r.RemoteAddr)
+	return false
+}
+
+// originMatches Originがパターンに一致するかどうか
+func originMatches(pattern string, origin *url.URL) bool {
+	host := pattern
+	if scheme, rest, ok := strings.Cut(pattern, "://"); ok {
+		if !strings.EqualFold(scheme, origin.Scheme) {
+			return false
+		}
+		host = rest
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "/"))
+	target := strings.ToLower(origin.Host)
+
+	if suffix, ok := strings.CutPrefix(host, "*."); ok {
+		// サブドメインのみ一致させる（example.com自体は含まない）
+		return strings.HasSuffix(target, "."+suffix)
+	}
+	return target == host
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"errors"
+
+	"reactflow-yjs/backend/yjsutil"
+)
+
+// y-websocketのメッセージタイプ
+const (
+	messageSync           = 0
+	messageAwareness      = 1
+	messageAuth           = 2
+	messageQueryAwareness = 3
+)
+
+// syncメッセージのサブタイプ
+const (
+	syncStep1  = 0 // state vectorを送り、不足分を要求する
+	syncStep2  = 1 // step 1に対する応答（不足分のupdate）
+	syncUpdate = 2 // 差分のupdate
+)
+
+var errMalformedMessage = errors.New("malformed message")
+
+// readVarUint lib0形式の可変長整数を読み込み、値と読み込んだバイト数を返す
+// 不正なデータの場合は読み込んだバイト数が0になる
+func readVarUint(buf []byte) (uint64, int) {
+	var num uint64
+	var shift uint
+	for i, b := range buf {
+		if shift > 63 {
+			return 0, 0
+		}
+		num |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return num, i + 1
+		}
+		shift += 7
+	}
+	return 0, 0
+}
+
+// readVarUint8Array 長さ付きのバイト列を読み込み、値と読み込んだバイト数を返す
+func readVarUint8Array(buf []byte) ([]byte, int) {
+	length, n := readVarUint(buf)
+	if n == 0 || uint64(len(buf)-n) < length {
+		return nil, 0
+	}
+	return buf[n : n+int(length)], n + int(length)
+}
+
+// appendVarUint lib0形式の可変長整数を追加
+func appendVarUint(buf []byte, num uint64) []byte {
+	for num > 0x7f {
+		buf = append(buf, byte(0x80|(num&0x7f)))
+		num >>= 7
+	}
+	return append(buf, byte(num))
+}
+
+// appendVarUint8Array 長さ付きのバイト列を追加
+func appendVarUint8Array(buf []byte, data []byte) []byte {
+	buf = appendVarUint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+// isAwarenessMessage awarenessメッセージ（先頭のメッセージタイプが1）かどうか
+// syncメッセージのサブタイプ1（step 2）は2バイト目なので区別される。
+func isAwarenessMessage(msg []byte) bool {
+	return len(msg) > 0 && msg[0] == messageAwareness
+}
+
+// isSyncUpdateMessage ドキュメントのupdateを運ぶsyncメッセージ（step 2またはupdate）かどうか
+func isSyncUpdateMessage(msg []byte) bool {
+	return len(msg) > 1 && msg[0] == messageSync && (msg[1] == syncStep2 || msg[1] == syncUpdate)
+}
+
+// decodeSyncMessage syncメッセージ（タイプ0）のサブタイプとペイロードを取り出す
+func decodeSyncMessage(msg []byte) (uint64, []byte, error) {
+	msgType, n := readVarUint(msg)
+	if n == 0 || msgType != messageSync {
+		return 0, nil, errMalformedMessage
+	}
+	subtype, m := readVarUint(msg[n:])
+	if m == 0 {
+		return 0, nil, errMalformedMessage
+	}
+	payload, k := readVarUint8Array(msg[n+m:])
+	if k == 0 {
+		return 0, nil, errMalformedMessage
+	}
+	return subtype, payload, nil
+}
+
+// encodeSyncMessage syncメッセージ（タイプ0）をエンコード
+func encodeSyncMessage(subtype uint64, payload []byte) []byte {
+	buf := appendVarUint(nil, messageSync)
+	buf = appendVarUint(buf, subtype)
+	return appendVarUint8Array(buf, payload)
+}
+
+// encodeSyncStep1 state vectorを含むsync step 1を作成
+func encodeSyncStep1(state []byte) []byte {
+	sv := yjsutil.EncodeStateVector(nil)
+	if len(state) > 0 {
+		if encoded, err := yjsutil.EncodeStateVectorFromUpdate(state); err == nil {
+			sv = encoded
+		}
+	}
+	return encodeSyncMessage(syncStep1, sv)
+}
+
+// encodeSyncStep2 相手のstate vectorに対する差分を含むsync step 2を作成
+func encodeSyncStep2(state []byte, stateVector []byte) ([]byte, error) {
+	if len(state) == 0 {
+		return encodeSyncMessage(syncStep2, emptyUpdate), nil
+	}
+	diff, err := yjsutil.DiffUpdate(state, stateVector)
+	if err != nil {
+		return nil, err
+	}
+	return encodeSyncMessage(syncStep2, diff), nil
+}
+
+// emptyUpdate 空のYjs update（struct 0件、削除 0件）
+var emptyUpdate = []byte{0, 0}
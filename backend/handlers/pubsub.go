@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"reactflow-yjs/backend/yjsutil"
+)
+
+// 複数インスタンス間のメッセージの中継
+// Brokerを設定すると、クライアントから受け取ってroomに転送するメッセージ（updateやawareness）と
+// スナップショットからの復元を他のインスタンスにも配信し、他のインスタンスから届いたメッセージを
+// 自身に接続しているクライアントに転送する。状態の保存先は全インスタンスで共有する（redisなど）。
+// 各インスタンスのメモリ上の状態は、使用中でない間に届いたupdateなどを含まない場合があるため、
+// 保存するときは保存済みの状態とマージしてから書き込む（mergeStoredState）。
+
+// publishTimeout 1回の配信のタイムアウト
+const publishTimeout = 2 * time.Second
+
+// Broker インスタンス間でroomのメッセージを配信するバックエンド
+// 自身が配信したメッセージはSubscribeのhandlerに渡さない。
+type Broker interface {
+	Publish(ctx context.Context, room string, msg []byte) error
+	// Subscribe 他のインスタンスが配信したメッセージを受け取る（ctxが終了するまで戻らない）
+	Subscribe(ctx context.Context, handler func(room string, msg []byte)) error
+}
+
+// broker 使用中のBroker（nilの場合は単一インスタンス）
+var broker Broker
+
+// SetBroker インスタンス間の配信に使うBrokerを設定し、購読を開始する（サーバー起動前に呼び出す）
+func SetBroker(b Broker) {
+	broker = b
+	go func() {
+		if err := b.Subscribe(context.Background(), handleRemoteMessage); err != nil {
+			logger.Error("broker subscription ended", "error", err)
+		}
+	}()
+}
+
+// publish roomのメッセージを他のインスタンスに配信する
+func (r *Room) publish(msg []byte) {
+	if broker == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	if err := broker.Publish(ctx, r.name, msg); err != nil {
+		logger.Error("error publishing message", "room", r.name, "bytes", len(msg), "error", err)
+	}
+}
+
+// handleRemoteMessage 他のインスタンスから届いたメッセージを処理する
+// このインスタンスで使用中のroomのみ対象で、updateは共有状態にもマージしてから
+// 接続中の全クライアントに転送する。
+func handleRemoteMessage(name string, msg []byte) {
+	room := findRoom(name)
+	if room == nil || len(msg) == 0 {
+		return
+	}
+
+	if subtype, update, err := decodeSyncMessage(msg); err == nil && (subtype == syncUpdate || subtype == syncStep2) {
+		if _, err := room.applyUpdate(update, nil); err != nil {
+			logger.Warn("invalid update from another instance dropped", "room", name, "bytes", len(update), "error", err)
+			return
+		}
+	}
+	room.broadcastAll(msg)
+}
+
+// mergeStoredState 保存する状態に、保存済みの状態と切り離したupdateログをマージする（Brokerを使う場合）
+// メモリ上の状態をそのまま書き込むと、他のインスタンスが保存した、このインスタンスが受け取っていない
+// updateを消してしまう（後からroomを読み込んだインスタンスや、roomが使用中でない間の配信など）。
+// このインスタンスになかった分は共有状態にもマージし、接続中のクライアントに送る。
+func (r *Room) mergeStoredState(ctx context.Context, data []byte) ([]byte, error) {
+	stored, err := stateStore.Load(ctx, r.name)
+	if err != nil {
+		return nil, err
+	}
+	if stored != nil {
+		if stored, _, err = DecodePersisted(stored); err != nil {
+			return nil, err
+		}
+	}
+	if stored, _, err = mergeLoggedUpdates(ctx, r.name, stored); err != nil {
+		return nil, err
+	}
+	if len(stored) == 0 {
+		return data, nil
+	}
+	merged, err := yjsutil.MergeUpdates(stored, data)
+	if err != nil {
+		return nil, err
+	}
+
+	local, err := yjsutil.EncodeStateVectorFromUpdate(data)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := yjsutil.EncodeStateVectorFromUpdate(merged)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(local, remote) {
+		if _, err := r.applyUpdate(stored, nil); err != nil {
+			return nil, err
+		}
+		if msg, err := encodeSyncStep2(merged, local); err == nil {
+			r.broadcastAll(msg)
+		}
+		logger.Info("merged updates saved by other instances", "room", r.name)
+	}
+	return merged, nil
+}
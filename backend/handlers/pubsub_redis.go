@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisChannelPrefix roomのメッセージを配信するチャンネルの接頭辞（floweditor:room:<room>）
+const redisChannelPrefix = "floweditor:room:"
+
+// instanceIDLen 配信元のインスタンスIDのバイト数
+const instanceIDLen = 8
+
+// RedisBroker Redisのpub/subによるインスタンス間の配信
+// メッセージの先頭に配信元のインスタンスIDを付け、自身が配信したメッセージを区別する。
+type RedisBroker struct {
+	client     *redis.Client
+	instanceID []byte
+}
+
+// NewRedisBroker Redisのpub/subを使うRedisBrokerを作成
+func NewRedisBroker(client *redis.Client) *RedisBroker {
+	id := make([]byte, instanceIDLen)
+	rand.Read(id)
+	return &RedisBroker{client: client, instanceID: id}
+}
+
+// Publish roomのチャンネルにメッセージを配信
+func (b *RedisBroker) Publish(ctx context.Context, room string, msg []byte) error {
+	payload := append(append(make([]byte, 0, instanceIDLen+len(msg)), b.instanceID...), msg...)
+	return b.client.Publish(ctx, redisChannelPrefix+room, payload).Err()
+}
+
+// Subscribe 全roomのチャンネルを購読し、他のインスタンスのメッセージをhandlerに渡す
+// 接続が切れた場合はgo-redisが再接続して購読し直す。
+func (b *RedisBroker) Subscribe(ctx context.Context, handler func(room string, msg []byte)) error {
+	sub := b.client.PSubscribe(ctx, redisChannelPrefix+"*")
+	defer sub.Close()
+	logger.Info("subscribed to room channels", "instance", hex.EncodeToString(b.instanceID))
+
+	ch := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case m, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			payload := []byte(m.Payload)
+			if len(payload) < instanceIDLen || string(payload[:instanceIDLen]) == string(b.instanceID) {
+				continue
+			}
+			handler(strings.TrimPrefix(m.Channel, redisChannelPrefix), payload[instanceIDLen:])
+		}
+	}
+}
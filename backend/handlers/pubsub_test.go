@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"reactflow-yjs/backend/yjsutil"
+)
+
+// nopBroker 何も配信しないBroker
+type nopBroker struct{}
+
+func (nopBroker) Publish(ctx context.Context, room string, msg []byte) error { return nil }
+
+func (nopBroker) Subscribe(ctx context.Context, handler func(room string, msg []byte)) error {
+	<-ctx.Done()
+	return nil
+}
+
+func TestSaveStateKeepsUpdatesSavedByOtherInstances(t *testing.T) {
+	useTempStore(t)
+	prev := broker
+	broker = nopBroker{}
+	t.Cleanup(func() { broker = prev })
+
+	// 同じroomを別々に読み込んだ2つのインスタンス
+	a, b := newTestRoom("multi"), newTestRoom("multi")
+	if _, err := a.applyUpdate(mapSetUpdate(1, 0, yjsutil.NodesMapName, "a", "from a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.applyUpdate(mapSetUpdate(2, 0, yjsutil.NodesMapName, "b", "from b"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.saveState(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.saveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := stateStore.Load(context.Background(), "multi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, _, err := DecodePersisted(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, state := range map[string][]byte{"stored": state, "instance b": b.state()} {
+		doc, err := yjsutil.DecodeDocument(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes := doc.Map(yjsutil.NodesMapName)
+		if nodes["a"] != "from a" || nodes["b"] != "from b" {
+			t.Errorf("%s state = %v, want updates from both instances", name, nodes)
+		}
+	}
+}
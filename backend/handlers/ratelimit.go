@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	"reactflow-yjs/backend/yjsutil"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
+)
+
+// 受信メッセージのレート制限
+// クライアントごとと接続元のIPアドレスごとのトークンバケット（メッセージ数とバイト数）で、
+// 超過したメッセージ（awarenessなど）は処理せずに破棄する。
+// ドキュメントのupdateは破棄すると状態がずれるため対象外とし、updateのレート制限でまとめる。
+// 短時間に続けて破棄された場合はポリシー違反（1008）として切断する。
+var (
+	// 1クライアントあたりの1秒間の最大メッセージ数（0以下で無効）
+	maxMessagesPerSecond = envInt("MAX_MESSAGES_PER_SECOND", 50)
+	// 1クライアントあたりの1秒間の最大受信バイト数（0以下で無効）
+	maxBytesPerSecond = envInt("MAX_BYTES_PER_SECOND", 1024*1024)
+	// 同じIPアドレスからの全接続の合計の、1秒間の最大メッセージ数と最大受信バイト数（0以下で無効）
+	maxMessagesPerSecondPerIP = envInt("MAX_MESSAGES_PER_SECOND_PER_IP", 0)
+	maxBytesPerSecondPerIP    = envInt("MAX_BYTES_PER_SECOND_PER_IP", 0)
+	// 1クライアントあたりの1秒間の最大update数（0以下で無効）とバースト
+	maxUpdatesPerSecond = envInt("MAX_UPDATES_PER_SECOND", 30)
+	updateBurst         = envInt("UPDATE_BURST", 60)
+)
+
+const (
+	// 切断するまでに許容する連続した破棄の回数
+	rateLimitMaxDrops = 3
+	// 連続した破棄を数える期間
+	rateLimitDropWindow = 10 * time.Second
+)
+
+// newMessageLimiter クライアント用のレートリミッターを作成
+func newMessageLimiter() *rate.Limiter {
+	if maxMessagesPerSecond <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	return rate.NewLimiter(rate.Limit(maxMessagesPerSecond), maxMessagesPerSecond)
+}
+
+// newByteLimiter 1秒間の受信バイト数のレートリミッターを作成
+// バーストは1秒分とし、1秒間の上限を超える大きさのメッセージはallowMessageで別に断る。
+func newByteLimiter(perSecond int) *rate.Limiter {
+	if perSecond <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), perSecond)
+}
+
+// exceedsBurst sizeバイトがリミッターのバーストより大きく、待っても受け取れないかどうか
+func exceedsBurst(l *rate.Limiter, size int) bool {
+	return l.Limit() != rate.Inf && size > l.Burst()
+}
+
+// exceedsByteLimits sizeバイトのメッセージが、クライアントかIPアドレスの1秒間の受信バイト数を超えるかどうか
+func (c *client) exceedsByteLimits(size int) bool {
+	return exceedsBurst(c.byteLimiter, size) || (c.ipLimits != nil && exceedsBurst(c.ipLimits.bytes, size))
+}
+
+// ipLimiter 同じIPアドレスからの全接続で共有するレートリミッター
+type ipLimiter struct {
+	messages *rate.Limiter
+	bytes    *rate.Limiter
+	// このリミッターを使用している接続の数（ipLimitersMutexで保護）
+	conns int
+}
+
+var (
+	// IPアドレス -> リミッター（接続がなくなったら削除する）
+	ipLimiters      = make(map[string]*ipLimiter)
+	ipLimitersMutex sync.Mutex
+)
+
+// acquireIPLimiter IPアドレスのリミッターを取得する（IPアドレスごとの制限が無効の場合はnil）
+// 接続の終了時にreleaseIPLimiterを呼び出す。
+func acquireIPLimiter(ip string) *ipLimiter {
+	if maxMessagesPerSecondPerIP <= 0 && maxBytesPerSecondPerIP <= 0 {
+		return nil
+	}
+	ipLimitersMutex.Lock()
+	defer ipLimitersMutex.Unlock()
+
+	l, ok := ipLimiters[ip]
+	if !ok {
+		messages := rate.NewLimiter(rate.Inf, 0)
+		if maxMessagesPerSecondPerIP > 0 {
+			messages = rate.NewLimiter(rate.Limit(maxMessagesPerSecondPerIP), maxMessagesPerSecondPerIP)
+		}
+		l = &ipLimiter{messages: messages, bytes: newByteLimiter(maxBytesPerSecondPerIP)}
+		ipLimiters[ip] = l
+	}
+	l.conns++
+	return l
+}
+
+// releaseIPLimiter 接続の終了時にIPアドレスのリミッターを解放する
+func releaseIPLimiter(ip string) {
+	ipLimitersMutex.Lock()
+	defer ipLimitersMutex.Unlock()
+
+	if l, ok := ipLimiters[ip]; ok {
+		if l.conns--; l.conns <= 0 {
+			delete(ipLimiters, ip)
+		}
+	}
+}
+
+// withinRateLimits sizeバイトのメッセージがクライアントとIPアドレスの制限内かどうか
+func (c *client) withinRateLimits(size int) bool {
+	now := time.Now()
+	if !c.limiter.AllowN(now, 1) || !c.byteLimiter.AllowN(now, size) {
+		return false
+	}
+	if c.ipLimits == nil {
+		return true
+	}
+	return c.ipLimits.messages.AllowN(now, 1) && c.ipLimits.bytes.AllowN(now, size)
+}
+
+// allowMessage 受信したメッセージを処理してよいかどうか
+// 超過したメッセージは破棄（allowed=false）し、連続して破棄した場合は接続を閉じる（keepOpen=false）。
+// 1秒間の受信バイト数より大きいメッセージは何度送っても受け取れないため、破棄せずに1009で閉じる。
+// ドキュメントのupdateは破棄せず、submitUpdateでレートを超えた分をマージしてから適用する。
+func (c *client) allowMessage(msg []byte) (allowed bool, keepOpen bool) {
+	size := len(msg)
+	if c.exceedsByteLimits(size) {
+		c.log.Warn("message exceeds byte rate limit", "bytes", size)
+		c.closeWithCode(websocket.CloseMessageTooBig, "message exceeds byte rate limit")
+		return false, false
+	}
+	if isSyncUpdateMessage(msg) {
+		return true, true
+	}
+	if c.withinRateLimits(size) {
+		c.drops = 0
+		return true, true
+	}
+
+	now := time.Now()
+	if c.drops == 0 || now.Sub(c.firstDrop) > rateLimitDropWindow {
+		c.drops = 0
+		c.firstDrop = now
+	}
+	c.drops++
+	c.log.Warn("rate limit exceeded, message dropped", "bytes", size)
+
+	if c.drops >= rateLimitMaxDrops {
+		c.log.Warn("closing client for repeated rate limit violations")
+		c.closeWithCode(websocket.ClosePolicyViolation, "rate limit exceeded")
+		return false, false
+	}
+	return false, true
+}
+
+// updateのレート制限
+// Yjsのupdateは破棄すると他のクライアントと状態がずれるため、超過分は破棄せずに
+// 1つのupdateにマージしておき、次に許可されたupdateと一緒に（またはタイマーで）適用する。
+
+// newUpdateLimiter クライアント用のupdateのレートリミッターを作成
+func newUpdateLimiter() *rate.Limiter {
+	if maxUpdatesPerSecond <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	return rate.NewLimiter(rate.Limit(maxUpdatesPerSecond), max(updateBurst, 1))
+}
+
+// submitUpdate クライアントからのupdateを適用する
+// レートを超えた場合は待機中のupdateにまとめ、一定時間後に適用する。
+func (c *client) submitUpdate(update []byte) error {
+	c.coalesceMutex.Lock()
+	if !c.updateLimiter.Allow() {
+		if len(c.coalesced) == 0 {
+			c.log.Info("update rate limit exceeded, coalescing updates")
+		}
+		c.coalesced = append(c.coalesced, update)
+		if c.flushTimer == nil {
+			c.flushTimer = time.AfterFunc(time.Second/time.Duration(maxUpdatesPerSecond), c.flushCoalesced)
+		}
+		c.coalesceMutex.Unlock()
+		return nil
+	}
+	pending := c.takeCoalesced()
+	c.coalesceMutex.Unlock()
+
+	if len(pending) > 0 {
+		merged, err := yjsutil.MergeUpdates(append(pending, update)...)
+		if err != nil {
+			c.log.Warn("invalid update dropped", "error", err)
+			return nil
+		}
+		update = merged
+	}
+	return c.applyAndBroadcast(update)
+}
+
+// flushCoalesced 待機中のupdateをまとめて適用する
+// 適用が終わるまでcoalesceMutexを保持するため、切断時の呼び出しはタイマーからの適用が
+// 終わるのを待ってから戻る（クリーンアップの後にroomへ触れないようにする）。
+func (c *client) flushCoalesced() {
+	c.coalesceMutex.Lock()
+	defer c.coalesceMutex.Unlock()
+	pending := c.takeCoalesced()
+	if len(pending) == 0 {
+		return
+	}
+
+	merged, err := yjsutil.MergeUpdates(pending...)
+	if err != nil {
+		c.log.Warn("invalid update dropped", "error", err)
+		return
+	}
+	c.applyAndBroadcast(merged)
+}
+
+// takeCoalesced 待機中のupdateを取り出す（coalesceMutexを保持して呼び出す）
+func (c *client) takeCoalesced() [][]byte {
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+		c.flushTimer = nil
+	}
+	pending := c.coalesced
+	c.coalesced = nil
+	return pending
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"reactflow-yjs/backend/yjsutil"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMessageLargerThanByteRateClosed(t *testing.T) {
+	useTempStore(t)
+	prev := maxBytesPerSecond
+	maxBytesPerSecond = 4096
+	t.Cleanup(func() { maxBytesPerSecond = prev })
+	forgetRooms(t, "byte-rate-test")
+
+	url := newTestServer(t)
+	conn := dialRoom(t, url, "byte-rate-test")
+	awareness := func(size int) []byte {
+		state := `{"name":"` + strings.Repeat("a", size) + `"}`
+		return encodeAwarenessMessage([]awarenessUpdateEntry{{clientID: 1, clock: 1, state: state}})
+	}
+
+	// 1秒分のバーストを超えた分は破棄するだけで、接続は閉じない
+	for i := 0; i < 2; i++ {
+		if err := conn.WriteMessage(websocket.BinaryMessage, awareness(3000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, time.Second, "client connected", func() bool { return roomClients("byte-rate-test") == 1 })
+	room := findRoom("byte-rate-test")
+
+	// 1秒間の上限より大きいメッセージは何度送っても受け取れないため、1009で閉じる
+	if err := conn.WriteMessage(websocket.BinaryMessage, awareness(5000)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseMessageTooBig {
+			t.Fatalf("read error = %v, want close code %d", err, websocket.CloseMessageTooBig)
+		}
+		break
+	}
+	// 切断後の保存が終わってから、永続化バックエンドを戻す
+	room.wg.Wait()
+}
+
+func TestUpdatesOverMessageRateMerged(t *testing.T) {
+	useTempStore(t)
+	prevMessages, prevUpdates, prevBurst := maxMessagesPerSecond, maxUpdatesPerSecond, updateBurst
+	maxMessagesPerSecond, maxUpdatesPerSecond, updateBurst = 2, 5, 1
+	t.Cleanup(func() { maxMessagesPerSecond, maxUpdatesPerSecond, updateBurst = prevMessages, prevUpdates, prevBurst })
+	forgetRooms(t, "update-rate-test")
+
+	url := newTestServer(t)
+	conn := dialRoom(t, url, "update-rate-test")
+	waitFor(t, time.Second, "client connected", func() bool { return roomClients("update-rate-test") == 1 })
+	room := findRoom("update-rate-test")
+
+	// メッセージ数の上限を超えたupdateも破棄せず、まとめて適用する（切断もしない）
+	const updates = 20
+	for i := 0; i < updates; i++ {
+		update := mapSetUpdate(7, uint64(i), "nodesById", fmt.Sprintf("n%d", i), "x")
+		if err := conn.WriteMessage(websocket.BinaryMessage, encodeSyncMessage(syncUpdate, update)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, 3*time.Second, "all updates applied", func() bool {
+		sv, err := yjsutil.EncodeStateVectorFromUpdate(room.state())
+		if err != nil {
+			return false
+		}
+		clocks, err := yjsutil.DecodeStateVector(sv)
+		return err == nil && clocks[7] == updates
+	})
+	if roomClients("update-rate-test") != 1 {
+		t.Fatal("client was disconnected for sending updates over the message rate")
+	}
+
+	conn.Close()
+	waitFor(t, time.Second, "client to leave", func() bool { return roomClients("update-rate-test") == 0 })
+	room.wg.Wait()
+}
@@ -0,0 +1,576 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"reactflow-yjs/backend/yjsutil"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// 永続化ファイル名の接頭辞と拡張子（ydoc_state_<room>.bin）
+	persistenceFilePrefix = "ydoc_state_"
+	persistenceFileSuffix = ".bin"
+)
+
+// 自動保存の間隔
+var autoSaveInterval = envDuration("AUTOSAVE_INTERVAL", 30*time.Second)
+
+func init() {
+	if autoSaveInterval <= 0 {
+		fatal("AUTOSAVE_INTERVAL must be positive", "value", autoSaveInterval)
+	}
+}
+
+// errPersistenceBlocked 保存済みの状態を読み込めなかったroomを保存しようとした場合のエラー
+var errPersistenceBlocked = errors.New("persisted state could not be loaded, refusing to overwrite")
+
+// 永続化ファイルを保存するディレクトリ（FileStore）
+var persistDir = envString("PERSIST_DIR", ".")
+
+// room名として使用できる文字（ファイル名に埋め込むため制限する）
+var roomNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]{0,127}$`)
+
+// validRoomName room名が安全に使用できるかどうか
+// "..", "/" などを含む名前はディレクトリ外を指す可能性があるため拒否する
+// サブドキュメントのroom（"<room>~<guid>"）は、親のroom名とGUIDの両方を検証する。
+func validRoomName(name string) bool {
+	parent, guid, isSubdoc := strings.Cut(name, subdocSeparator)
+	if isSubdoc && !validRoomNamePart(guid) {
+		return false
+	}
+	return validRoomNamePart(parent)
+}
+
+func validRoomNamePart(name string) bool {
+	return roomNamePattern.MatchString(name) && !strings.Contains(name, "..")
+}
+
+// 接続を許可するroom名のパターン（"team-*" のようなglob、カンマ区切り。未設定の場合はすべて許可）
+var allowedRoomPatterns = ParseList(os.Getenv("ALLOWED_ROOM_PATTERNS"))
+
+func init() {
+	for _, p := range allowedRoomPatterns {
+		if _, err := path.Match(p, ""); err != nil {
+			fatal("invalid ALLOWED_ROOM_PATTERNS entry", "pattern", p, "error", err)
+		}
+	}
+}
+
+// roomAllowed room名が許可されたパターンのいずれかに一致するかどうか（サブドキュメントは親のroom名で判定）
+func roomAllowed(name string) bool {
+	if len(allowedRoomPatterns) == 0 {
+		return true
+	}
+	name = parentRoomName(name)
+	for _, p := range allowedRoomPatterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Room room単位のクライアントと共有状態
+type Room struct {
+	name string
+
+	// 接続中のクライアント
+	clients      map[*client]bool
+	clientsMutex sync.RWMutex
+
+	// 共有状態（簡易版：実際にはYDocのバイナリデータを保持）
+	sharedState []byte
+	stateMutex  sync.RWMutex
+	// 最後にupdateを適用した時刻（stateMutexで保護）
+	lastUpdate time.Time
+	// 直近1時間に適用したupdateの数（stateMutexで保護）
+	updateCounts updateCounter
+
+	// 送信ループと切断時のクリーンアップの終了待ち（room削除時に使用）
+	// クライアントごとに2つ数え、送信ループとHandleWebSocketのクリーンアップの最後で1つずつ減らす。
+	// 待ち終えた後は、切断したクライアントの処理がroomに触れることはない。
+	wg sync.WaitGroup
+	// 削除処理中
+	deleting atomic.Bool
+
+	// 保存処理の直列化
+	saveMutex sync.Mutex
+
+	// 保存済みの状態を読み込めなかったため保存しない（上書きを防ぐ）
+	persistenceBlocked bool
+
+	// 永続化の縮退モード（保存できずメモリ上の状態のみで動作中）
+	degraded atomic.Bool
+
+	// 最後のクライアントが切断した時刻（roomsMutexで保護）
+	idleSince time.Time
+	// 一覧に登録済みで、まだクライアントを登録していない参加処理の数（roomsMutexで保護）
+	// 0でなければ空のroomでも取り除かない。
+	joining int
+	// 保存済みの状態の読み込みが終わったら閉じる（参加するクライアントはこれを待つ）
+	loaded chan struct{}
+
+	// 最後に保存した（または読み込んだ）状態と、最後にスナップショットを作成した時刻（saveMutexで保護）
+	lastSaved    []byte
+	lastSnapshot time.Time
+
+	// 前回の圧縮以降にupdateログへ追記したupdate数と、COMPACT_AFTER_UPDATESによる圧縮の実行中かどうか
+	loggedUpdates atomic.Int64
+	compacting    atomic.Bool
+
+	// 保存待ちのupdate数（クライアント -> 数、stateMutexで保護）
+	pendingAcks map[*client]int
+
+	// awarenessの状態（カーソル位置など）
+	awareness awarenessStore
+
+	// ドキュメントの変更のWebhookを予約済みかどうか
+	changeWebhookPending atomic.Bool
+
+	// シングルライターモードの編集権
+	singleWriter     bool
+	writer           *client
+	writerLastActive time.Time
+	writerMutex      sync.Mutex
+}
+
+var (
+	// 使用中のroom（room名 -> Room）
+	rooms      = make(map[string]*Room)
+	roomsMutex sync.Mutex
+)
+
+// 1つのroomに接続できる最大クライアント数（0以下で無制限）
+var maxClientsPerRoom = envInt("MAX_CLIENTS_PER_ROOM", 50)
+
+// errRoomFull roomの接続数が上限に達している
+var errRoomFull = errors.New("room is full")
+
+// joinRoom room名に対応するRoomにクライアントを登録し、初期同期メッセージを送信する
+// Roomがなければ作成して保存済みの状態を読み込む
+// 接続数がMAX_CLIENTS_PER_ROOMに達している場合は登録せずにerrRoomFullを返す
+// roomsMutexはroomの作成・予約にのみ使い、永続化バックエンドからの読み込みは
+// ロックの外で行う（読み込みの遅いroomが他のroomの接続を止めないようにする）。
+func joinRoom(name string, c *client) (*Room, error) {
+	for {
+		roomsMutex.Lock()
+		// 削除中のroomには参加させず、新しいroomを作成する
+		room, ok := rooms[name]
+		created := !ok || room.deleting.Load()
+		if created {
+			room = &Room{
+				name:         name,
+				clients:      make(map[*client]bool),
+				awareness:    awarenessStore{entries: make(map[uint64]*awarenessEntry)},
+				singleWriter: isSingleWriterRoom(name),
+				loaded:       make(chan struct{}),
+			}
+			rooms[name] = room
+		}
+		room.joining++
+		evicting := evictingRooms[name]
+		roomsMutex.Unlock()
+
+		if created {
+			// 同じ名前の破棄したroomの状態を削除中であれば、削除が終わってから読み込む
+			if evicting != nil {
+				<-evicting
+			}
+			room.loadState()
+			// 保存済みの状態がない新しいroom
+			if len(room.sharedState) == 0 && !room.persistenceBlocked {
+				emitWebhook(WebhookEvent{Event: webhookRoomCreated, Room: name})
+			}
+			close(room.loaded)
+		} else {
+			<-room.loaded
+		}
+
+		err := room.addClient(c)
+		roomsMutex.Lock()
+		room.joining--
+		roomsMutex.Unlock()
+		// 読み込みを待っている間に削除されたroomには参加させず、作成し直す
+		if err == errRoomDeleting {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return room, nil
+	}
+}
+
+// errRoomDeleting 参加しようとしたroomが削除中
+var errRoomDeleting = errors.New("room is being deleted")
+
+// addClient 読み込み済みのroomにクライアントを登録し、初期同期メッセージを送信する
+func (r *Room) addClient(c *client) error {
+	// 登録と初期同期の送信をまとめて行い、他のクライアントからの
+	// ブロードキャストが保存済みの状態より先に届かないようにする
+	r.clientsMutex.Lock()
+	if r.deleting.Load() {
+		r.clientsMutex.Unlock()
+		return errRoomDeleting
+	}
+	if maxClientsPerRoom > 0 && len(r.clients) >= maxClientsPerRoom {
+		r.clientsMutex.Unlock()
+		return errRoomFull
+	}
+	r.clients[c] = true
+	c.room = r
+	// 削除中の判定と同じロックの中で登録し、closeClientsが待ち始める前に数えられるようにする
+	r.wg.Add(2)
+	c.sendInitialSync()
+	clients := len(r.clients)
+	r.clientsMutex.Unlock()
+	emitWebhook(WebhookEvent{Event: webhookClientJoined, Room: r.name, User: c.user, ClientID: c.id, Clients: clients})
+	metricConnectedClients.WithLabelValues(r.name).Inc()
+	return nil
+}
+
+// removeClient クライアントをroomから削除
+// 最後のクライアントが抜けたroomは状態を保存し、ROOM_IDLE_TTLが経過するまで残しておく
+// （ROOM_IDLE_TTLが0以下の場合はすぐに取り除く）
+// 保存はroomsMutexの外で行い、保存の間に別のクライアントが参加した場合は取り除かない。
+// 保存できなかった場合は変更を失わないよう取り除かず、自動保存で保存できてからevictIdleRoomsが取り除く。
+func (r *Room) removeClient(c *client) {
+	r.clientsMutex.Lock()
+	delete(r.clients, c)
+	clients := len(r.clients)
+	r.clientsMutex.Unlock()
+	emitWebhook(WebhookEvent{Event: webhookClientLeft, Room: r.name, User: c.user, ClientID: c.id, Clients: clients})
+	metricConnectedClients.WithLabelValues(r.name).Dec()
+
+	if clients > 0 || r.deleting.Load() || findRoom(r.name) != r {
+		return
+	}
+	saveErr := r.saveState()
+
+	roomsMutex.Lock()
+	evicted := false
+	if rooms[r.name] == r && r.joining == 0 && r.clientCount() == 0 && !r.deleting.Load() {
+		r.idleSince = time.Now()
+		if saveErr != nil {
+			logger.Warn("keeping empty room in memory until its state is saved", "room", r.name, "error", saveErr)
+		} else if roomIdleTTL <= 0 {
+			r.evict()
+			evicted = true
+		}
+	}
+	roomsMutex.Unlock()
+	if evicted {
+		r.removeEvictedState()
+	}
+}
+
+// roomCloseTimeout room削除時にクライアントの切断を待つ最大時間
+const roomCloseTimeout = 5 * time.Second
+
+// deleteRoom roomの全クライアントを切断し、保存済みの状態を削除する
+// クローズフレームを送信した後、全クライアントの送信ループが終了するのを待ってから
+// roomを一覧から取り除く。時間内に終了しない接続は強制的に閉じる。
+func deleteRoom(name string) error {
+	roomsMutex.Lock()
+	room := rooms[name]
+	roomsMutex.Unlock()
+
+	if room == nil {
+		return removePersistedState(name)
+	}
+
+	// 以降、切断時の保存や新しいクライアントの参加を行わない
+	room.deleting.Store(true)
+	if err := removePersistedState(name); err != nil {
+		room.deleting.Store(false)
+		return err
+	}
+
+	n := room.closeClients(websocket.CloseGoingAway, "room deleted", time.Now().Add(roomCloseTimeout))
+
+	roomsMutex.Lock()
+	if rooms[name] == room {
+		delete(rooms, name)
+		forgetRoomMetrics(name)
+	}
+	roomsMutex.Unlock()
+
+	logger.Info("room deleted", "room", name, "clients", n)
+	return nil
+}
+
+// closeClients roomの全クライアントにクローズフレームを送信し、送信ループの終了を待つ
+// deadlineまでに終了しない接続は強制的に閉じる。切断したクライアント数を返す。
+func (r *Room) closeClients(code int, reason string, deadline time.Time) int {
+	clients := r.clientList()
+	msg := websocket.FormatCloseMessage(code, reason)
+	for _, c := range clients {
+		c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Until(deadline)):
+		logger.Warn("timed out waiting for clients to close, forcing close", "room", r.name)
+		for _, c := range clients {
+			c.conn.Close()
+		}
+		<-done
+	}
+	return len(clients)
+}
+
+// removePersistedState roomの保存済みの状態を削除
+func removePersistedState(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	return stateStore.Delete(ctx, name)
+}
+
+// applyUpdate Yjsのupdateを共有状態にマージし、マージ後の状態を返す
+// 最後のupdateで上書きするのではなく、すべての更新を含む状態を保持する
+// fromはupdateを送ったクライアント（永続化のACKに使う）
+func (r *Room) applyUpdate(update []byte, from *client) ([]byte, error) {
+	return r.mergeUpdate(update, from, false)
+}
+
+// applyClientUpdate クライアントから受け取ったupdateをマージする
+// FLOW_VALIDATIONが有効な場合は、フロー図のスキーマに違反するupdateを適用せずにエラーを返す。
+func (r *Room) applyClientUpdate(update []byte, from *client) ([]byte, error) {
+	return r.mergeUpdate(update, from, flowValidation)
+}
+
+// mergeUpdate updateを共有状態にマージする（validateが真の場合はマージ後の状態を検証してから置き換える）
+func (r *Room) mergeUpdate(update []byte, from *client, validate bool) ([]byte, error) {
+	r.stateMutex.Lock()
+	defer r.stateMutex.Unlock()
+
+	updates := [][]byte{update}
+	if len(r.sharedState) > 0 {
+		updates = [][]byte{r.sharedState, update}
+	}
+	merged, err := yjsutil.MergeUpdates(updates...)
+	if err != nil {
+		return nil, err
+	}
+	if validate {
+		if err := validateFlowUpdate(r.sharedState, merged); err != nil {
+			return nil, err
+		}
+	}
+	r.sharedState = merged
+	r.lastUpdate = time.Now()
+	r.updateCounts.add(r.lastUpdate)
+	r.trackPendingAck(from)
+	metricStateBytes.WithLabelValues(r.name).Set(float64(len(merged)))
+	return merged, nil
+}
+
+// saveState 共有状態を永続化バックエンドに保存
+// 保存は1つずつ行い、古い状態が新しい状態を上書きしないようにする
+func (r *Room) saveState() error {
+	r.saveMutex.Lock()
+	defer r.saveMutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	// 保存する状態と、それに含まれるACK待ちのupdateを同時に取り出す
+	// updateログを使う場合は、状態に含まれるupdateまでのログも同時に切り離す
+	log := updateLog()
+	r.stateMutex.Lock()
+	data := r.sharedState
+	acks := r.takePendingAcks()
+	var rotateErr error
+	if log != nil && len(data) > 0 {
+		rotateErr = log.RotateUpdates(ctx, r.name)
+	}
+	r.stateMutex.Unlock()
+
+	if len(data) == 0 {
+		return nil
+	}
+	if rotateErr != nil {
+		logger.Error("error rotating update log", "room", r.name, "error", rotateErr)
+		r.restorePendingAcks(acks)
+		r.setDegraded(true, rotateErr)
+		return rotateErr
+	}
+	r.loggedUpdates.Store(0)
+
+	// 削除中のroomは保存しない
+	if r.deleting.Load() {
+		return nil
+	}
+
+	// 保存済みの状態を読み込めなかった場合は上書きしない
+	if r.persistenceBlocked {
+		logger.Warn("skipping save, persisted state could not be loaded", "room", r.name)
+		r.restorePendingAcks(acks)
+		r.setDegraded(true, errPersistenceBlocked)
+		return errPersistenceBlocked
+	}
+
+	// 複数インスタンスの場合は、他のインスタンスが保存したupdateを上書きしないようマージする
+	if broker != nil {
+		merged, err := r.mergeStoredState(ctx, data)
+		if err != nil {
+			logger.Error("error merging stored state", "room", r.name, "error", err)
+			r.restorePendingAcks(acks)
+			r.setDegraded(true, err)
+			return err
+		}
+		data = merged
+	}
+
+	// 書き込み（フォーマットのバージョンヘッダー付き）
+	start := time.Now()
+	err := stateStore.Save(ctx, r.name, EncodePersisted(data))
+	metricSaveDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		logger.Error("error saving state", "room", r.name, "error", err)
+		r.restorePendingAcks(acks)
+		r.setDegraded(true, err)
+		return err
+	}
+
+	logger.Debug("state saved", "room", r.name, "bytes", len(data))
+	if log != nil {
+		// 削除できなくても、次回の読み込みで重複してマージされるだけなので続ける
+		if err := log.RemoveRotatedUpdates(ctx, r.name); err != nil {
+			logger.Warn("error removing compacted update log", "room", r.name, "error", err)
+		}
+	}
+	r.setDegraded(false, nil)
+	r.lastSaved = data
+	r.sendAcks(acks)
+	return nil
+}
+
+// loadState 保存された状態を永続化バックエンドから読み込む
+// updateログを使う場合は、前回の圧縮以降に追記されたupdateもマージする
+func (r *Room) loadState() {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	data, err := stateStore.Load(ctx, r.name)
+	if err != nil {
+		logger.Error("error loading state", "room", r.name, "error", err)
+		r.persistenceBlocked = true
+		r.degraded.Store(true)
+		return
+	}
+
+	if data != nil {
+		var version int
+		data, version, err = DecodePersisted(data)
+		if err != nil {
+			// 未知のバージョンは読み込まず、ファイルを上書きしないようにする
+			logger.Error("error loading state", "room", r.name, "error", err)
+			r.persistenceBlocked = true
+			r.degraded.Store(true)
+			return
+		}
+		if version < currentFormatVersion {
+			logger.Info("migrating state format on next save", "room", r.name, "from", version, "to", currentFormatVersion)
+		}
+	}
+
+	state, logged, err := mergeLoggedUpdates(ctx, r.name, data)
+	if err != nil {
+		// ログのupdateを失わないよう、状態を上書きしない
+		logger.Error("error loading update log", "room", r.name, "error", err)
+		r.persistenceBlocked = true
+		r.degraded.Store(true)
+		return
+	}
+	if logged > 0 {
+		r.loggedUpdates.Store(int64(logged))
+		logger.Info("logged updates merged", "room", r.name, "count", logged)
+	}
+	if len(state) == 0 {
+		logger.Info("no saved state found, starting with empty state", "room", r.name)
+		return
+	}
+
+	r.stateMutex.Lock()
+	r.sharedState = state
+	r.stateMutex.Unlock()
+	// ログからマージした分は次回の自動保存で圧縮される
+	r.lastSaved = data
+	metricStateBytes.WithLabelValues(r.name).Set(float64(len(state)))
+
+	logger.Info("state loaded", "room", r.name, "bytes", len(state))
+}
+
+// activeRooms 現在使用中のroomの一覧
+func activeRooms() []*Room {
+	roomsMutex.Lock()
+	defer roomsMutex.Unlock()
+
+	list := make([]*Room, 0, len(rooms))
+	for _, room := range rooms {
+		list = append(list, room)
+	}
+	return list
+}
+
+// clientList roomに接続中のクライアントの一覧
+func (r *Room) clientList() []*client {
+	r.clientsMutex.RLock()
+	defer r.clientsMutex.RUnlock()
+
+	list := make([]*client, 0, len(r.clients))
+	for c := range r.clients {
+		list = append(list, c)
+	}
+	return list
+}
+
+// clientCount roomに接続中のクライアント数
+func (r *Room) clientCount() int {
+	r.clientsMutex.RLock()
+	defer r.clientsMutex.RUnlock()
+
+	return len(r.clients)
+}
+
+// unsaved 前回の保存以降に状態が変わっているかどうか
+func (r *Room) unsaved() bool {
+	r.saveMutex.Lock()
+	defer r.saveMutex.Unlock()
+	r.stateMutex.RLock()
+	defer r.stateMutex.RUnlock()
+
+	return len(r.sharedState) > 0 && !bytes.Equal(r.sharedState, r.lastSaved)
+}
+
+// autoSave 定期的に全roomの状態を自動保存
+func autoSave() {
+	ticker := time.NewTicker(autoSaveInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, room := range activeRooms() {
+			// 前回の保存から変わっていないroom（空のまま残っているroomなど）は書き込まない
+			if room.unsaved() {
+				room.saveState()
+			}
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// blockingStore 指定したroomの読み込みをreleaseが閉じられるまで止めるStateStore
+type blockingStore struct {
+	StateStore
+	room    string
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) Load(ctx context.Context, room string) ([]byte, error) {
+	if room == s.room {
+		close(s.started)
+		<-s.release
+	}
+	return s.StateStore.Load(ctx, room)
+}
+
+// forgetRooms テスト終了時に、テストで作成したroomを一覧から取り除く
+func forgetRooms(t testing.TB, names ...string) {
+	t.Cleanup(func() {
+		roomsMutex.Lock()
+		defer roomsMutex.Unlock()
+		for _, name := range names {
+			delete(rooms, name)
+		}
+	})
+}
+
+func TestJoinRoomLoadsOutsideRoomsMutex(t *testing.T) {
+	store := &blockingStore{
+		StateStore: useTempStore(t),
+		room:       "slow-room",
+		started:    make(chan struct{}),
+		release:    make(chan struct{}),
+	}
+	stateStore = store
+	forgetRooms(t, "slow-room", "fast-room")
+
+	ctx := context.Background()
+	saved := mapSetUpdate(1, 0, "nodesById", "a", "x")
+	if err := store.Save(ctx, "slow-room", EncodePersisted(saved)); err != nil {
+		t.Fatal(err)
+	}
+
+	joined := make(chan *client, 2)
+	join := func(name string) *client {
+		c := &client{send: make(chan []byte, 16), log: logger}
+		go func() {
+			if _, err := joinRoom(name, c); err != nil {
+				t.Errorf("joinRoom(%s): %v", name, err)
+			}
+			joined <- c
+		}()
+		return c
+	}
+
+	first := join("slow-room")
+	<-store.started
+	second := join("slow-room")
+
+	// 読み込みの遅いroomがあっても、他のroomには参加できる
+	fast := &client{send: make(chan []byte, 16), log: logger}
+	done := make(chan error, 1)
+	go func() {
+		_, err := joinRoom("fast-room", fast)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("joinRoom(fast-room): %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("joinRoom(fast-room) blocked while another room was loading")
+	}
+
+	select {
+	case c := <-joined:
+		t.Fatalf("client %p joined before the room was loaded", c)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(store.release)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-joined:
+		case <-time.After(time.Second):
+			t.Fatal("joinRoom(slow-room) did not return after the state was loaded")
+		}
+	}
+
+	// 読み込みを待っていたクライアントも同じroomに参加し、保存済みの状態を受け取る
+	if first.room != second.room {
+		t.Fatal("clients joined different rooms")
+	}
+	for _, c := range []*client{first, second} {
+		msg := <-c.send
+		subtype, payload, err := decodeSyncMessage(msg)
+		if err != nil || subtype != syncStep2 || string(payload) != string(saved) {
+			t.Errorf("initial sync = %x, want sync step 2 with the saved state", msg)
+		}
+	}
+}
+
+func TestDeleteRoomWaitsForClientCleanup(t *testing.T) {
+	useTempStore(t)
+	forgetRooms(t, "delete-test")
+	url := newTestServer(t)
+
+	const clients = 10
+	var senders sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		conn := dialRoom(t, url, "delete-test")
+		senders.Add(2)
+		go func() {
+			defer senders.Done()
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		// 削除されるまで編集とカーソルの移動を送り続ける（MAX_MESSAGES_PER_SECONDを超えない間隔で）
+		go func(clientID uint64) {
+			defer senders.Done()
+			for clock := uint64(0); ; clock++ {
+				update := encodeSyncMessage(syncUpdate, mapSetUpdate(clientID, clock, "nodesById", fmt.Sprint(clock), "x"))
+				awareness := encodeAwarenessMessage([]awarenessUpdateEntry{{clientID: clientID, clock: clock, state: `{"cursor":{"x":1,"y":2}}`}})
+				if conn.WriteMessage(websocket.BinaryMessage, update) != nil || conn.WriteMessage(websocket.BinaryMessage, awareness) != nil {
+					return
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		}(uint64(100 + i))
+	}
+	waitFor(t, 5*time.Second, "clients to join", func() bool { return roomClients("delete-test") == clients })
+	room := findRoom("delete-test")
+	waitFor(t, time.Second, "updates to be applied", func() bool { return len(room.state()) > 0 })
+
+	// 切断中のクライアントへの送信も失敗させる（送信ループが先に終了する）
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				room.broadcastAll(encodeControlMessage(controlMessage{Type: "test"}))
+			}
+		}
+	}()
+	err := deleteRoom("delete-test")
+	close(stop)
+	<-stopped
+	if err != nil {
+		t.Fatalf("deleteRoom: %v", err)
+	}
+	if findRoom("delete-test") == room {
+		t.Fatal("deleted room is still listed")
+	}
+	// 戻った時点で全クライアントの切断時の処理が終わっている
+	if n := room.clientCount(); n != 0 {
+		t.Fatalf("deleted room still has %d clients", n)
+	}
+	if entries := room.awareness.snapshot(); len(entries) != 0 {
+		t.Fatalf("deleted room still has %d awareness states", len(entries))
+	}
+
+	// 以降、roomの状態は変わらない
+	state := room.state()
+	senders.Wait()
+	time.Sleep(50 * time.Millisecond)
+	if !bytes.Equal(room.state(), state) {
+		t.Fatal("state of the deleted room changed after deleteRoom returned")
+	}
+}
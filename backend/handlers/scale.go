@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// HandleScaleMetric オートスケーラー向けに接続数を1つの数値で返す
+// ?metric=total（デフォルト）: 全roomの接続クライアント数
+// ?metric=busiest: 最も接続の多いroomのクライアント数
+// ?metric=degraded: 永続化の縮退モードのroomの数
+func HandleScaleMetric(c echo.Context) error {
+	total, busiest := 0, 0
+	for _, room := range activeRooms() {
+		n := room.clientCount()
+		total += n
+		if n > busiest {
+			busiest = n
+		}
+	}
+
+	switch c.QueryParam("metric") {
+	case "", "total":
+		return c.String(http.StatusOK, strconv.Itoa(total))
+	case "busiest":
+		return c.String(http.StatusOK, strconv.Itoa(busiest))
+	case "degraded":
+		return c.String(http.StatusOK, strconv.Itoa(degradedRoomCount()))
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "unknown metric")
+	}
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 終了処理中（新しいWebSocket接続を受け付けない）
+var shuttingDown atomic.Bool
+
+// Shutdown 接続中のクライアントを切断し、全roomの状態を保存する
+// サーバーの終了前に呼び出す。新しい接続の受け付けを止め、送信バッファに残っている
+// メッセージを送り切ってから切断する。保存は全クライアントの受信ループが終了し、
+// 受信済みのupdateをすべて適用してから行う（保存後に届いたupdateを失わないため）。
+// ctxの期限までに切断できない接続は強制的に閉じる。
+func Shutdown(ctx context.Context) error {
+	shuttingDown.Store(true)
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(roomCloseTimeout)
+	}
+
+	list := activeRooms()
+	for _, room := range list {
+		room.drainClients(ctx)
+	}
+	for _, room := range list {
+		room.closeClients(websocket.CloseGoingAway, "server shutting down", deadline)
+	}
+	for _, room := range list {
+		// 自動保存を待たずに最新の状態を書き込む
+		if err := room.saveState(); err != nil {
+			logger.Error("error flushing state on shutdown", "room", room.name, "error", err)
+		}
+	}
+
+	logger.Info("flushed rooms on shutdown", "rooms", len(list))
+	return ctx.Err()
+}
+
+// drainClients 全クライアントの送信バッファが空になるまで待つ（ctxの期限まで）
+func (r *Room) drainClients(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for _, c := range r.clientList() {
+		for len(c.send) > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+}
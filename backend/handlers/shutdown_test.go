@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"reactflow-yjs/backend/yjsutil"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestShutdownOnSIGTERMFlushesAllUpdates(t *testing.T) {
+	useTempStore(t)
+	forgetRooms(t, "shutdown-test")
+	t.Cleanup(func() { shuttingDown.Store(false) })
+	url := newTestServer(t)
+
+	const clients = 3
+	var senders sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		conn := dialRoom(t, url, "shutdown-test")
+		senders.Add(2)
+		go func() {
+			defer senders.Done()
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		// 切断されるまで編集を送り続ける
+		go func(clientID uint64) {
+			defer senders.Done()
+			for clock := uint64(0); ; clock++ {
+				update := encodeSyncMessage(syncUpdate, mapSetUpdate(clientID, clock, "nodesById", fmt.Sprint(clock), "x"))
+				if conn.WriteMessage(websocket.BinaryMessage, update) != nil {
+					return
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		}(uint64(200 + i))
+	}
+	waitFor(t, 5*time.Second, "clients to join", func() bool { return roomClients("shutdown-test") == clients })
+	room := findRoom("shutdown-test")
+	waitFor(t, time.Second, "updates to be applied", func() bool { return len(room.state()) > 0 })
+
+	// mainと同じく、SIGTERMを受け取ったらShutdownを呼ぶ
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	defer stop()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	<-ctx.Done()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := Shutdown(shutdownCtx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	// mainはShutdownから戻るとすぐに終了するため、戻った時点の状態で確認する
+	stored := loadStoredState(t, "shutdown-test")
+	state := room.state()
+	if n := room.clientCount(); n != 0 {
+		t.Fatalf("%d clients still connected after shutdown", n)
+	}
+	senders.Wait()
+
+	// 受信したupdateはすべて保存されている
+	want, _ := yjsutil.EncodeStateVectorFromUpdate(state)
+	got, _ := yjsutil.EncodeStateVectorFromUpdate(stored)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("stored state vector = %x, want %x (updates applied after the final save)", got, want)
+	}
+}
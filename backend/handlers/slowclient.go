@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// クライアントごとの送信バッファのサイズ（メッセージ数）
+	sendBufferSize = envInt("SEND_BUFFER_SIZE", 256)
+	// 送信バッファが満杯のときに空きを待つ時間（過ぎても空かなければ切断する）
+	slowClientGrace = envDuration("SLOW_CLIENT_GRACE", 100*time.Millisecond)
+	// 送信が追いつかないクライアントの扱い（disconnect または resync）
+	slowClientPolicy = envString("SLOW_CLIENT_POLICY", slowPolicyDisconnect)
+)
+
+const (
+	// slowPolicyDisconnect 切断して再接続させる
+	slowPolicyDisconnect = "disconnect"
+	// slowPolicyResync 接続を続け、送信バッファが空いたらroomの状態全体を送り直す
+	slowPolicyResync = "resync"
+)
+
+func init() {
+	if slowClientPolicy != slowPolicyDisconnect && slowClientPolicy != slowPolicyResync {
+		logger.Warn("invalid SLOW_CLIENT_POLICY, using disconnect", "value", slowClientPolicy)
+		slowClientPolicy = slowPolicyDisconnect
+	}
+}
+
+// sendBufferFull 送信バッファが空かないクライアントをSLOW_CLIENT_POLICYに従って扱う
+func (c *client) sendBufferFull() {
+	if slowClientPolicy == slowPolicyResync {
+		c.markResync()
+		return
+	}
+	c.disconnectSlow()
+}
+
+// disconnectSlow 送信が追いつかないクライアントを切断する
+// updateを取りこぼしたまま接続を続けると同期がずれたままになるため、
+// 切断して再接続させ、保存済みの状態から同期し直させる。
+// 受信ループが接続の切断を検出し、通常の切断と同じくroomから取り除かれる。
+func (c *client) disconnectSlow() {
+	if !c.slow.CompareAndSwap(false, true) {
+		return
+	}
+	c.log.Warn("disconnecting slow client, send buffer full")
+	metricSlowClients.WithLabelValues(c.room.name).Inc()
+
+	// roomのロックを持ったまま呼ばれるため、クローズフレームの送信は待たない
+	go c.closeWithCode(websocket.CloseTryAgainLater, "client too slow, reconnect to resync")
+}
+
+// markResync 取りこぼしたメッセージがあることを記録する
+// 取りこぼしたupdateはすべて共有状態にマージ済みのため、送信バッファが空いたときに
+// 共有状態をまとめて送れば、個々のupdateを送り直さなくても同期が追いつく。
+func (c *client) markResync() {
+	if !c.resync.CompareAndSwap(false, true) {
+		return
+	}
+	c.log.Warn("send buffer full, client will be resynced with the full state")
+	metricSlowClientResyncs.WithLabelValues(c.room.name).Inc()
+}
+
+// writeResync 取りこぼしがあれば共有状態をsync step2として送信する（送信ループから呼び出す）
+func (c *client) writeResync() error {
+	if len(c.send) > 0 || !c.resync.CompareAndSwap(true, false) {
+		return nil
+	}
+	state := c.room.state()
+	if len(state) == 0 {
+		return nil
+	}
+	msg := c.transform(encodeSyncMessage(syncStep2, state))
+	if msg == nil {
+		return nil
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.writeBinary(msg)
+}
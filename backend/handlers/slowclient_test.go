@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSlowClientDisconnected(t *testing.T) {
+	useTempStore(t)
+	prevSize, prevPolicy := sendBufferSize, slowClientPolicy
+	sendBufferSize, slowClientPolicy = 4, slowPolicyDisconnect
+	t.Cleanup(func() { sendBufferSize, slowClientPolicy = prevSize, prevPolicy })
+	forgetRooms(t, "slow-client-test")
+
+	url := newTestServer(t)
+	// 受信ループを動かさない（ソケットのバッファが埋まると送信ループが止まる）
+	dialRoom(t, url, "slow-client-test")
+	fast := dialRoom(t, url, "slow-client-test")
+	waitFor(t, time.Second, "clients to join", func() bool { return roomClients("slow-client-test") == 2 })
+	room := findRoom("slow-client-test")
+
+	payload := bytes.Repeat([]byte{0xff}, 256*1024)
+	msg := encodeControlMessage(controlMessage{Type: "test", Message: string(payload)})
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := fast.ReadMessage(); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	// 読まないクライアントだけが切断されるまで送り続ける
+	deadline := time.Now().Add(10 * time.Second)
+	sent := 0
+	for room.clientCount() == 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("slow client was not disconnected after %d messages", sent)
+		}
+		room.broadcastAll(msg)
+		sent++
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// 残ったのは読み続けていたクライアント
+	remaining := room.clientList()
+	if len(remaining) != 1 || remaining[0].conn.RemoteAddr().String() != fast.LocalAddr().String() {
+		t.Fatalf("remaining clients = %d, want only the reading client", len(remaining))
+	}
+	if remaining[0].slow.Load() {
+		t.Fatal("reading client was marked slow")
+	}
+	select {
+	case err := <-readErr:
+		t.Fatalf("reading client was disconnected: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
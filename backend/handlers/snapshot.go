@@ -0,0 +1,432 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"reactflow-yjs/backend/yjsutil"
+
+	"github.com/labstack/echo/v4"
+)
+
+// スナップショットの履歴
+// 自動保存とは別にSNAPSHOT_INTERVALごとに、前回から変更のあったroomの状態をタイムスタンプ付きの
+// スナップショットとして残し、新しいものからSNAPSHOT_RETENTION個だけ保持する。
+// 誤操作で消したノードなどを戻すために使う。
+// APIから名前と作成者を付けて作成したスナップショットは、自動では削除しない。
+var (
+	// 保持するスナップショットの数（0でスナップショットを作成しない）
+	snapshotRetention = envInt("SNAPSHOT_RETENTION", 10)
+	// スナップショットを作成する間隔
+	snapshotInterval = envDuration("SNAPSHOT_INTERVAL", 5*time.Minute)
+)
+
+func init() {
+	if snapshotRetention > 0 && snapshotInterval > 0 {
+		go snapshotter()
+	}
+}
+
+// errSnapshotsUnsupported 永続化バックエンドがスナップショットに対応していない
+var errSnapshotsUnsupported = errors.New("state store does not support snapshots")
+
+// SnapshotInfo スナップショットの情報
+type SnapshotInfo struct {
+	Timestamp int64  `json:"timestamp"`        // 作成時刻（Unix時刻、スナップショットのID）
+	Size      int    `json:"size"`             // バイト数
+	Name      string `json:"name,omitempty"`   // 名前（APIで作成した場合）
+	Author    string `json:"author,omitempty"` // 作成者（APIで作成した場合）
+}
+
+// SnapshotStore スナップショットを保存できる永続化バックエンド
+// StateStoreがこのインターフェースも実装している場合にスナップショットを作成する。
+type SnapshotStore interface {
+	// SaveSnapshot info.Timestampをidとしてスナップショットを保存する（info.Sizeは使わない）
+	SaveSnapshot(ctx context.Context, room string, info SnapshotInfo, data []byte) error
+	// ListSnapshots roomのスナップショットの一覧（新しい順）
+	ListSnapshots(ctx context.Context, room string) ([]SnapshotInfo, error)
+	// LoadSnapshot スナップショットを読み込む（存在しない場合は nil, nil）
+	LoadSnapshot(ctx context.Context, room string, timestamp int64) ([]byte, error)
+	DeleteSnapshot(ctx context.Context, room string, timestamp int64) error
+}
+
+// snapshotStore スナップショットに対応した永続化バックエンド（未対応の場合はnil）
+func snapshotStore() SnapshotStore {
+	s, _ := stateStore.(SnapshotStore)
+	return s
+}
+
+// snapshotter 定期的に使用中のroomのスナップショットを作成する
+func snapshotter() {
+	ticker := time.NewTicker(snapshotInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if snapshotStore() == nil {
+			continue
+		}
+		for _, room := range activeRooms() {
+			room.takeSnapshot()
+		}
+	}
+}
+
+// takeSnapshot 前回のスナップショットから変更があれば現在の状態をスナップショットとして残し、
+// 古いものを削除する
+func (r *Room) takeSnapshot() {
+	store := snapshotStore()
+	if store == nil {
+		return
+	}
+
+	// 保存と同じく1つずつ行う（lastSnapshotはsaveMutexで保護）
+	r.saveMutex.Lock()
+	defer r.saveMutex.Unlock()
+
+	r.stateMutex.RLock()
+	data := r.sharedState
+	changed := r.lastUpdate.After(r.lastSnapshot)
+	r.stateMutex.RUnlock()
+	if len(data) == 0 || !changed || r.deleting.Load() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	now := time.Now()
+	timestamp, err := nextSnapshotID(ctx, store, r.name, now)
+	if err != nil {
+		logger.Error("error listing snapshots", "room", r.name, "error", err)
+		return
+	}
+	if err := store.SaveSnapshot(ctx, r.name, SnapshotInfo{Timestamp: timestamp}, EncodePersisted(data)); err != nil {
+		logger.Error("error saving snapshot", "room", r.name, "error", err)
+		return
+	}
+	r.lastSnapshot = now
+
+	snapshots, err := store.ListSnapshots(ctx, r.name)
+	if err != nil {
+		logger.Error("error listing snapshots", "room", r.name, "error", err)
+		return
+	}
+	kept := 0
+	for _, s := range snapshots {
+		// 名前付きのスナップショットは保持数に含めず、残しておく
+		if s.Name != "" {
+			continue
+		}
+		if kept++; kept <= snapshotRetention {
+			continue
+		}
+		if err := store.DeleteSnapshot(ctx, r.name, s.Timestamp); err != nil {
+			logger.Error("error pruning snapshot", "room", r.name, "snapshot", s.Timestamp, "error", err)
+		}
+	}
+}
+
+// nextSnapshotID 新しいスナップショットのid（現在のUnix時刻、同じ秒に作成済みであればその次）
+func nextSnapshotID(ctx context.Context, store SnapshotStore, room string, now time.Time) (int64, error) {
+	snapshots, err := store.ListSnapshots(ctx, room)
+	if err != nil {
+		return 0, err
+	}
+	id := now.Unix()
+	if len(snapshots) > 0 && snapshots[0].Timestamp >= id {
+		id = snapshots[0].Timestamp + 1
+	}
+	return id, nil
+}
+
+// createSnapshot roomの現在の状態から名前付きのスナップショットを作成する
+// 使用中でないroomは保存済みの状態から作成する（状態がなければos.ErrNotExist）。
+func createSnapshot(ctx context.Context, name, snapshotName, author string) (SnapshotInfo, error) {
+	store := snapshotStore()
+	if store == nil {
+		return SnapshotInfo{}, errSnapshotsUnsupported
+	}
+	// 使用中のroomは自動のスナップショットとidが重ならないよう、1つずつ作成する
+	if room := findRoom(name); room != nil {
+		room.saveMutex.Lock()
+		defer room.saveMutex.Unlock()
+	}
+	state, err := loadRoomState(ctx, name)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	if len(state) == 0 {
+		return SnapshotInfo{}, os.ErrNotExist
+	}
+
+	timestamp, err := nextSnapshotID(ctx, store, name, time.Now())
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	data := EncodePersisted(state)
+	info := SnapshotInfo{Timestamp: timestamp, Size: len(data), Name: snapshotName, Author: author}
+	if err := store.SaveSnapshot(ctx, name, info, data); err != nil {
+		return SnapshotInfo{}, err
+	}
+	logger.Info("snapshot created", "room", name, "snapshot", timestamp, "name", snapshotName, "author", author)
+	return info, nil
+}
+
+// restoreSnapshot roomの状態をスナップショットの内容に戻す
+// 現在の状態をスナップショットの内容に戻すupdateを作成して適用するため、接続中のクライアントも
+// 通常のupdateとして受け取ってマージできる。適用後の状態は保存済みの状態も上書きする。
+func restoreSnapshot(ctx context.Context, name string, timestamp int64) error {
+	store := snapshotStore()
+	if store == nil {
+		return errSnapshotsUnsupported
+	}
+	data, err := store.LoadSnapshot(ctx, name, timestamp)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return os.ErrNotExist
+	}
+	target, _, err := DecodePersisted(data)
+	if err != nil {
+		return err
+	}
+	return replaceRoomState(ctx, name, target)
+}
+
+// replaceRoomState roomの状態をtargetに置き換える
+// 使用中のroomは接続中のクライアントにも送信し、使用中でないroomは保存済みの状態を書き換える。
+func replaceRoomState(ctx context.Context, name string, target []byte) error {
+	if room := findRoom(name); room != nil {
+		// 復元も元に戻せるよう、復元前の状態もスナップショットとして残しておく
+		room.takeSnapshot()
+		return room.revertTo(target)
+	}
+
+	// 使用中でないroomは保存済みの状態を直接書き換える
+	current, err := loadPersisted(ctx, name)
+	if err != nil {
+		return err
+	}
+	state := target
+	if len(current) > 0 {
+		revert, err := yjsutil.RevertUpdate(current, target)
+		if err != nil {
+			return err
+		}
+		if state, err = yjsutil.MergeUpdates(current, revert); err != nil {
+			return err
+		}
+	}
+	return stateStore.Save(ctx, name, EncodePersisted(state))
+}
+
+// revertTo 使用中のroomの状態をtargetに戻し、全クライアントに送信して保存する
+func (r *Room) revertTo(target []byte) error {
+	r.stateMutex.Lock()
+	revert, err := yjsutil.RevertUpdate(r.sharedState, target)
+	if err == nil {
+		var merged []byte
+		if merged, err = yjsutil.MergeUpdates(r.sharedState, revert); err == nil {
+			r.sharedState = merged
+			r.lastUpdate = time.Now()
+			metricStateBytes.WithLabelValues(r.name).Set(float64(len(merged)))
+		}
+	}
+	r.stateMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	msg := encodeSyncMessage(syncUpdate, revert)
+	r.broadcastAll(msg)
+	r.publish(msg)
+	r.scheduleChangeWebhook()
+	logger.Info("state restored", "room", r.name)
+	return r.saveState()
+}
+
+// snapshotDir roomのスナップショットを保存するディレクトリ（snapshots/<room>/）
+func (s *FileStore) snapshotDir(room string) string {
+	return filepath.Join(s.dir, "snapshots", room)
+}
+
+// snapshotPath スナップショットのファイルパス（snapshots/<room>/<timestamp>.bin）
+func (s *FileStore) snapshotPath(room string, timestamp int64) string {
+	return filepath.Join(s.snapshotDir(room), fmt.Sprintf("%d%s", timestamp, persistenceFileSuffix))
+}
+
+// snapshotMetaPath スナップショットの名前と作成者のファイルパス（snapshots/<room>/<timestamp>.json）
+func (s *FileStore) snapshotMetaPath(room string, timestamp int64) string {
+	return filepath.Join(s.snapshotDir(room), fmt.Sprintf("%d.json", timestamp))
+}
+
+// snapshotMeta スナップショットのファイルと並べて保存する名前と作成者
+type snapshotMeta struct {
+	Name   string `json:"name,omitempty"`
+	Author string `json:"author,omitempty"`
+}
+
+// SaveSnapshot スナップショットを原子的にファイルへ書き込む
+// 名前か作成者があれば、先に<timestamp>.jsonとして書き込む
+func (s *FileStore) SaveSnapshot(ctx context.Context, room string, info SnapshotInfo, data []byte) error {
+	if err := os.MkdirAll(s.snapshotDir(room), 0755); err != nil {
+		return err
+	}
+	if info.Name != "" || info.Author != "" {
+		meta, err := json.Marshal(snapshotMeta{Name: info.Name, Author: info.Author})
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(s.snapshotMetaPath(room, info.Timestamp), meta, 0644); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(s.snapshotPath(room, info.Timestamp), data, 0644)
+}
+
+// ListSnapshots roomのスナップショットの一覧（新しい順）
+func (s *FileStore) ListSnapshots(ctx context.Context, room string) ([]SnapshotInfo, error) {
+	entries, err := os.ReadDir(s.snapshotDir(room))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []SnapshotInfo
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, persistenceFileSuffix) {
+			continue
+		}
+		// タイムスタンプの名前でないファイルは除く
+		timestamp, err := strconv.ParseInt(strings.TrimSuffix(name, persistenceFileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		snapshot := SnapshotInfo{Timestamp: timestamp, Size: int(info.Size())}
+		if meta, err := os.ReadFile(s.snapshotMetaPath(room, timestamp)); err == nil {
+			var m snapshotMeta
+			if err := json.Unmarshal(meta, &m); err != nil {
+				logger.Warn("ignoring invalid snapshot metadata", "room", room, "snapshot", timestamp, "error", err)
+			}
+			snapshot.Name, snapshot.Author = m.Name, m.Author
+		}
+		list = append(list, snapshot)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Timestamp > list[j].Timestamp })
+	return list, nil
+}
+
+// LoadSnapshot スナップショットを読み込む
+func (s *FileStore) LoadSnapshot(ctx context.Context, room string, timestamp int64) ([]byte, error) {
+	data, err := os.ReadFile(s.snapshotPath(room, timestamp))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// DeleteSnapshot スナップショットを削除
+// 最後のスナップショットを削除した場合はroomのディレクトリも削除する
+func (s *FileStore) DeleteSnapshot(ctx context.Context, room string, timestamp int64) error {
+	if err := os.Remove(s.snapshotPath(room, timestamp)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(s.snapshotMetaPath(room, timestamp)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// 空でなければ失敗するだけなので、エラーは無視する
+	os.Remove(s.snapshotDir(room))
+	return nil
+}
+
+// HandleListSnapshots roomのスナップショットの一覧（新しい順）を返す
+// 認可はWebSocketの接続と同じく行う。作成と復元には閲覧のみでないトークンが必要。
+func HandleListSnapshots(c echo.Context) error {
+	name, _, err := authorizeRoomAPI(c)
+	if err != nil {
+		return err
+	}
+	store := snapshotStore()
+	if store == nil {
+		return echo.NewHTTPError(http.StatusNotImplemented, errSnapshotsUnsupported.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), storeTimeout)
+	defer cancel()
+	list, err := store.ListSnapshots(ctx, name)
+	if err != nil {
+		logger.Error("error listing snapshots", "room", name, "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to list snapshots")
+	}
+	if list == nil {
+		list = []SnapshotInfo{}
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+// CreateSnapshotRequest POST /rooms/:room/snapshots のリクエスト
+type CreateSnapshotRequest struct {
+	Name   string `json:"name"`   // スナップショットの名前（必須）
+	Author string `json:"author"` // 作成者
+}
+
+// HandleCreateSnapshot roomの現在の状態から名前付きのスナップショットを作成する
+// 作成者を省略した場合はトークンのユーザーIDを記録する。
+func HandleCreateSnapshot(c echo.Context) error {
+	name, grant, err := authorizeRoomWrite(c)
+	if err != nil {
+		return err
+	}
+	var req CreateSnapshotRequest
+	if err := c.Bind(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "snapshot name is required")
+	}
+	author := strings.TrimSpace(req.Author)
+	if author == "" {
+		author = grant.User
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), storeTimeout)
+	defer cancel()
+	info, err := createSnapshot(ctx, name, strings.TrimSpace(req.Name), author)
+	switch {
+	case err == nil:
+		return c.JSON(http.StatusCreated, info)
+	case errors.Is(err, os.ErrNotExist):
+		return echo.NewHTTPError(http.StatusNotFound, "room not found")
+	case errors.Is(err, errSnapshotsUnsupported):
+		return echo.NewHTTPError(http.StatusNotImplemented, err.Error())
+	default:
+		logger.Error("error creating snapshot", "room", name, "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to create snapshot")
+	}
+}
+
+// HandleRestoreSnapshot roomの状態をスナップショットの内容に戻す
+func HandleRestoreSnapshot(c echo.Context) error {
+	name, _, err := authorizeRoomWrite(c)
+	if err != nil {
+		return err
+	}
+	ts, err := strconv.ParseInt(c.Param("ts"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid snapshot timestamp")
+	}
+	return restoreRoom(c, name, ts)
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestSnapshotAPIAuthorization(t *testing.T) {
+	store := useTempStore(t)
+	const name = "snapshot-auth"
+	if err := store.Save(context.Background(), name, mapSetUpdate(1, 0, "nodesById", "n1", "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	secret := []byte("test-secret")
+	prevSecret, prevAuthorizer := roomTokenSecret, authorizer
+	roomTokenSecret, authorizer = secret, authorizeRoomToken
+	t.Cleanup(func() { roomTokenSecret, authorizer = prevSecret, prevAuthorizer })
+
+	e := echo.New()
+	e.GET("/api/rooms/:room/snapshots", HandleListSnapshots)
+	e.POST("/api/rooms/:room/snapshots", HandleCreateSnapshot)
+	e.POST("/api/rooms/:room/snapshots/:ts/restore", HandleRestoreSnapshot)
+	do := func(method, path, access, body string) *httptest.ResponseRecorder {
+		if access != "-" {
+			path += "?token=" + SignRoomToken(secret, name, access, time.Now().Add(time.Hour))
+		}
+		req := httptest.NewRequest(method, "/api/rooms/"+name+path, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("GET", "/snapshots", "-", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("list without token: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	for _, access := range []string{"read", "observe"} {
+		if rec := do("POST", "/snapshots", access, `{"name": "before"}`); rec.Code != http.StatusForbidden {
+			t.Errorf("create with %s token: status = %d, want %d", access, rec.Code, http.StatusForbidden)
+		}
+	}
+
+	rec := do("POST", "/snapshots", "", `{"name": "before"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create with writer token: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	var info SnapshotInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil || info.Name != "before" {
+		t.Fatalf("created snapshot = %s", rec.Body)
+	}
+
+	rec = do("GET", "/snapshots", "read", "")
+	var list []SnapshotInfo
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &list) != nil || len(list) != 1 {
+		t.Fatalf("list with read token: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	restore := "/snapshots/" + strconv.FormatInt(list[0].Timestamp, 10) + "/restore"
+	if rec := do("POST", restore, "read", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("restore with read token: status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if rec := do("POST", restore, "", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("restore with writer token: status = %d, body = %s", rec.Code, rec.Body)
+	}
+}
+
+func TestSnapshotAPIRequiresAdminKeyWithoutAuthorizer(t *testing.T) {
+	store := useTempStore(t)
+	const name = "snapshot-admin"
+	if err := store.Save(context.Background(), name, mapSetUpdate(1, 0, "nodesById", "n1", "a")); err != nil {
+		t.Fatal(err)
+	}
+	prevAuthorizer, prevKey := authorizer, adminAPIKey
+	authorizer, adminAPIKey = nil, "admin-key"
+	t.Cleanup(func() { authorizer, adminAPIKey = prevAuthorizer, prevKey })
+
+	e := echo.New()
+	e.POST("/api/rooms/:room/snapshots", HandleCreateSnapshot)
+	e.POST("/api/rooms/:room/snapshots/:ts/restore", HandleRestoreSnapshot)
+	RegisterAdminRoutes(e.Group("/api/v1"))
+	do := func(method, path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// roomの認可が設定されていなければ、作成も復元も管理APIキーが必要
+	if rec := do("POST", "/api/rooms/"+name+"/snapshots", "", `{}`); rec.Code != http.StatusUnauthorized {
+		t.Errorf("create without key: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := do("POST", "/api/rooms/"+name+"/snapshots/1/restore", "wrong", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("restore with wrong key: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := do("POST", "/api/rooms/"+name+"/snapshots", "admin-key", `{"name": "before"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("create with admin key: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	// /api/v1の別名でも一覧と復元ができる
+	rec := do("GET", "/api/v1/rooms/"+name+"/snapshots", "admin-key", "")
+	var list []SnapshotInfo
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &list) != nil || len(list) != 1 {
+		t.Fatalf("admin list: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	restore := "/api/v1/rooms/" + name + "/snapshots/" + strconv.FormatInt(list[0].Timestamp, 10) + "/restore"
+	if rec := do("POST", restore, "", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("admin restore without key: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := do("POST", restore, "admin-key", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("admin restore: status = %d, body = %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"reactflow-yjs/backend/yjsutil"
+
+	"github.com/labstack/echo/v4"
+)
+
+// updateCounterBuckets 直近1時間のupdate数を数えるバケット数（1分ごと）
+const updateCounterBuckets = 60
+
+// updateCounter 直近1時間に適用したupdateの数を1分単位で数える
+type updateCounter struct {
+	minutes [updateCounterBuckets]int64 // バケットの時刻（Unix時刻の分）
+	counts  [updateCounterBuckets]int
+}
+
+// add tの時刻にupdateを1つ数える
+func (u *updateCounter) add(t time.Time) {
+	minute := t.Unix() / 60
+	i := minute % updateCounterBuckets
+	if u.minutes[i] != minute {
+		u.minutes[i] = minute
+		u.counts[i] = 0
+	}
+	u.counts[i]++
+}
+
+// lastHour nowまでの直近1時間のupdate数
+func (u *updateCounter) lastHour(now time.Time) int {
+	minute := now.Unix() / 60
+	total := 0
+	for i, m := range u.minutes {
+		if minute-m < updateCounterBuckets {
+			total += u.counts[i]
+		}
+	}
+	return total
+}
+
+// RoomStats GET /api/rooms/:room/stats のレスポンス
+type RoomStats struct {
+	Room            string `json:"room"`
+	Nodes           int    `json:"nodes"`
+	Edges           int    `json:"edges"`
+	StateSize       int    `json:"stateSize"`       // ドキュメントのサイズ（バイト）
+	Tombstones      int    `json:"tombstones"`      // 削除済みで状態に残っている要素の数
+	Conflicts       int    `json:"conflicts"`       // これまでに同時に書き込まれた（競合した）キーの数
+	UpdatesLastHour int    `json:"updatesLastHour"` // 直近1時間に適用したupdateの数（このインスタンスで使用中の場合のみ）
+	Clients         int    `json:"clients"`         // 接続中のクライアント数
+	Active          bool   `json:"active"`
+}
+
+// HandleRoomStats roomのYDocをデコードした統計情報を返す
+// 認可はWebSocketの接続と同じく行う。状態全体をデコードするため、頻繁なポーリングには向かない。
+func HandleRoomStats(c echo.Context) error {
+	name, _, err := authorizeRoomAPI(c)
+	if err != nil {
+		return err
+	}
+
+	stats := RoomStats{Room: name}
+	var state []byte
+	if room := findRoom(name); room != nil {
+		room.stateMutex.RLock()
+		state = room.sharedState
+		stats.UpdatesLastHour = room.updateCounts.lastHour(time.Now())
+		room.stateMutex.RUnlock()
+		stats.Clients = room.clientCount()
+		stats.Active = true
+	} else {
+		ctx, cancel := context.WithTimeout(c.Request().Context(), storeTimeout)
+		defer cancel()
+		state, err = loadRoomState(ctx, name)
+		if os.IsNotExist(err) {
+			return echo.NewHTTPError(http.StatusNotFound, "room not found")
+		}
+		if err != nil {
+			logger.Error("error loading state", "room", name, "error", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to load room state")
+		}
+	}
+
+	stats.StateSize = len(state)
+	if len(state) > 0 {
+		info, err := yjsutil.InspectYjsDocument(state)
+		if err != nil {
+			logger.Error("error inspecting state", "room", name, "error", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to decode room state")
+		}
+		stats.Nodes = info.Nodes
+		stats.Edges = info.Edges
+		stats.Tombstones = info.Tombstones
+		stats.Conflicts = info.Conflicts
+	}
+	return c.JSON(http.StatusOK, stats)
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// RoomStatus 使用中のroomの状態
+type RoomStatus struct {
+	Name       string     `json:"name"`
+	Clients    int        `json:"clients"`
+	StateSize  int        `json:"stateSize"`
+	LastUpdate *time.Time `json:"lastUpdate,omitempty"` // 起動後にupdateがなければ省略
+	Degraded   bool       `json:"degraded"`             // 永続化の縮退モード
+}
+
+// RoomsStatus GET /api/v1/status のレスポンス
+type RoomsStatus struct {
+	Rooms         []RoomStatus `json:"rooms"`
+	TotalRooms    int          `json:"totalRooms"`
+	TotalClients  int          `json:"totalClients"`
+	DegradedRooms int          `json:"degradedRooms"`
+}
+
+// HandleRooms 使用中のroomと接続数の一覧を返す（監視用の管理API、読み取り専用）
+// room名を含むため、roomの認可に関係なく一覧できるAPIとしてADMIN_API_KEYで保護する。
+// メモリ上の情報のみを返すため、数秒ごとにポーリングしても負荷はかからない。
+func HandleRooms(c echo.Context) error {
+	status := RoomsStatus{Rooms: []RoomStatus{}}
+	for _, room := range activeRooms() {
+		room.stateMutex.RLock()
+		rs := RoomStatus{Name: room.name, StateSize: len(room.sharedState)}
+		if !room.lastUpdate.IsZero() {
+			t := room.lastUpdate
+			rs.LastUpdate = &t
+		}
+		room.stateMutex.RUnlock()
+		rs.Clients = room.clientCount()
+		rs.Degraded = room.degraded.Load()
+
+		status.Rooms = append(status.Rooms, rs)
+		status.TotalClients += rs.Clients
+		if rs.Degraded {
+			status.DegradedRooms++
+		}
+	}
+	sort.Slice(status.Rooms, func(i, j int) bool { return status.Rooms[i].Name < status.Rooms[j].Name })
+	status.TotalRooms = len(status.Rooms)
+	return c.JSON(http.StatusOK, status)
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestRoomsStatusRequiresAdminKey(t *testing.T) {
+	prevKey := adminAPIKey
+	adminAPIKey = "admin-key"
+	t.Cleanup(func() { adminAPIKey = prevKey })
+	forgetRooms(t, "status-room")
+	room := newTestRoom("status-room")
+	newTestClient(room)
+	roomsMutex.Lock()
+	rooms[room.name] = room
+	roomsMutex.Unlock()
+
+	e := echo.New()
+	RegisterAdminRoutes(e.Group("/api/v1"))
+	get := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/status", nil)
+		if key != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+key)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// room名の一覧は管理APIキーがなければ返さない
+	if rec := get(""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without key: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	rec := get("admin-key")
+	var status RoomsStatus
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &status) != nil {
+		t.Fatalf("with key: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	found := false
+	for _, rs := range status.Rooms {
+		if rs.Name == "status-room" {
+			found = rs.Clients == 1
+		}
+	}
+	if !found {
+		t.Errorf("rooms = %+v, want status-room with 1 client", status.Rooms)
+	}
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// storeTimeout 永続化バックエンドへの1回の操作のタイムアウト
+const storeTimeout = 5 * time.Second
+
+// StateStore roomの状態の永続化バックエンド
+// Loadは保存された状態がない場合 (nil, nil) を返す。
+type StateStore interface {
+	Save(ctx context.Context, room string, data []byte) error
+	Load(ctx context.Context, room string) ([]byte, error)
+	Delete(ctx context.Context, room string) error
+	// List 状態が保存されているroom名の一覧
+	List(ctx context.Context) ([]string, error)
+}
+
+// stateStore 使用中の永続化バックエンド（デフォルトはファイル）
+var stateStore StateStore = NewFileStore(persistDir)
+
+// SetStateStore 永続化バックエンドを設定する（サーバー起動前に呼び出す）
+func SetStateStore(store StateStore) {
+	stateStore = store
+
+	// 起動時に保存済みのroomを確認（状態はroomに最初に接続したときに読み込む）
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	names, err := store.List(ctx)
+	if err != nil {
+		logger.Error("error listing persisted rooms", "error", err)
+		return
+	}
+	logger.Info("found persisted rooms", "count", len(names), "rooms", names)
+}
+
+// FileStore ローカルファイルシステムへの永続化（ydoc_state_<room>.bin）
+type FileStore struct {
+	dir string
+
+	// updateログの追記と切り離しの直列化
+	logMutex sync.Mutex
+	// fsync待ちの追記（logMutexで保護）と、fsyncの直列化
+	logBatch     *logBatch
+	logSyncMutex sync.Mutex
+	// 監査ログの追記と読み込みの直列化
+	auditMutex sync.Mutex
+}
+
+// NewFileStore dirに状態を保存するFileStoreを作成
+func NewFileStore(dir string) *FileStore {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logger.Error("error creating persistence directory", "dir", dir, "error", err)
+	}
+	return &FileStore{dir: dir}
+}
+
+// path roomの永続化ファイルのパス
+func (s *FileStore) path(room string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s%s%s", persistenceFilePrefix, room, persistenceFileSuffix))
+}
+
+// Save 状態を原子的にファイルへ書き込む
+func (s *FileStore) Save(ctx context.Context, room string, data []byte) error {
+	return writeFileAtomic(s.path(room), data, 0644)
+}
+
+// Load ファイルから状態を読み込む
+func (s *FileStore) Load(ctx context.Context, room string) ([]byte, error) {
+	data, err := os.ReadFile(s.path(room))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Delete 永続化ファイルとupdateログを削除
+func (s *FileStore) Delete(ctx context.Context, room string) error {
+	if err := os.Remove(s.path(room)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.deleteUpdateLogs(room)
+}
+
+// List 永続化ファイルが存在するroom名の一覧
+func (s *FileStore) List(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, persistenceFilePrefix) || !strings.HasSuffix(name, persistenceFileSuffix) {
+			continue
+		}
+		room := strings.TrimSuffix(strings.TrimPrefix(name, persistenceFilePrefix), persistenceFileSuffix)
+		if validRoomName(room) {
+			names = append(names, room)
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisKeyPrefix Redisに状態を保存するキーの接頭辞（ydoc:<room>）
+const redisKeyPrefix = "ydoc:"
+
+// RedisStore Redisへの永続化
+// 複数のサーバーインスタンスで同じ状態を共有できる
+type RedisStore struct {
+	client *redis.Client
+	ttl    time.Duration // 0の場合は期限なし
+}
+
+// NewRedisStore Redisに状態を保存するRedisStoreを作成
+func NewRedisStore(client *redis.Client, ttl time.Duration) *RedisStore {
+	return &RedisStore{client: client, ttl: ttl}
+}
+
+// Save 状態をSETで保存
+func (s *RedisStore) Save(ctx context.Context, room string, data []byte) error {
+	return s.client.Set(ctx, redisKeyPrefix+room, data, s.ttl).Err()
+}
+
+// Load 状態をGETで読み込む
+func (s *RedisStore) Load(ctx context.Context, room string) ([]byte, error) {
+	data, err := s.client.Get(ctx, redisKeyPrefix+room).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Delete 状態を削除
+func (s *RedisStore) Delete(ctx context.Context, room string) error {
+	return s.client.Del(ctx, redisKeyPrefix+room).Err()
+}
+
+// List 状態が保存されているroom名の一覧
+func (s *RedisStore) List(ctx context.Context) ([]string, error) {
+	var names []string
+	iter := s.client.Scan(ctx, 0, redisKeyPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		names = append(names, strings.TrimPrefix(iter.Val(), redisKeyPrefix))
+	}
+	return names, iter.Err()
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// S3Store S3互換のオブジェクトストレージへの永続化
+// <prefix>ydoc_state_<room>.bin というキーで保存するため、書き込み可能なローカルディスクがなくても動作する。
+type S3Store struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3Store bucketのprefix以下に状態を保存するS3Storeを作成
+func NewS3Store(client *minio.Client, bucket, prefix string) *S3Store {
+	return &S3Store{client: client, bucket: bucket, prefix: prefix}
+}
+
+// key roomの状態のオブジェクトキー
+func (s *S3Store) key(room string) string {
+	return s.prefix + persistenceFilePrefix + room + persistenceFileSuffix
+}
+
+// Save 状態をオブジェクトとして書き込む（オブジェクトの書き込みは原子的）
+func (s *S3Store) Save(ctx context.Context, room string, data []byte) error {
+	_, err := s.client.PutObject(ctx, s.bucket, s.key(room), bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	return err
+}
+
+// Load オブジェクトから状態を読み込む
+func (s *S3Store) Load(ctx context.Context, room string) ([]byte, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, s.key(room), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	data, err := io.ReadAll(obj)
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Delete オブジェクトを削除（存在しない場合もエラーにしない）
+func (s *S3Store) Delete(ctx context.Context, room string) error {
+	return s.client.RemoveObject(ctx, s.bucket, s.key(room), minio.RemoveObjectOptions{})
+}
+
+// List 状態が保存されているroom名の一覧
+func (s *S3Store) List(ctx context.Context) ([]string, error) {
+	var names []string
+	keyPrefix := s.prefix + persistenceFilePrefix
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: keyPrefix}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if !strings.HasSuffix(obj.Key, persistenceFileSuffix) {
+			continue
+		}
+		room := strings.TrimSuffix(strings.TrimPrefix(obj.Key, keyPrefix), persistenceFileSuffix)
+		if validRoomName(room) {
+			names = append(names, room)
+		}
+	}
+	return names, nil
+}
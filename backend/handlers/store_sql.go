@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SQLStore SQLデータベース（SQLite / PostgreSQL）への永続化
+// ydoc_statesテーブルにroomごとに1行で状態を保存する。
+// プレースホルダー（$1）とupsert（ON CONFLICT）はどちらのデータベースでも同じ構文を使う。
+type SQLStore struct {
+	db *sql.DB
+}
+
+// sqlBlobTypes ドライバーごとのバイナリ列の型
+var sqlBlobTypes = map[string]string{
+	"sqlite": "BLOB",
+	"pgx":    "BYTEA",
+}
+
+// NewSQLStore dbに状態を保存するSQLStoreを作成（テーブルがなければ作成する）
+// driverはsql.Openに渡したドライバー名（"sqlite" または "pgx"）
+func NewSQLStore(ctx context.Context, db *sql.DB, driver string) (*SQLStore, error) {
+	blob, ok := sqlBlobTypes[driver]
+	if !ok {
+		return nil, fmt.Errorf("unsupported SQL driver: %s", driver)
+	}
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS ydoc_states (
+	room TEXT PRIMARY KEY,
+	data %s NOT NULL,
+	updated_at BIGINT NOT NULL
+)`, blob))
+	if err != nil {
+		return nil, fmt.Errorf("creating ydoc_states table: %w", err)
+	}
+	if err := createAuditTable(ctx, db); err != nil {
+		return nil, err
+	}
+	return &SQLStore{db: db}, nil
+}
+
+// Save 状態を保存（既存の行は上書き）
+func (s *SQLStore) Save(ctx context.Context, room string, data []byte) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO ydoc_states (room, data, updated_at) VALUES ($1, $2, $3)
+ON CONFLICT (room) DO UPDATE SET data = excluded.data, updated_at = excluded.updated_at`,
+		room, data, time.Now().Unix())
+	return err
+}
+
+// Load 状態を読み込む
+func (s *SQLStore) Load(ctx context.Context, room string) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRowContext(ctx, `SELECT data FROM ydoc_states WHERE room = $1`, room).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Delete 状態を削除
+func (s *SQLStore) Delete(ctx context.Context, room string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM ydoc_states WHERE room = $1`, room)
+	return err
+}
+
+// List 状態が保存されているroom名の一覧
+func (s *SQLStore) List(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT room FROM ydoc_states ORDER BY room`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
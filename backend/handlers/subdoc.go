@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"reactflow-yjs/backend/yjsutil"
+
+	"github.com/labstack/echo/v4"
+)
+
+// サブドキュメント（複数ページのフロー図）
+// 1つのプロジェクトのroomに、Yjsのサブドキュメントとして複数のページを持たせる。
+// 親のroomのYDocにはページのGUIDだけが記録され、各ページの内容は "<room>~<guid>" という
+// 名前の別のroomとして同期・永続化する。クライアントはページを開いたときに
+// /ws/:room/:subdoc へ接続するため、開かれていないページは読み込まれない。
+// 認可とALLOWED_ROOM_PATTERNSは親のroom名で判定する。
+
+// subdocSeparator 親のroom名とサブドキュメントのGUIDの区切り
+// （room名には使えない文字なので、通常のroomと名前が衝突しない）
+const subdocSeparator = "~"
+
+// subdocRoomName サブドキュメントを同期・永続化するroomの名前
+func subdocRoomName(room, guid string) string {
+	return room + subdocSeparator + guid
+}
+
+// parentRoomName サブドキュメントのroomであれば親のroom名を、そうでなければそのままの名前を返す
+func parentRoomName(name string) string {
+	parent, _, _ := strings.Cut(name, subdocSeparator)
+	return parent
+}
+
+// isSubdocOf nameがroomのサブドキュメントのroomであれば、そのGUIDを返す
+func isSubdocOf(name, room string) (string, bool) {
+	guid, ok := strings.CutPrefix(name, room+subdocSeparator)
+	return guid, ok && guid != ""
+}
+
+// SubdocSummary サブドキュメントの概要
+type SubdocSummary struct {
+	GUID       string `json:"guid"`
+	Room       string `json:"room"`       // 同期・永続化に使うroom名
+	Referenced bool   `json:"referenced"` // 親のYDocに含まれているか（falseはページを削除した後に残った状態）
+	Clients    int    `json:"clients"`
+	StateSize  int    `json:"stateSize"`
+	Active     bool   `json:"active"`
+	Persisted  bool   `json:"persisted"`
+}
+
+// roomSubdocs 親のYDocが参照しているサブドキュメントと、使用中・保存済みのサブドキュメントのroomの一覧
+func roomSubdocs(ctx context.Context, name string) ([]*SubdocSummary, error) {
+	summaries := make(map[string]*SubdocSummary)
+	summary := func(guid string) *SubdocSummary {
+		s, ok := summaries[guid]
+		if !ok {
+			s = &SubdocSummary{GUID: guid, Room: subdocRoomName(name, guid)}
+			summaries[guid] = s
+		}
+		return s
+	}
+
+	state, err := loadRoomState(ctx, name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(state) > 0 {
+		doc, err := yjsutil.DecodeDocument(state)
+		if err != nil {
+			return nil, err
+		}
+		for _, guid := range doc.Subdocs() {
+			summary(guid).Referenced = true
+		}
+	}
+
+	for _, room := range activeRooms() {
+		if guid, ok := isSubdocOf(room.name, name); ok {
+			s := summary(guid)
+			s.Active = true
+			s.Clients = room.clientCount()
+			s.StateSize = len(room.state())
+		}
+	}
+
+	names, err := stateStore.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, persisted := range names {
+		if guid, ok := isSubdocOf(persisted, name); ok {
+			s := summary(guid)
+			s.Persisted = true
+			if !s.Active {
+				data, err := loadPersisted(ctx, persisted)
+				if err != nil {
+					logger.Error("error loading state", "room", persisted, "error", err)
+				}
+				s.StateSize = len(data)
+			}
+		}
+	}
+
+	list := make([]*SubdocSummary, 0, len(summaries))
+	for _, s := range summaries {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].GUID < list[j].GUID })
+	return list, nil
+}
+
+// deleteSubdocRooms roomのサブドキュメントのroom（使用中・保存済み）をすべて削除する
+func deleteSubdocRooms(ctx context.Context, name string) error {
+	targets := make(map[string]bool)
+	for _, room := range activeRooms() {
+		if _, ok := isSubdocOf(room.name, name); ok {
+			targets[room.name] = true
+		}
+	}
+	names, err := stateStore.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, persisted := range names {
+		if _, ok := isSubdocOf(persisted, name); ok {
+			targets[persisted] = true
+		}
+	}
+	for target := range targets {
+		if err := deleteRoom(target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleListSubdocs roomのサブドキュメント（ページ）の一覧を返す
+func HandleListSubdocs(c echo.Context) error {
+	name := c.Param("room")
+	if !validRoomName(name) || name != parentRoomName(name) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid room name")
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), storeTimeout)
+	defer cancel()
+	list, err := roomSubdocs(ctx, name)
+	if err != nil {
+		logger.Error("error listing subdocuments", "room", name, "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to list subdocuments")
+	}
+	return c.JSON(http.StatusOK, list)
+}
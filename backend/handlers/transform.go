@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"os"
+	"sync"
+
+	"reactflow-yjs/backend/yjsutil"
+)
+
+// 送信メッセージの変換（リダクション）
+// roomごとに変換関数を登録しておき、クライアントの送信バッファに積む前に
+// 送信先ごとに適用する。閲覧専用のobserverには一部のフィールドを伏せる、といった用途に使う。
+var (
+	// observerに送るノード・エッジから取り除くフィールド（"data.secret" のようなドット区切り）
+	redactFields = ParseList(os.Getenv("REDACT_FIELDS"))
+	// REDACT_FIELDSを適用するroom（未設定の場合はすべてのroom）
+	redactRooms = ParseList(os.Getenv("REDACT_ROOMS"))
+)
+
+// Recipient 変換関数に渡す送信先クライアントの情報
+type Recipient struct {
+	Room     string
+	Observer bool // トークンで閲覧専用のobserverとして認可されたクライアント
+}
+
+// Transform 送信メッセージの変換関数
+// 変換後のメッセージを返す。nilを返した場合、そのクライアントには送信しない。
+type Transform func(to Recipient, msg []byte) []byte
+
+var (
+	transforms      = make(map[string][]Transform)
+	transformsMutex sync.RWMutex
+)
+
+// RegisterTransform roomに送信メッセージの変換関数を登録する（"*" はすべてのroom）
+func RegisterTransform(room string, t Transform) {
+	transformsMutex.Lock()
+	defer transformsMutex.Unlock()
+	transforms[room] = append(transforms[room], t)
+}
+
+func init() {
+	if len(redactFields) == 0 {
+		return
+	}
+	if len(redactRooms) == 0 {
+		redactRooms = []string{"*"}
+	}
+	for _, room := range redactRooms {
+		RegisterTransform(room, redactForObservers)
+	}
+	logger.Info("redacting fields for observers", "fields", redactFields, "rooms", redactRooms)
+}
+
+// transform 送信先のクライアントに合わせてメッセージを変換する
+func (c *client) transform(msg []byte) []byte {
+	return applyTransforms(Recipient{Room: c.room.name, Observer: c.observer}, msg)
+}
+
+// applyTransforms 送信先のroomに登録された変換関数を順に適用する
+func applyTransforms(to Recipient, msg []byte) []byte {
+	transformsMutex.RLock()
+	list := append(append([]Transform(nil), transforms["*"]...), transforms[to.Room]...)
+	transformsMutex.RUnlock()
+
+	for _, t := range list {
+		if msg = t(to, msg); msg == nil {
+			return nil
+		}
+	}
+	return msg
+}
+
+// redactForObservers observer宛てのsyncメッセージに含まれるupdateからREDACT_FIELDSを取り除く
+// 取り除けなかった場合は内容を漏らさないよう送信しない。
+func redactForObservers(to Recipient, msg []byte) []byte {
+	if !to.Observer {
+		return msg
+	}
+	syncType, payload, err := decodeSyncMessage(msg)
+	if err != nil || syncType == syncStep1 {
+		// sync以外のメッセージとstate vectorはそのまま送る
+		return msg
+	}
+	redacted, err := yjsutil.RedactUpdate(payload, redactFields)
+	if err != nil {
+		logger.Error("failed to redact update for observer", "room", to.Room, "error", err)
+		return nil
+	}
+	return encodeSyncMessage(syncType, redacted)
+}
+
+// transformUpdate 送信先に合わせてupdateを変換する（HTTPで状態や差分を返す場合に使う）
+// 変換関数はsyncメッセージに対して適用するため、メッセージにしてからupdateを取り出す。
+// 送信しない（nilを返した）変換関数があった場合はfalseを返す。
+func transformUpdate(to Recipient, update []byte) ([]byte, bool) {
+	msg := applyTransforms(to, encodeSyncMessage(syncStep2, update))
+	if msg == nil {
+		return nil, false
+	}
+	_, update, err := decodeSyncMessage(msg)
+	if err != nil {
+		logger.Error("error decoding transformed message", "room", to.Room, "error", err)
+		return nil, false
+	}
+	return update, true
+}
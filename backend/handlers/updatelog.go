@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"reactflow-yjs/backend/yjsutil"
+)
+
+// 追記型のupdateログ
+// updateを受け取るたびに状態全体を書き直すのではなく、roomごとのログにupdateを追記し、
+// 自動保存（圧縮）のときにマージ済みの状態として書き込んでログを削除する。
+// 状態の取得とログの切り離しは同時に行うため、圧縮中に届いたupdateは新しいログに残る。
+// 読み込み時は保存済みの状態にログのupdateをマージする（重複したupdateのマージは無害）。
+var (
+	// 永続化バックエンドが対応していればupdateログを使う
+	updateLogEnabled = envBool("UPDATE_LOG", true)
+	// 自動保存を待たずに圧縮するログのupdate数（0以下の場合は自動保存のときのみ）
+	compactAfterUpdates = envInt("COMPACT_AFTER_UPDATES", 500)
+)
+
+// FileStoreのupdateログの追記は、fsyncを複数の追記でまとめて行う（グループコミット）。
+// 追記はファイルに書き込んだ時点で現在のバッチに加わり、最初にfsyncを始めた追記が
+// その時点までのバッチ全体をfsyncする。fsync中に届いた追記は次のバッチになるため、
+// 同時に多くのクライアントが編集していてもfsyncの回数は追記の数ではなく並行度で抑えられる。
+// どの追記もfsyncが終わるまで戻らないため、PERSIST_ACKSのACKの意味は変わらない。
+
+// logBatch fsync待ちの追記のまとまり
+type logBatch struct {
+	files []*os.File
+	done  chan struct{}
+	err   error // doneが閉じてから読む
+}
+
+func newLogBatch() *logBatch {
+	return &logBatch{done: make(chan struct{})}
+}
+
+// UpdateLog updateの追記に対応した永続化バックエンド
+// StateStoreがこのインターフェースも実装している場合にupdateログを使う。
+type UpdateLog interface {
+	AppendUpdate(ctx context.Context, room string, update []byte) error
+	// LoadUpdates 保存済みの状態にまだ含まれていない可能性のあるupdate（古い順）
+	LoadUpdates(ctx context.Context, room string) ([][]byte, error)
+	// RotateUpdates 現在のログを圧縮対象として切り離す（以降の追記は新しいログに行う）
+	RotateUpdates(ctx context.Context, room string) error
+	// RemoveRotatedUpdates 切り離したログを削除する（圧縮した状態の保存後に呼び出す）
+	RemoveRotatedUpdates(ctx context.Context, room string) error
+}
+
+// updateLog 使用するupdateログ（無効または未対応の場合はnil）
+func updateLog() UpdateLog {
+	if !updateLogEnabled {
+		return nil
+	}
+	l, _ := stateStore.(UpdateLog)
+	return l
+}
+
+// appendUpdate updateをログに追記し、溜まっていれば圧縮する
+// applyUpdateの後に呼び出す（切り離し済みのログに、状態に含まれないupdateが入らないようにするため）
+func (r *Room) appendUpdate(log UpdateLog, update []byte) error {
+	// 削除中のroomのログを作り直さない
+	if r.deleting.Load() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if err := log.AppendUpdate(ctx, r.name, update); err != nil {
+		logger.Error("error appending update", "room", r.name, "bytes", len(update), "error", err)
+		r.setDegraded(true, err)
+		return err
+	}
+
+	// 読み込み時のログのupdate数で既に超えている場合もあるため、到達後は圧縮が終わるまで数え続ける
+	if n := r.loggedUpdates.Add(1); compactAfterUpdates > 0 && n >= int64(compactAfterUpdates) && r.compacting.CompareAndSwap(false, true) {
+		go func() {
+			defer r.compacting.Store(false)
+			r.saveState()
+		}()
+	}
+	return nil
+}
+
+// mergeLoggedUpdates 保存済みの状態にログのupdateをマージし、マージ後の状態とupdate数を返す
+// マージできないupdateは読み飛ばす（他のupdateまで失わないようにする）
+func mergeLoggedUpdates(ctx context.Context, name string, state []byte) ([]byte, int, error) {
+	log := updateLog()
+	if log == nil {
+		return state, 0, nil
+	}
+	updates, err := log.LoadUpdates(ctx, name)
+	if err != nil || len(updates) == 0 {
+		return state, 0, err
+	}
+
+	for _, update := range updates {
+		merged := update
+		if len(state) > 0 {
+			if merged, err = yjsutil.MergeUpdates(state, update); err != nil {
+				logger.Warn("skipping invalid logged update", "room", name, "bytes", len(update), "error", err)
+				continue
+			}
+		}
+		state = merged
+	}
+	return state, len(updates), nil
+}
+
+// updateLogPath roomのupdateログのパス（ydoc_updates_<room>.log）
+func (s *FileStore) updateLogPath(room string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("ydoc_updates_%s.log", room))
+}
+
+// rotatedLogPath 圧縮対象として切り離したログのパス
+func (s *FileStore) rotatedLogPath(room string) string {
+	return s.updateLogPath(room) + ".compacting"
+}
+
+// AppendUpdate updateを長さ付きでログに追記し、fsyncが終わるまで待つ
+func (s *FileStore) AppendUpdate(ctx context.Context, room string, update []byte) error {
+	s.logMutex.Lock()
+	f, err := os.OpenFile(s.updateLogPath(room), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		s.logMutex.Unlock()
+		return err
+	}
+	if _, err := f.Write(appendVarUint8Array(nil, update)); err != nil {
+		s.logMutex.Unlock()
+		f.Close()
+		return err
+	}
+	if s.logBatch == nil {
+		s.logBatch = newLogBatch()
+	}
+	batch := s.logBatch
+	batch.files = append(batch.files, f)
+	s.logMutex.Unlock()
+
+	return s.syncLogBatch(batch)
+}
+
+// syncLogBatch 追記したバッチのfsyncが終わるまで待つ
+// まだ誰もfsyncしていなければ、その時点のバッチを切り離してまとめてfsyncする。
+func (s *FileStore) syncLogBatch(batch *logBatch) error {
+	s.logSyncMutex.Lock()
+	select {
+	case <-batch.done:
+		s.logSyncMutex.Unlock()
+		return batch.err
+	default:
+	}
+
+	// fsync済みのバッチはすべてdoneが閉じているため、このバッチはまだ現在のバッチ
+	s.logMutex.Lock()
+	s.logBatch = nil
+	s.logMutex.Unlock()
+
+	for _, f := range batch.files {
+		if err := f.Sync(); err != nil && batch.err == nil {
+			batch.err = err
+		}
+		if err := f.Close(); err != nil && batch.err == nil {
+			batch.err = err
+		}
+	}
+	close(batch.done)
+	s.logSyncMutex.Unlock()
+	return batch.err
+}
+
+// LoadUpdates 切り離したログと現在のログのupdateを読み込む
+// 書き込み途中で落ちた場合の末尾の不完全なレコードは無視する
+func (s *FileStore) LoadUpdates(ctx context.Context, room string) ([][]byte, error) {
+	s.logMutex.Lock()
+	defer s.logMutex.Unlock()
+
+	var updates [][]byte
+	for _, path := range []string{s.rotatedLogPath(room), s.updateLogPath(room)} {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for len(data) > 0 {
+			update, n := readVarUint8Array(data)
+			if n == 0 {
+				logger.Warn("ignoring truncated update log record", "room", room, "path", path, "bytes", len(data))
+				break
+			}
+			updates = append(updates, update)
+			data = data[n:]
+		}
+	}
+	return updates, nil
+}
+
+// RotateUpdates 現在のログを切り離す
+// 前回の圧縮で削除できなかったログが残っている場合は、その後ろに連結する
+func (s *FileStore) RotateUpdates(ctx context.Context, room string) error {
+	s.logMutex.Lock()
+	defer s.logMutex.Unlock()
+
+	current, rotated := s.updateLogPath(room), s.rotatedLogPath(room)
+	if _, err := os.Stat(rotated); errors.Is(err, os.ErrNotExist) {
+		if err := os.Rename(current, rotated); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	src, err := os.Open(current)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(rotated, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Remove(current)
+}
+
+// RemoveRotatedUpdates 切り離したログを削除
+func (s *FileStore) RemoveRotatedUpdates(ctx context.Context, room string) error {
+	s.logMutex.Lock()
+	defer s.logMutex.Unlock()
+
+	if err := os.Remove(s.rotatedLogPath(room)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// deleteUpdateLogs roomのupdateログをすべて削除
+func (s *FileStore) deleteUpdateLogs(room string) error {
+	s.logMutex.Lock()
+	defer s.logMutex.Unlock()
+
+	for _, path := range []string{s.updateLogPath(room), s.rotatedLogPath(room)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
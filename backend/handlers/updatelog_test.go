@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAppendUpdateConcurrent(t *testing.T) {
+	store := useTempStore(t)
+	ctx := context.Background()
+
+	// 並行した追記はfsyncをまとめて行うが、どの追記もログに残る
+	const writers, perWriter = 20, 10
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			room := fmt.Sprintf("append-%d", w%2)
+			for i := 0; i < perWriter; i++ {
+				if err := store.AppendUpdate(ctx, room, []byte{byte(w), byte(i)}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for _, room := range []string{"append-0", "append-1"} {
+		updates, err := store.LoadUpdates(ctx, room)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(updates) != writers/2*perWriter {
+			t.Errorf("%s: %d updates, want %d", room, len(updates), writers/2*perWriter)
+		}
+	}
+}
+
+func TestCompactAfterUpdatesLoadedFromLog(t *testing.T) {
+	store := useTempStore(t)
+	prev := compactAfterUpdates
+	compactAfterUpdates = 10
+	t.Cleanup(func() { compactAfterUpdates = prev })
+
+	// 読み込み時にログのupdate数が既にCOMPACT_AFTER_UPDATESを超えていても、次の追記で圧縮する
+	room := newTestRoom("compact-loaded")
+	room.sharedState = mapSetUpdate(1, 0, "nodesById", "n1", "a")
+	room.loggedUpdates.Store(15)
+	if err := room.appendUpdate(store, mapSetUpdate(1, 0, "nodesById", "n1", "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 2*time.Second, "update log compacted", func() bool {
+		return room.loggedUpdates.Load() == 0 && !room.compacting.Load()
+	})
+	updates, err := store.LoadUpdates(context.Background(), room.name)
+	if err != nil || len(updates) != 0 {
+		t.Errorf("logged updates after compaction = %d (%v), want 0", len(updates), err)
+	}
+	if data, err := loadPersisted(context.Background(), room.name); err != nil || len(data) == 0 {
+		t.Errorf("persisted state = %d bytes (%v), want the compacted state", len(data), err)
+	}
+}
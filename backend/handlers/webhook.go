@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Webhook
+// roomの作成、クライアントの参加・退出、ドキュメントの変更をWEBHOOK_URLSのURLにPOSTで通知する。
+// ドキュメントの変更は最初の変更からWEBHOOK_DEBOUNCEの間の変更をまとめて1回通知する。
+// 通知は受信処理を止めないよう1つのゴルーチンで順に送信し、失敗した場合は数回再試行する。
+// 変更を通知するのは変更を受け取ったインスタンスのみ（pub/subで届いた変更は通知しない）。
+var (
+	webhookURLs = ParseList(os.Getenv("WEBHOOK_URLS"))
+	// 通知するイベント（カンマ区切り、未設定の場合はすべて）
+	webhookEvents = ParseList(os.Getenv("WEBHOOK_EVENTS"))
+	// ドキュメントの変更をまとめる時間
+	webhookDebounce = envDuration("WEBHOOK_DEBOUNCE", 5*time.Second)
+	// ドキュメントの変更の通知にフロー図（GET /api/rooms/:room/flow と同じ内容）を含めるかどうか
+	webhookIncludeFlow = envBool("WEBHOOK_INCLUDE_FLOW", false)
+	// 設定されている場合、本文のHMAC-SHA256をX-Floweditor-Signatureヘッダーに付ける
+	webhookSecret = os.Getenv("WEBHOOK_SECRET")
+	// 1回の送信のタイムアウト
+	webhookTimeout = envDuration("WEBHOOK_TIMEOUT", 5*time.Second)
+)
+
+// Webhookのイベント
+const (
+	webhookRoomCreated     = "room.created"
+	webhookClientJoined    = "client.joined"
+	webhookClientLeft      = "client.left"
+	webhookDocumentChanged = "document.changed"
+)
+
+const (
+	// 送信待ちの通知の最大数（超えた場合は通知を破棄する）
+	webhookQueueSize = 256
+	// 送信に失敗した場合の試行回数
+	webhookAttempts = 3
+)
+
+// WebhookEvent Webhookで送信する本文
+type WebhookEvent struct {
+	Event    string    `json:"event"`
+	Room     string    `json:"room"`
+	Time     time.Time `json:"time"`
+	User     string    `json:"user,omitempty"`     // 参加・退出したクライアントのユーザーID
+	ClientID uint64    `json:"clientId,omitempty"` // 参加・退出したクライアントのID
+	Clients  int       `json:"clients"`            // 接続中のクライアント数
+	Flow     *Flow     `json:"flow,omitempty"`     // 変更後のフロー図（WEBHOOK_INCLUDE_FLOW）
+}
+
+var (
+	webhookQueue  = make(chan WebhookEvent, webhookQueueSize)
+	webhookClient = &http.Client{Timeout: webhookTimeout}
+	// 通知するイベントの集合
+	webhookEventSet = make(map[string]bool)
+)
+
+func init() {
+	if len(webhookURLs) == 0 {
+		return
+	}
+	for _, e := range webhookEvents {
+		switch e {
+		case webhookRoomCreated, webhookClientJoined, webhookClientLeft, webhookDocumentChanged:
+			webhookEventSet[e] = true
+		default:
+			fatal("invalid WEBHOOK_EVENTS entry", "event", e)
+		}
+	}
+	go webhookSender()
+}
+
+// webhookEnabled イベントを通知するかどうか
+func webhookEnabled(event string) bool {
+	return len(webhookURLs) > 0 && (len(webhookEventSet) == 0 || webhookEventSet[event])
+}
+
+// emitWebhook 通知を送信待ちに追加する（ロックを保持したまま呼び出せる）
+func emitWebhook(e WebhookEvent) {
+	if !webhookEnabled(e.Event) {
+		return
+	}
+	e.Time = time.Now()
+	select {
+	case webhookQueue <- e:
+	default:
+		logger.Warn("webhook queue full, event dropped", "event", e.Event, "room", e.Room)
+	}
+}
+
+// scheduleChangeWebhook ドキュメントの変更の通知を予約する
+// 予約済みの場合は何もしない（WEBHOOK_DEBOUNCEの間の変更を1回にまとめる）
+func (r *Room) scheduleChangeWebhook() {
+	if !webhookEnabled(webhookDocumentChanged) || !r.changeWebhookPending.CompareAndSwap(false, true) {
+		return
+	}
+	time.AfterFunc(webhookDebounce, func() {
+		r.changeWebhookPending.Store(false)
+		e := WebhookEvent{Event: webhookDocumentChanged, Room: r.name, Clients: r.clientCount()}
+		if webhookIncludeFlow {
+			flow, err := decodeFlow(r.name, r.state())
+			if err != nil {
+				logger.Error("error decoding flow for webhook", "room", r.name, "error", err)
+			}
+			e.Flow = flow
+		}
+		emitWebhook(e)
+	})
+}
+
+// webhookSender 送信待ちの通知を順に全URLへ送信する
+func webhookSender() {
+	for e := range webhookQueue {
+		body, err := json.Marshal(e)
+		if err != nil {
+			logger.Error("error encoding webhook", "event", e.Event, "room", e.Room, "error", err)
+			continue
+		}
+		for _, url := range webhookURLs {
+			deliverWebhook(url, e, body)
+		}
+	}
+}
+
+// deliverWebhook 通知を送信し、失敗した場合（接続エラー、5xx）は間隔をあけて再試行する
+func deliverWebhook(url string, e WebhookEvent, body []byte) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := postWebhook(url, e.Event, body)
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			logger.Error("webhook delivery failed", "event", e.Event, "room", e.Room, "url", url, "attempts", attempt, "error", err)
+			return
+		}
+		logger.Warn("webhook delivery failed, retrying", "event", e.Event, "room", e.Room, "url", url, "attempt", attempt, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// postWebhook 通知を1回送信する
+func postWebhook(url, event string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Floweditor-Event", event)
+	if webhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(webhookSecret))
+		mac.Write(body)
+		req.Header.Set("X-Floweditor-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("webhook failed with status %d", resp.StatusCode)
+	}
+	if resp.StatusCode >= 300 {
+		// 受信側が拒否した通知は再試行しても同じ結果になるため、ログに残して諦める
+		logger.Warn("webhook rejected", "event", event, "url", url, "status", resp.StatusCode)
+	}
+	return nil
+}
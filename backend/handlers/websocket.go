@@ -1,43 +1,109 @@
 package handlers
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"reactflow-yjs/backend/yjsutil"
+
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
+	"golang.org/x/time/rate"
 )
 
-const (
-	// 永続化ファイルのパス
-	persistenceFile = "ydoc_state.bin"
-	// 自動保存の間隔（秒）
-	autoSaveInterval = 30
+var (
+	// pongを待つ時間（この間に応答がなければ接続を閉じる）
+	pongWait = envDuration("PONG_WAIT", 60*time.Second)
+	// pingの送信間隔（pongWaitより短くする）
+	// スリープ復帰後などに切れた接続を早めに検出できるよう、デフォルトは30秒ごと
+	pingPeriod = envDuration("PING_PERIOD", defaultPingPeriod())
+	// 1回の書き込みのタイムアウト
+	writeWait = envDuration("WRITE_WAIT", 10*time.Second)
+	// 1メッセージの最大サイズ（超えた場合は切断）
+	maxUpdateBytes = envInt("MAX_UPDATE_BYTES", 10*1024*1024)
+	// permessage-deflateによる圧縮（クライアントが対応していない場合は圧縮せずに接続する）
+	wsCompression = envBool("WS_COMPRESSION", true)
 )
 
+// errMessageTooBig メッセージがMAX_UPDATE_BYTESを超えた場合のエラー
+var errMessageTooBig = errors.New("message too big")
+
+// nextClientID 最後に割り当てたクライアントのID（管理APIで切断するクライアントの指定に使う）
+var nextClientID atomic.Uint64
+
 // 接続中のクライアント管理
 type client struct {
 	conn *websocket.Conn
 	send chan []byte
+	room *Room
+
+	// プロセス内で一意なIDと接続した時刻
+	id          uint64
+	connectedAt time.Time
+	// 接続ごとのロガー（room、クライアントID、接続元、ユーザーを付ける）
+	log *slog.Logger
+
+	// 最後に操作した（updateまたはkeepaliveを受信した）時刻（UnixNano）
+	lastSeen atomic.Int64
+	// アイドルの警告を送信済みかどうか
+	idleWarned atomic.Bool
+
+	// 送信が追いつかず切断したかどうか（以降のメッセージは積まない）
+	slow atomic.Bool
+	// メッセージを取りこぼしたため、送信バッファが空いたら状態全体を送り直すかどうか
+	resync atomic.Bool
+	// updateをスキーマ違反で拒否したかどうか（切断まで以降のupdateを適用しない）
+	rejected atomic.Bool
+
+	// トークンのユーザーIDと、閲覧のみ許可されているかどうか（?mode=readonly を含む）
+	user     string
+	readOnly bool
+	// 閲覧のみのクライアントのupdateを破棄したかどうか（受信ループのみが使用）
+	readOnlyDropped bool
+	// 編集権・ロックでupdateを破棄することを通知済みかどうか
+	// 編集権・ロックが変わったときに改めて設定し、破棄するたびに通知を送らないようにする。
+	writerDeniedNotified atomic.Bool
+	lockDeniedNotified   atomic.Bool
+
+	// トークンで閲覧専用のobserverとして認可されたかどうか（送信メッセージの変換に使う）
+	observer bool
+
+	// 受信メッセージのレート制限（受信ループのみが使用）
+	limiter     *rate.Limiter
+	byteLimiter *rate.Limiter
+	drops       int
+	firstDrop   time.Time
+	// 接続元のIPアドレスと、同じIPアドレスの接続で共有するレート制限（無効の場合はnil）
+	ip       string
+	ipLimits *ipLimiter
+
+	// updateのレート制限と、超過分をまとめて適用するまでの待機
+	updateLimiter *rate.Limiter
+	coalesced     [][]byte
+	flushTimer    *time.Timer
+	coalesceMutex sync.Mutex
 }
 
-var (
-	// 接続中のクライアント
-	clients      = make(map[*client]bool)
-	clientsMutex sync.RWMutex
-
-	// 共有状態（簡易版：実際にはYDocのバイナリデータを保持）
-	sharedState []byte
-	stateMutex  sync.RWMutex
-)
+// defaultPingPeriod pingの送信間隔のデフォルト値（30秒、ただしpongWaitの9割まで）
+func defaultPingPeriod() time.Duration {
+	if d := pongWait * 9 / 10; d < 30*time.Second {
+		return d
+	}
+	return 30 * time.Second
+}
 
 func init() {
-	// サーバー起動時に保存された状態を読み込む
-	loadState()
+	if pingPeriod <= 0 || pingPeriod >= pongWait {
+		logger.Warn("PING_PERIOD must be shorter than PONG_WAIT", "ping_period", pingPeriod, "pong_wait", pongWait, "using", pongWait*9/10)
+		pingPeriod = pongWait * 9 / 10
+	}
 
 	// 自動保存を開始
 	go autoSave()
@@ -46,230 +112,474 @@ func init() {
 // HandleWebSocket WebSocketハンドラー
 // Yjsのsync protocolメッセージを転送
 func HandleWebSocket(c echo.Context) error {
+	if shuttingDown.Load() {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "server is shutting down")
+	}
+
+	roomName := c.Param("room")
+	// /ws/:room/:subdoc はroomのサブドキュメント（ページ）を同期する
+	if guid := c.Param("subdoc"); guid != "" {
+		if roomName != parentRoomName(roomName) {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid room name")
+		}
+		roomName = subdocRoomName(roomName, guid)
+	}
+	if !validRoomName(roomName) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid room name")
+	}
+	if !roomAllowed(roomName) {
+		return echo.NewHTTPError(http.StatusForbidden, "room is not allowed")
+	}
+	grant, err := authorizeRequest(c.Request(), roomName)
+	if err != nil {
+		return err
+	}
+	// ?mode=readonly で接続したクライアントは、トークンの権限にかかわらず閲覧のみにする
+	// （ダッシュボードへの埋め込みなどで、誤って編集しないようにするため）
+	switch mode := c.QueryParam("mode"); mode {
+	case "":
+	case "readonly":
+		grant.ReadOnly = true
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid mode")
+	}
+
+	// サーバー全体の接続数の上限（アップグレード前にHTTPの503で断る）
+	if !acquireConnection() {
+		metricRejectedConnections.WithLabelValues("max_connections").Inc()
+		logger.Warn("rejected websocket connection, too many connections", "room", roomName, "remote_addr", c.RealIP(), "max_connections", maxConnections)
+		c.Response().Header().Set("Retry-After", retryAfterHeader())
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "too many connections")
+	}
+	defer releaseConnection()
+
 	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			// 開発環境ではすべてのオリジンを許可
-			return true
-		},
+		// ALLOWED_ORIGINSのオリジンのみ許可（未設定の場合は同じホストのみ、GO_ENV=developmentではすべて許可）
+		CheckOrigin:       checkOrigin,
+		EnableCompression: wsCompression,
+		// トークンをSec-WebSocket-Protocolで渡された場合に選択して応答する
+		Subprotocols: []string{tokenSubprotocol},
 	}
 	conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
 	if err != nil {
 		return err
 	}
-
-	roomName := c.Param("room")
-	log.Printf("WebSocket client connected: %s (room: %s)", c.RealIP(), roomName)
+	// 上限を超えるメッセージは最後まで読み込まずに1009で閉じる（メモリを使い切らせないため）
+	conn.SetReadLimit(int64(maxUpdateBytes))
+	// 圧縮はネゴシエーションに成功した場合のみ行われる（メッセージごとの有効化はwriteBinary）
+	if err := conn.SetCompressionLevel(wsCompressionLevel); err != nil {
+		logger.Warn("error setting compression level", "level", wsCompressionLevel, "error", err)
+	}
 
 	client := &client{
 		conn: conn,
-		send: make(chan []byte, 256),
+		send: make(chan []byte, sendBufferSize),
+
+		id:          nextClientID.Add(1),
+		connectedAt: time.Now(),
+
+		user:     grant.User,
+		readOnly: grant.ReadOnly,
+		observer: grant.Observer,
+		limiter:  newMessageLimiter(),
+
+		byteLimiter: newByteLimiter(maxBytesPerSecond),
+		ip:          c.RealIP(),
+
+		updateLimiter: newUpdateLimiter(),
+	}
+	client.log = clientLogger(roomName, client)
+	client.log.Info("websocket client connected", "read_only", grant.ReadOnly, "observer", grant.Observer)
+	client.ipLimits = acquireIPLimiter(client.ip)
+	defer releaseIPLimiter(client.ip)
+	client.touch()
+	room, err := joinRoomWaiting(roomName, client)
+	if err != nil {
+		client.log.Warn("rejected client", "error", err)
+		// 接続数の上限に達している場合は、後で再接続するよう1013で閉じる
+		if errors.Is(err, errRoomFull) {
+			client.rejectRoomFull()
+		} else {
+			conn.Close()
+		}
+		return nil
 	}
 
-	clientsMutex.Lock()
-	clients[client] = true
-	clientsMutex.Unlock()
+	// ウェルカムメッセージと他のユーザーのawareness状態
+	client.sendWelcome()
+	client.sendAwarenessStates()
+	if room.degraded.Load() {
+		client.sendDegradedStatus()
+	}
+	if client.readOnly {
+		client.sendControl(controlMessage{Type: "access-read-only", Message: "This connection is read-only"})
+	}
+	if roomLock(roomName) != nil {
+		client.sendLockStatus()
+	}
+
+	// トークンの有効期限が切れたら切断する（再接続時に新しいトークンを要求させる）
+	if !grant.Expires.IsZero() {
+		expiry := time.AfterFunc(time.Until(grant.Expires), func() {
+			client.log.Info("closing connection, token expired")
+			client.closeWithCode(closeTokenExpired, "token expired")
+		})
+		defer expiry.Stop()
+	}
 
-	// 送信ループ
+	// 送信ループ（room削除時に終了を待てるよう、joinRoomでWaitGroupに登録済み）
 	go client.writePump()
 
 	// 受信ループ
 	client.readPump()
 
-	// クリーンアップ
-	clientsMutex.Lock()
-	delete(clients, client)
-	clientsMutex.Unlock()
+	// クリーンアップ（まとめて待機中のupdateは切断前に適用する）
+	client.flushCoalesced()
+	client.clearAwareness()
+	room.releaseWriter(client)
+	room.removeClient(client)
 	close(client.send)
+	room.wg.Done()
 
-	log.Println("WebSocket client disconnected")
+	client.log.Info("websocket client disconnected")
 	return nil
 }
 
 // readPump メッセージ受信ループ
+// pongWaitの間にメッセージもpongも届かない場合はタイムアウトで終了する
 func (c *client) readPump() {
 	defer c.conn.Close()
 
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
 	for {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if err == io.EOF {
-				log.Println("WebSocket read EOF")
+				c.log.Debug("websocket read EOF")
 			} else {
-				log.Printf("WebSocket read error: %v", err)
+				c.log.Info("websocket read error", "error", err)
 			}
 			break
 		}
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+
+		// レート制限を超えたメッセージは処理しない（updateはsubmitUpdateでまとめる）
+		allowed, keepOpen := c.allowMessage(message)
+		if !keepOpen {
+			break
+		}
+		if !allowed {
+			continue
+		}
 
 		// Yjsメッセージを処理
 		if err := c.handleMessage(message); err != nil {
-			log.Printf("Error handling message: %v", err)
+			c.log.Warn("error handling message", "error", err)
 			break
 		}
 	}
 }
 
 // writePump メッセージ送信ループ
+// 一定間隔でpingを送信し、応答のない接続を検出する
 func (c *client) writePump() {
-	for message := range c.send {
-		if err := c.conn.WriteMessage(websocket.BinaryMessage, message); err != nil {
-			log.Printf("WebSocket write error: %v", err)
-			return
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+		c.room.wg.Done()
+	}()
+
+	for {
+		select {
+		case message, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, nil)
+				return
+			}
+			if err := c.writeBinary(message); err != nil {
+				c.log.Info("websocket write error", "error", err)
+				return
+			}
+			if err := c.writeResync(); err != nil {
+				c.log.Info("websocket write error", "error", err)
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.log.Info("websocket ping error", "error", err)
+				return
+			}
 		}
 	}
-	c.conn.WriteMessage(websocket.CloseMessage, nil)
 }
 
 // handleMessage Yjsメッセージを処理
-// y-websocketはYjsのsync protocolメッセージをそのまま送信するため、
-// メッセージをそのまま転送する必要があります
+// syncメッセージはサーバーが応答・状態の更新を行い、それ以外は同じroomに転送する
 func (c *client) handleMessage(msg []byte) error {
-	if len(msg) == 0 {
-		return nil
+	// 空のフレーム（タイプもない）は処理しない
+	if len(msg) < 1 {
+		return errMalformedMessage
 	}
-
-	// デバッグ用：メッセージタイプをログ出力
-	if len(msg) > 0 {
-		msgType := msg[0]
-		log.Printf("Received message type: %d, length: %d", msgType, len(msg))
+	// サイズの上限を超えるメッセージは保存も転送もせず、1009で切断する
+	if len(msg) > maxUpdateBytes {
+		c.log.Warn("message too big", "bytes", len(msg), "max_bytes", maxUpdateBytes)
+		c.closeWithCode(websocket.CloseMessageTooBig, "message too big")
+		return errMessageTooBig
 	}
 
-	// Updateメッセージ（タイプ2）の場合は状態を保存
-	if len(msg) > 0 && msg[0] == 2 {
-		c.handleUpdate(msg)
+	msgType, n := readVarUint(msg)
+	if n == 0 {
+		return errMalformedMessage
 	}
+	metricMessages.WithLabelValues(c.room.name, messageTypeLabel(msgType)).Inc()
 
-	// y-websocketは、Yjsのsync protocolメッセージをそのまま送信するため、
-	// メッセージをそのまま全クライアントにブロードキャスト
-	return c.broadcastMessage(msg)
-}
+	// デバッグ用：メッセージタイプをログ出力
+	c.log.Debug("received message", "msg_type", messageTypeLabel(msgType), "bytes", len(msg))
 
-// handleUpdate Updateメッセージ（タイプ2）を処理して状態を保存
-func (c *client) handleUpdate(msg []byte) {
-	if len(msg) < 2 || msg[0] != 2 {
-		return
+	// awarenessは一時的な情報（カーソル位置など）なので、ドキュメントの状態には
+	// マージも保存もせず、同じroomの他クライアントに転送するだけにする
+	if isAwarenessMessage(msg) {
+		c.handleAwarenessMessage(msg)
+		return c.broadcastMessage(msg)
 	}
 
-	update := msg[1:]
-	if len(update) == 0 {
-		return
+	switch msgType {
+	case messageSync:
+		return c.handleSyncMessage(msg)
+	case messageQueryAwareness:
+		c.sendAwarenessStates()
+		return nil
+	case messageControl:
+		// クライアントからの制御メッセージ（編集権の要求・解放など）
+		if ctrl, ok := decodeControlMessage(msg); ok {
+			c.handleControl(ctrl)
+		}
+		return nil
 	}
 
-	// 共有状態を更新
-	stateMutex.Lock()
-	sharedState = update
-	stateMutex.Unlock()
+	// その他のメッセージはそのまま同じroomの他クライアントにブロードキャスト
+	return c.broadcastMessage(msg)
+}
 
-	// YDocの内容を解析してログ出力（簡易版）
-	c.logYDocContent(update)
+// handleSyncMessage syncメッセージ（タイプ0）を処理
+func (c *client) handleSyncMessage(msg []byte) error {
+	subtype, payload, err := decodeSyncMessage(msg)
+	if err != nil {
+		return err
+	}
 
-	// 状態を保存（非同期）
-	go saveState()
-}
+	switch subtype {
+	case syncStep1:
+		// クライアントのstate vectorに対する差分をstep 2で返す
+		c.room.stateMutex.RLock()
+		state := c.room.sharedState
+		c.room.stateMutex.RUnlock()
 
-// broadcastMessage 全クライアントにメッセージをブロードキャスト
-func (c *client) broadcastMessage(msg []byte) error {
-	clientsMutex.RLock()
-	defer clientsMutex.RUnlock()
+		reply, err := encodeSyncStep2(state, payload)
+		if err != nil {
+			c.log.Error("error computing sync step 2", "error", err)
+			reply = encodeSyncMessage(syncStep2, state)
+		}
+		if !c.enqueue(reply) {
+			c.log.Warn("sync step 2 dropped")
+		}
+		return nil
 
-	for client := range clients {
-		if client != c {
-			select {
-			case client.send <- msg:
-			default:
-				// 送信バッファが満杯の場合はスキップ
+	case syncStep2, syncUpdate:
+		// ドキュメントの編集は操作として扱い、アイドルタイムアウトを延長する
+		// （awarenessやping/pongは開いているだけのタブからも送られるため延長しない）
+		c.touch()
+		// 閲覧のみのクライアントの更新は破棄（接続ごとに最初の1回はInfoで記録する）
+		if c.readOnly {
+			if !c.readOnlyDropped {
+				c.readOnlyDropped = true
+				c.log.Info("update from read-only client dropped")
+			} else {
+				c.log.Debug("update from read-only client dropped")
+			}
+			return nil
+		}
+		// ロック中のroomでは保持者以外の更新を破棄（ロックの状態は変わるまでに1回だけ通知する）
+		if !c.lockAllows() {
+			c.log.Debug("update dropped, room is locked")
+			if !c.lockDeniedNotified.Load() {
+				c.sendLockStatus()
 			}
+			return nil
 		}
+		// シングルライターモードでは編集権のないクライアントの更新を破棄
+		if !c.room.acquireWriter(c) {
+			c.log.Debug("update from read-only client dropped")
+			return nil
+		}
+		// レート制限を超えたupdateはまとめて後で適用する
+		return c.submitUpdate(payload)
 	}
-	return nil
+	return errMalformedMessage
 }
 
-// logYDocContent YDocの内容をログ出力とバリデーション
-// 実際の実装では、y-crdtライブラリを使用してYDocを解析
-func (c *client) logYDocContent(update []byte) {
-	// バリデーション：更新サイズのチェック
-	const maxUpdateSize = 10 * 1024 * 1024 // 10MB制限
-	if len(update) > maxUpdateSize {
-		log.Printf("WARNING: Update size exceeds limit: %d bytes (max: %d)", len(update), maxUpdateSize)
-		return
-	}
+// sendInitialSync 接続直後のクライアントに初期同期メッセージを送信
+// 状態があれば保存済みの状態（step 2）を最初に送り、続けてサーバーのstate vector（step 1）を送る
+// step 2を先に送ることで、他のクライアントがいなくてもすぐに保存済みの図が表示される
+func (c *client) sendInitialSync() {
+	c.room.stateMutex.RLock()
+	state := c.room.sharedState
+	c.room.stateMutex.RUnlock()
 
-	log.Printf("Received YDoc update: %d bytes", len(update))
+	if len(state) > 0 {
+		c.enqueue(encodeSyncMessage(syncStep2, state))
+	}
+	c.enqueue(encodeSyncStep1(state))
+}
 
-	// 簡易版：バイナリデータの一部をログ出力（デバッグ用）
-	if len(update) > 0 {
-		previewLen := min(100, len(update))
-		log.Printf("Update preview (first %d bytes): %x", previewLen, update[:previewLen])
+// enqueue 送信バッファにメッセージを追加
+// 満杯の場合はSLOW_CLIENT_GRACEの間だけ空きを待ち、それでも空かなければ
+// クライアントを切断してfalseを返す。
+// 登録された変換関数を適用してから積む。変換でメッセージが破棄された場合はtrueを返す。
+func (c *client) enqueue(msg []byte) bool {
+	if msg = c.transform(msg); msg == nil {
+		return true
+	}
+	if c.slow.Load() {
+		return false
+	}
+	select {
+	case c.send <- msg:
+		return true
+	default:
+	}
+	// 状態を送り直すまでは、空きを待たずに取りこぼす
+	if c.resync.Load() {
+		return false
+	}
 
-		// 簡易的なサイズベースの推定（実際のノード/エッジ数ではない）
-		// 1つのノードが約100-500バイト、1つのエッジが約50-200バイトと仮定
-		estimatedNodes := len(update) / 300
-		estimatedEdges := len(update) / 100
-		log.Printf("Estimated nodes: ~%d, Estimated edges: ~%d (rough estimate)", estimatedNodes, estimatedEdges)
+	timer := time.NewTimer(slowClientGrace)
+	defer timer.Stop()
+	select {
+	case c.send <- msg:
+		return true
+	case <-timer.C:
+		c.sendBufferFull()
+		return false
 	}
 }
 
-func min(a, b int) int {
-	if a < b {
-		return a
+// applyAndBroadcast updateを共有状態に適用し、他のクライアントに転送する
+func (c *client) applyAndBroadcast(update []byte) error {
+	// スキーマ違反で拒否したクライアントは切断まで何も適用しない
+	if c.rejected.Load() {
+		return nil
+	}
+	if err := c.handleUpdate(update); err != nil {
+		var invalid *flowValidationError
+		if errors.As(err, &invalid) {
+			c.rejectUpdate(invalid)
+			return nil
+		}
+		// マージできないupdateは他のクライアントにも転送しない
+		c.log.Warn("invalid update dropped", "error", err)
+		return nil
 	}
-	return b
-}
 
-// saveState 共有状態をファイルに保存
-func saveState() {
-	stateMutex.RLock()
-	data := sharedState
-	stateMutex.RUnlock()
+	// 他のクライアントには通常のupdateとして転送
+	return c.broadcastMessage(encodeSyncMessage(syncUpdate, update))
+}
 
-	if len(data) == 0 {
-		return
+// handleUpdate Yjsのupdateをroomの状態にマージして保存
+func (c *client) handleUpdate(update []byte) error {
+	if len(update) == 0 {
+		return nil
 	}
-
-	// ファイルに書き込み
-	if err := os.WriteFile(persistenceFile, data, 0644); err != nil {
-		log.Printf("Error saving state: %v", err)
-		return
+	metricUpdateBytes.Observe(float64(len(update)))
+
+	// 共有状態にマージ
+	// updateログを使う場合、ACKは状態の保存ではなくログへの追記の完了時に送る
+	log := updateLog()
+	from := c
+	if log != nil {
+		from = nil
 	}
+	state, err := c.room.applyClientUpdate(update, from)
+	if err != nil {
+		return err
+	}
+
+	c.recordAudit(update)
+	c.room.scheduleChangeWebhook()
+
+	// YDocの内容を解析してログ出力
+	c.logYDocContent(update, state)
 
-	log.Printf("State saved to %s (%d bytes)", persistenceFile, len(data))
+	// 縮退モードでは更新ごとには保存せず、自動保存での再試行に任せる
+	if c.room.degraded.Load() {
+		return nil
+	}
+	if log != nil {
+		// updateをログに追記（状態全体の書き込みは自動保存で圧縮するときに行う）
+		if err := c.room.appendUpdate(log, update); err == nil && persistAcks {
+			c.sendControl(controlMessage{Type: "persisted", Count: 1})
+		}
+		return nil
+	}
+	// 状態を保存（非同期）
+	go c.room.saveState()
+	return nil
 }
 
-// loadState 保存された状態をファイルから読み込む
-func loadState() {
-	data, err := os.ReadFile(persistenceFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			log.Println("No saved state found, starting with empty state")
-			return
+// broadcastMessage 同じroomの他クライアントにメッセージをブロードキャスト
+// 他のインスタンスに接続しているクライアントにも配信する
+func (c *client) broadcastMessage(msg []byte) error {
+	c.room.publish(msg)
+
+	c.room.clientsMutex.RLock()
+	defer c.room.clientsMutex.RUnlock()
+
+	for client := range c.room.clients {
+		if client != c {
+			// 送信が追いつかないクライアントは切断される
+			if client.enqueue(msg) {
+				metricBroadcasts.WithLabelValues(c.room.name).Inc()
+			} else {
+				metricBroadcastDropped.WithLabelValues(c.room.name).Inc()
+			}
 		}
-		log.Printf("Error loading state: %v", err)
-		return
 	}
+	return nil
+}
 
-	if len(data) == 0 {
-		log.Println("Saved state is empty")
+// logYDocContent YDocの内容をログ出力
+// マージ後の状態をyjsutilで解析し、実際のノード数・エッジ数を出力する
+// 解析のコストがかかるため、LOG_LEVEL=debugのときのみ行う。
+func (c *client) logYDocContent(update, state []byte) {
+	if !logger.Enabled(context.Background(), slog.LevelDebug) {
 		return
 	}
+	c.log.Debug("received ydoc update", "bytes", len(update), "state_bytes", len(state))
 
-	stateMutex.Lock()
-	sharedState = data
-	stateMutex.Unlock()
+	// バイナリデータの一部をログ出力（ドキュメントの内容を含むため LOG_UPDATE_PREVIEW=true のときのみ）
+	if logUpdatePreview {
+		previewLen := min(100, len(update))
+		c.log.Debug("update preview", "preview", hex.EncodeToString(update[:previewLen]))
+	}
 
-	log.Printf("State loaded from %s (%d bytes)", persistenceFile, len(data))
+	info, err := yjsutil.InspectYjsDocument(state)
+	if err != nil {
+		c.log.Debug("error inspecting ydoc", "error", err)
+		return
+	}
+	c.log.Debug("ydoc content", "nodes", info.Nodes, "edges", info.Edges, "tombstones", info.Tombstones, "conflicts", info.Conflicts)
 }
 
-// autoSave 定期的に状態を自動保存
-func autoSave() {
-	ticker := time.NewTicker(autoSaveInterval * time.Second)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		stateMutex.RLock()
-		hasState := len(sharedState) > 0
-		stateMutex.RUnlock()
-
-		if hasState {
-			saveState()
-		}
+func min(a, b int) int {
+	if a < b {
+		return a
 	}
+	return b
 }
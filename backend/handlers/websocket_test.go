@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestFirstFrameIsPersistedState(t *testing.T) {
+	store := useTempStore(t)
+	forgetRooms(t, "first-frame-test")
+	saved := mapSetUpdate(1, 0, "nodesById", "a", "x")
+	if err := store.Save(context.Background(), "first-frame-test", EncodePersisted(saved)); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := dialRoom(t, newTestServer(t), "first-frame-test")
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sync（0）のstep 2（1）
+	if len(msg) < 2 || msg[0] != 0x00 || msg[1] != 0x01 {
+		t.Fatalf("first frame = %x, want it to start with 0001", msg)
+	}
+	if _, payload, err := decodeSyncMessage(msg); err != nil || !bytes.Equal(payload, saved) {
+		t.Fatalf("first frame payload = %x, want the saved state %x", payload, saved)
+	}
+}
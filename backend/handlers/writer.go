@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"os"
+	"time"
+)
+
+// シングルライターモード
+// 対象のroomでは編集権（書き込みロック）を持つクライアントは常に1つだけで、
+// 他のクライアントは編集権が解放されるまで読み取り専用になる。
+var (
+	// シングルライターモードのroom（"*" はすべてのroom）
+	singleWriterRooms = ParseList(os.Getenv("SINGLE_WRITER_ROOMS"))
+	// 編集権を持つクライアントが操作しない場合に自動で解放するまでの時間
+	writerIdleTimeout = envDuration("WRITER_IDLE_TIMEOUT", 60*time.Second)
+)
+
+// isSingleWriterRoom roomがシングルライターモードかどうか
+func isSingleWriterRoom(name string) bool {
+	for _, r := range singleWriterRooms {
+		if r == "*" || r == name {
+			return true
+		}
+	}
+	return false
+}
+
+// acquireWriter クライアントが編集できるかどうかを判定し、可能なら編集権を与える
+// 編集権が空いているか、現在の保持者が一定時間操作していない場合は引き継ぐ。
+func (r *Room) acquireWriter(c *client) bool {
+	if !r.singleWriter {
+		return true
+	}
+
+	r.writerMutex.Lock()
+	now := time.Now()
+	if r.writer == c {
+		r.writerLastActive = now
+		r.writerMutex.Unlock()
+		return true
+	}
+	if r.writer != nil && now.Sub(r.writerLastActive) < writerIdleTimeout {
+		r.writerMutex.Unlock()
+		// 編集権が変わるまでに1回だけ通知する
+		if !c.writerDeniedNotified.Swap(true) {
+			c.sendControl(controlMessage{Type: "read-only", Message: "Another client holds the write lock"})
+		}
+		return false
+	}
+	r.writer = c
+	r.writerLastActive = now
+	r.writerMutex.Unlock()
+
+	c.log.Info("write lock granted")
+	r.notifyWriterChanged(c)
+	return true
+}
+
+// releaseWriter クライアントが編集権を持っていれば解放する
+func (r *Room) releaseWriter(c *client) {
+	if !r.singleWriter {
+		return
+	}
+
+	r.writerMutex.Lock()
+	if r.writer != c {
+		r.writerMutex.Unlock()
+		return
+	}
+	r.writer = nil
+	r.writerMutex.Unlock()
+
+	logger.Info("write lock released", "room", r.name)
+	r.notifyWriterChanged(nil)
+}
+
+// notifyWriterChanged 編集権の変更をroomの全クライアントに通知
+// 読み取り専用になったクライアントには通知済みとして、編集を破棄するたびに送り直さない。
+func (r *Room) notifyWriterChanged(writer *client) {
+	r.clientsMutex.RLock()
+	defer r.clientsMutex.RUnlock()
+
+	for c := range r.clients {
+		c.writerDeniedNotified.Store(writer != nil && c != writer)
+		switch {
+		case writer == nil:
+			c.sendControl(controlMessage{Type: "writer-released"})
+		case c == writer:
+			c.sendControl(controlMessage{Type: "writer-granted"})
+		default:
+			c.sendControl(controlMessage{Type: "read-only", Message: "Another client holds the write lock"})
+		}
+	}
+}
+
+// handleWriterControl クライアントからの編集権の要求・解放を処理
+func (c *client) handleWriterControl(msg controlMessage) {
+	switch msg.Type {
+	case "request-writer":
+		c.room.acquireWriter(c)
+	case "release-writer":
+		c.room.releaseWriter(c)
+	}
+}
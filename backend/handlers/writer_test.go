@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReadOnlyNoticeOncePerWriterChange(t *testing.T) {
+	room := newTestRoom("writer-notice")
+	room.singleWriter = true
+	a, b := newTestClient(room), newTestClient(room)
+
+	if !room.acquireWriter(a) {
+		t.Fatal("first client did not get the write lock")
+	}
+	if got := controlTypes(b); !reflect.DeepEqual(got, []string{"read-only"}) {
+		t.Fatalf("notices after the writer changed = %v", got)
+	}
+
+	// 編集権が変わるまでは、破棄するたびに通知しない
+	for i := 0; i < 3; i++ {
+		if room.acquireWriter(b) {
+			t.Fatal("second client got the write lock while it was held")
+		}
+	}
+	if got := controlTypes(b); len(got) != 0 {
+		t.Errorf("notices for rejected updates = %v, want none", got)
+	}
+
+	// 解放後に別のクライアントが取得すると、改めて1回だけ通知する
+	room.releaseWriter(a)
+	c := newTestClient(room)
+	room.acquireWriter(c)
+	for i := 0; i < 3; i++ {
+		room.acquireWriter(b)
+	}
+	if got := controlTypes(b); !reflect.DeepEqual(got, []string{"writer-released", "read-only"}) {
+		t.Errorf("notices after the writer changed again = %v", got)
+	}
+}
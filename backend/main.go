@@ -1,28 +1,130 @@
 package main
 
 import (
-	"log"
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"reactflow-yjs/backend/handlers"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/acme/autocert"
+
+	// SQLの永続化バックエンドのドライバー
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
 )
 
 func main() {
+	// 読み込めなかった環境変数があれば、デフォルト値で動かさずに終了する
+	if err := handlers.ConfigError(); err != nil {
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	timeout, err := shutdownTimeout()
+	if err != nil {
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(1)
+	}
+
+	// 永続化バックエンドの選択
+	store, err := newStateStore()
+	if err != nil {
+		slog.Error("invalid store configuration", "error", err)
+		os.Exit(1)
+	}
+	handlers.SetStateStore(store)
+
+	// サブコマンド（backup / restore）はサーバーを起動せずに実行して終了する
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
+	// TLSの設定（証明書ファイルまたはLet's Encrypt）
+	tlsConfig, err := newTLSSettings()
+	if err != nil {
+		slog.Error("invalid TLS configuration", "error", err)
+		os.Exit(1)
+	}
+
+	// 複数インスタンスで動かす場合のメッセージの中継
+	if err := setupBroker(); err != nil {
+		slog.Error("invalid pub/sub configuration", "error", err)
+		os.Exit(1)
+	}
+
 	e := echo.New()
 
+	// Echo自身の起動メッセージは出さず、ログはすべてslog（JSON）で出力する
+	e.HideBanner = true
+	e.HidePort = true
+
 	// ミドルウェア設定
-	e.Use(middleware.Logger())
+	e.Use(handlers.AccessLog())
 	e.Use(middleware.Recover())
-	e.Use(middleware.CORS())
+	corsConfig, err := newCORSConfig()
+	if err != nil {
+		slog.Error("invalid CORS configuration", "error", err)
+		os.Exit(1)
+	}
+	e.Use(middleware.CORSWithConfig(corsConfig))
 
 	// 静的ファイルの配信（開発用）
 	e.Static("/", "../frontend/dist")
 
 	// WebSocketエンドポイント（room名付き）
 	e.GET("/ws/:room", handlers.HandleWebSocket)
+	// サブドキュメント（ページ）ごとのWebSocketエンドポイント
+	e.GET("/ws/:room/:subdoc", handlers.HandleWebSocket)
+
+	// state vectorに対する差分（オフラインだったクライアントの追いつき・ポーリング用）
+	e.POST("/api/rooms/:room/diff", handlers.HandleDiff)
+
+	// roomのフロー図（ノードとエッジのJSON）
+	e.GET("/api/rooms/:room/flow", handlers.HandleGetFlow)
+	// roomのフロー図のエクスポート（Mermaid / GraphML / DOT）
+	e.GET("/api/rooms/:room/export", handlers.HandleExportFlow)
+
+	// roomのスナップショット（一覧・作成・復元）
+	e.GET("/api/rooms/:room/snapshots", handlers.HandleListSnapshots)
+	e.POST("/api/rooms/:room/snapshots", handlers.HandleCreateSnapshot)
+	e.POST("/api/rooms/:room/snapshots/:ts/restore", handlers.HandleRestoreSnapshot)
+
+	// roomの監査ログ（AUDIT_LOG）
+	e.GET("/api/rooms/:room/history", handlers.HandleRoomHistory)
+
+	// roomのロック（プレゼンテーションモード）
+	e.GET("/api/rooms/:room/lock", handlers.HandleGetRoomLock)
+	e.POST("/api/rooms/:room/lock", handlers.HandleLockRoom)
+	e.DELETE("/api/rooms/:room/lock", handlers.HandleUnlockRoom)
+
+	// roomのドキュメントの統計情報（ノード数、削除済みの要素数、直近のupdate数など）
+	e.GET("/api/rooms/:room/stats", handlers.HandleRoomStats)
+
+	// オートスケーラー向けの接続数
+	e.GET("/api/scale-metric", handlers.HandleScaleMetric)
+
+	// ヘルスチェック（Kubernetesのliveness / readiness probe用）
+	e.GET("/healthz", handlers.HandleHealthz)
+	e.GET("/readyz", handlers.HandleReadyz)
+
+	// Prometheusのメトリクス（管理APIと同じADMIN_API_KEYで保護）
+	e.GET("/metrics", handlers.MetricsHandler(), handlers.AdminAuth())
+
+	// 管理API（ADMIN_API_KEYで保護）
+	handlers.RegisterAdminRoutes(e.Group("/api/v1"))
 
 	// サーバー起動
 	port := os.Getenv("PORT")
@@ -30,9 +132,331 @@ func main() {
 		port = "8080"
 	}
 
-	log.Printf("Server starting on port %s", port)
-	if err := e.Start(":" + port); err != nil {
-		log.Fatal(err)
+	// SIGINT/SIGTERMで全roomの状態を保存してから終了する
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		slog.Info("server starting", "port", port, "tls", tlsConfig.mode())
+		if err := tlsConfig.start(e, ":"+port); err != nil && err != http.ErrServerClosed {
+			slog.Error("server error", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	<-ctx.Done()
+	slog.Info("shutting down server")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// 時間内に終わらない場合は強制終了
+	time.AfterFunc(timeout+time.Second, func() {
+		slog.Error("shutdown timed out, forcing exit")
+		os.Exit(1)
+	})
+
+	if err := handlers.Shutdown(shutdownCtx); err != nil {
+		slog.Error("error flushing rooms", "error", err)
+	}
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		slog.Error("error shutting down server", "error", err)
+	}
+	slog.Info("server stopped")
+}
+
+// runCommand サブコマンドを実行し、終了コードを返す
+//
+//	backend backup --out dump.tar.gz   全roomの状態とスナップショットを書き出す
+//	backend restore --in dump.tar.gz   バックアップから全roomを戻す
+//
+// 永続化バックエンドはサーバーと同じ環境変数で指定する。
+// サーバーの実行中に使うと、メモリ上のroomの状態と食い違うため、実行中は管理APIを使う。
+func runCommand(name string, args []string) int {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	var path string
+	switch name {
+	case "backup":
+		fs.StringVar(&path, "out", "", "書き出すバックアップファイル（tar.gz）")
+	case "restore":
+		fs.StringVar(&path, "in", "", "読み込むバックアップファイル（tar.gz）")
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s (available: backup, restore)\n", name)
+		return 2
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if path == "" || fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var (
+		result handlers.BackupResult
+		err    error
+	)
+	if name == "backup" {
+		result, err = writeBackupFile(ctx, path)
+	} else {
+		result, err = restoreBackupFile(ctx, path)
+	}
+	if err != nil {
+		slog.Error(name+" failed", "path", path, "error", err)
+		return 1
+	}
+	slog.Info(name+" completed", "path", path, "rooms", result.Rooms, "snapshots", result.Snapshots)
+	return 0
+}
+
+// writeBackupFile バックアップをファイルに書き出す（失敗した場合は書きかけのファイルを残さない）
+func writeBackupFile(ctx context.Context, path string) (handlers.BackupResult, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return handlers.BackupResult{}, err
+	}
+	result, err := handlers.WriteBackup(ctx, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return result, err
+}
+
+// restoreBackupFile ファイルからバックアップを戻す
+func restoreBackupFile(ctx context.Context, path string) (handlers.BackupResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return handlers.BackupResult{}, err
+	}
+	defer f.Close()
+	return handlers.RestoreBackup(ctx, f)
+}
+
+// shutdownTimeout 終了処理（状態の保存と切断）の最大時間
+// 環境変数 SHUTDOWN_TIMEOUT_SECONDS（デフォルト10秒）
+func shutdownTimeout() (time.Duration, error) {
+	v := os.Getenv("SHUTDOWN_TIMEOUT_SECONDS")
+	if v == "" {
+		return 10 * time.Second, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid SHUTDOWN_TIMEOUT_SECONDS %q: must be a positive number of seconds", v)
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+// tlsSettings TLSの設定
+// TLS_CERT_FILE / TLS_KEY_FILE で証明書ファイルを指定するか、TLS_AUTOCERT_DOMAINS（カンマ区切り）で
+// Let's Encryptから証明書を自動で取得する。どちらも未設定の場合はHTTPで起動する（リバースプロキシの背後で使う）。
+type tlsSettings struct {
+	certFile, keyFile string
+	// Let's Encryptで証明書を取得するドメインと、取得した証明書の保存先、連絡先のメールアドレス
+	autocertDomains  []string
+	autocertCacheDir string
+	autocertEmail    string
+}
+
+// newTLSSettings 環境変数からTLSの設定を作成
+func newTLSSettings() (tlsSettings, error) {
+	s := tlsSettings{
+		certFile:         os.Getenv("TLS_CERT_FILE"),
+		keyFile:          os.Getenv("TLS_KEY_FILE"),
+		autocertDomains:  handlers.ParseList(os.Getenv("TLS_AUTOCERT_DOMAINS")),
+		autocertCacheDir: os.Getenv("TLS_AUTOCERT_CACHE_DIR"),
+		autocertEmail:    os.Getenv("TLS_AUTOCERT_EMAIL"),
+	}
+	if (s.certFile == "") != (s.keyFile == "") {
+		return s, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if s.certFile != "" && len(s.autocertDomains) > 0 {
+		return s, fmt.Errorf("TLS_CERT_FILE and TLS_AUTOCERT_DOMAINS cannot be used together")
+	}
+	if s.autocertCacheDir == "" {
+		s.autocertCacheDir = "autocert-cache"
+	}
+	return s, nil
+}
+
+// mode ログに出すTLSの方式（none|file|autocert）
+func (s tlsSettings) mode() string {
+	switch {
+	case len(s.autocertDomains) > 0:
+		return "autocert"
+	case s.certFile != "":
+		return "file"
+	default:
+		return "none"
+	}
+}
+
+// start 設定に応じてHTTPまたはHTTPSでサーバーを起動する
+// Let's Encryptの検証にはTLS-ALPN-01を使うため、443番ポートで外部から接続できる必要がある。
+func (s tlsSettings) start(e *echo.Echo, addr string) error {
+	switch s.mode() {
+	case "autocert":
+		e.AutoTLSManager.Prompt = autocert.AcceptTOS
+		e.AutoTLSManager.HostPolicy = autocert.HostWhitelist(s.autocertDomains...)
+		e.AutoTLSManager.Cache = autocert.DirCache(s.autocertCacheDir)
+		e.AutoTLSManager.Email = s.autocertEmail
+		return e.StartAutoTLS(addr)
+	case "file":
+		return e.StartTLS(addr, s.certFile, s.keyFile)
+	default:
+		return e.Start(addr)
+	}
+}
+
+// newCORSConfig 環境変数からCORSの設定を作成
+// CORS_ALLOWED_ORIGINS（カンマ区切り）が未設定の場合、すべてのオリジンを許可するのは
+// GO_ENV=development のときのみで、それ以外は起動しない。
+func newCORSConfig() (middleware.CORSConfig, error) {
+	config := middleware.CORSConfig{
+		// WebSocketはプリフライトを行わず（Originは接続時に検証する）、
+		// /metricsはブラウザから参照しないためCORSの対象外
+		Skipper: func(c echo.Context) bool {
+			return c.Path() == "/ws/:room" || c.Path() == "/ws/:room/:subdoc" || c.Path() == "/metrics"
+		},
+		AllowOrigins: handlers.ParseList(os.Getenv("CORS_ALLOWED_ORIGINS")),
+		AllowMethods: handlers.ParseList(os.Getenv("CORS_ALLOW_METHODS")),
+		AllowHeaders: handlers.ParseList(os.Getenv("CORS_ALLOW_HEADERS")),
+	}
+	if len(config.AllowOrigins) == 0 {
+		if os.Getenv("GO_ENV") != "development" {
+			return config, fmt.Errorf("CORS_ALLOWED_ORIGINS is not set (set GO_ENV=development to allow all origins during development)")
+		}
+		slog.Warn("CORS_ALLOWED_ORIGINS is not set, allowing all origins (GO_ENV=development)")
+		config.AllowOrigins = []string{"*"}
+	}
+	if len(config.AllowMethods) == 0 {
+		config.AllowMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodDelete}
+	}
+	if len(config.AllowHeaders) == 0 {
+		config.AllowHeaders = []string{echo.HeaderContentType, echo.HeaderAuthorization, "X-API-Key"}
+	}
+	return config, nil
+}
+
+// newStateStore 環境変数 STORE_BACKEND（file|redis|sqlite|postgres|s3）に応じた永続化バックエンドを作成
+// STORE_BACKENDが未設定の場合は STORE も参照する
+func newStateStore() (handlers.StateStore, error) {
+	backend := os.Getenv("STORE_BACKEND")
+	if backend == "" {
+		backend = os.Getenv("STORE")
+	}
+	switch backend {
+	case "", "file":
+		dir := os.Getenv("PERSIST_DIR")
+		if dir == "" {
+			dir = "."
+		}
+		return handlers.NewFileStore(dir), nil
+	case "redis":
+		opts, err := redisOptions()
+		if err != nil {
+			return nil, err
+		}
+		var ttl time.Duration
+		if v := os.Getenv("REDIS_STATE_TTL"); v != "" {
+			if ttl, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("invalid REDIS_STATE_TTL: %w", err)
+			}
+		}
+		return handlers.NewRedisStore(redis.NewClient(opts), ttl), nil
+	case "sqlite":
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "ydoc_states.db"
+		}
+		db, err := sql.Open("sqlite", path)
+		if err != nil {
+			return nil, fmt.Errorf("opening SQLite database: %w", err)
+		}
+		// SQLiteは書き込みを1つずつしか行えないため、接続を1つにしてロック待ちのエラーを防ぐ
+		db.SetMaxOpenConns(1)
+		return newSQLStore(db, "sqlite")
+	case "postgres":
+		url := os.Getenv("DATABASE_URL")
+		if url == "" {
+			return nil, fmt.Errorf("DATABASE_URL is required for the postgres store")
+		}
+		db, err := sql.Open("pgx", url)
+		if err != nil {
+			return nil, fmt.Errorf("opening PostgreSQL database: %w", err)
+		}
+		return newSQLStore(db, "pgx")
+	case "s3":
+		return newS3Store()
+	default:
+		return nil, fmt.Errorf("unknown STORE_BACKEND: %s", backend)
+	}
+}
+
+// newSQLStore テーブルを準備してSQLStoreを作成
+func newSQLStore(db *sql.DB, driver string) (handlers.StateStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return handlers.NewSQLStore(ctx, db, driver)
+}
+
+// newS3Store 環境変数からS3互換ストレージのクライアントを作成
+// 認証情報は S3_ACCESS_KEY_ID / S3_SECRET_ACCESS_KEY、未設定の場合は AWS_ACCESS_KEY_ID などのAWSの環境変数を使う
+func newS3Store() (handlers.StateStore, error) {
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return nil, fmt.Errorf("S3_BUCKET is required for the s3 store")
+	}
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "s3.amazonaws.com"
 	}
+	creds := credentials.NewEnvAWS()
+	if id := os.Getenv("S3_ACCESS_KEY_ID"); id != "" {
+		creds = credentials.NewStaticV4(id, os.Getenv("S3_SECRET_ACCESS_KEY"), "")
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: os.Getenv("S3_USE_SSL") != "false",
+		Region: os.Getenv("S3_REGION"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 configuration: %w", err)
+	}
+	return handlers.NewS3Store(client, bucket, os.Getenv("S3_PREFIX")), nil
 }
 
+// redisOptions 環境変数 REDIS_URL（デフォルト redis://localhost:6379/0）からRedisの接続設定を作成
+func redisOptions() (*redis.Options, error) {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		url = "redis://localhost:6379/0"
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+	return opts, nil
+}
+
+// setupBroker 環境変数 PUBSUB_BACKEND（redis）に応じてインスタンス間の配信を設定
+// 未設定の場合は単一インスタンスとして動作する
+func setupBroker() error {
+	switch backend := os.Getenv("PUBSUB_BACKEND"); backend {
+	case "":
+		return nil
+	case "redis":
+		opts, err := redisOptions()
+		if err != nil {
+			return err
+		}
+		handlers.SetBroker(handlers.NewRedisBroker(redis.NewClient(opts)))
+		return nil
+	default:
+		return fmt.Errorf("unknown PUBSUB_BACKEND: %s", backend)
+	}
+}
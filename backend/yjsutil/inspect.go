@@ -0,0 +1,441 @@
+package yjsutil
+
+import (
+	"encoding/json"
+	"sort"
+	"unicode/utf16"
+)
+
+// Yjsの型参照番号（ContentType）
+const (
+	typeArray       = 0
+	typeMap         = 1
+	typeText        = 2
+	typeXMLElement  = 3
+	typeXMLFragment = 4
+	typeXMLHook     = 5
+	typeXMLText     = 6
+)
+
+// フロントエンド（FlowEditor.tsx）が使用するルート型の名前
+const (
+	NodesMapName   = "nodesById"
+	EdgesMapName   = "edgesById"
+	LegacyNodesKey = "nodes"
+	LegacyEdgesKey = "edges"
+)
+
+// parentRef Itemの親（ルート型の名前、またはネストした型のItem ID）
+type parentRef struct {
+	root   string
+	isRoot bool
+	item   ID
+}
+
+// Document updateをデコードし、ルート型の内容を読み取れるようにしたもの
+// 完全なYjsの統合処理は行わないため、同時挿入された配列要素の順序は近似となる。
+type Document struct {
+	u        *update
+	parents  map[*block]*parentRef
+	children map[parentRef][]*block
+}
+
+// DecodeDocument v1形式のupdate（またはマージ済みの状態）をデコードする
+func DecodeDocument(data []byte) (*Document, error) {
+	u, err := decodeUpdate(data)
+	if err != nil {
+		return nil, err
+	}
+	doc := &Document{
+		u:        u,
+		parents:  make(map[*block]*parentRef),
+		children: make(map[parentRef][]*block),
+	}
+	for _, blocks := range u.structs {
+		for _, b := range blocks {
+			if b.kind != kindItem {
+				continue
+			}
+			if p := doc.resolveParent(b); p != nil {
+				doc.children[*p] = append(doc.children[*p], b)
+			}
+		}
+	}
+	return doc, nil
+}
+
+// find IDを含むstructを探す
+func (doc *Document) find(id ID) *block {
+	blocks := doc.u.structs[id.Client]
+	i := sort.Search(len(blocks), func(i int) bool { return blocks[i].end() > id.Clock })
+	if i < len(blocks) && blocks[i].id.Clock <= id.Clock {
+		return blocks[i]
+	}
+	return nil
+}
+
+// resolveParent Itemの親を求める
+// origin/rightOriginを持つItemは親情報がエンコードされないため、隣接Itemから引き継ぐ。
+func (doc *Document) resolveParent(b *block) *parentRef {
+	var chain []*block
+	var p *parentRef
+	for cur := b; cur != nil && cur.kind == kindItem; {
+		if cached, ok := doc.parents[cur]; ok {
+			p = cached
+			break
+		}
+		if cur.parentKey != nil || cur.parentID != nil {
+			chain = append(chain, cur)
+			if cur.parentKey != nil {
+				p = &parentRef{root: *cur.parentKey, isRoot: true}
+			} else {
+				p = &parentRef{item: *cur.parentID}
+			}
+			break
+		}
+		chain = append(chain, cur)
+		if len(chain) > 1<<20 {
+			break
+		}
+		next := cur.origin
+		if next == nil {
+			next = cur.rightOrigin
+		}
+		if next == nil {
+			break
+		}
+		neighbor := doc.find(*next)
+		if neighbor != nil && neighbor.kind == kindItem && cur.parentSub == nil {
+			cur.parentSub = neighbor.parentSub
+		}
+		cur = neighbor
+	}
+	for _, c := range chain {
+		doc.parents[c] = p
+	}
+	// parentSubは起点側から伝播させる
+	for i := len(chain) - 2; i >= 0; i-- {
+		if chain[i].parentSub == nil {
+			chain[i].parentSub = chain[i+1].parentSub
+		}
+	}
+	return p
+}
+
+// deleted IDの要素が削除済みかどうか
+func (doc *Document) deleted(b *block, offset uint64) bool {
+	if _, ok := b.content.(contentDeleted); ok {
+		return true
+	}
+	return doc.u.ds.isDeleted(ID{Client: b.id.Client, Clock: b.id.Clock + offset})
+}
+
+// Map ルートのY.Mapの内容を返す
+func (doc *Document) Map(name string) map[string]any {
+	return doc.mapValue(parentRef{root: name, isRoot: true})
+}
+
+// Array ルートのY.Arrayの内容を返す
+func (doc *Document) Array(name string) []any {
+	return doc.arrayValue(parentRef{root: name, isRoot: true})
+}
+
+// Has ルート型が存在するかどうか
+func (doc *Document) Has(name string) bool {
+	return len(doc.children[parentRef{root: name, isRoot: true}]) > 0
+}
+
+// mapValue Y.Mapとして内容を組み立てる
+func (doc *Document) mapValue(p parentRef) map[string]any {
+	result := make(map[string]any)
+	for key, winner := range doc.mapItems(p) {
+		if doc.deleted(winner, winner.length-1) {
+			continue
+		}
+		values := doc.values(winner, winner.length-1)
+		if len(values) > 0 {
+			result[key] = values[len(values)-1]
+		}
+	}
+	return result
+}
+
+// mapItems Y.Mapのキーごとに現在の値を持つItemを返す（削除済みのItemを含む）
+// 同じキーに複数のItemがある場合は、他のItemのoriginになっていない（右端の）ものを採用する。
+func (doc *Document) mapItems(p parentRef) map[string]*block {
+	byKey := make(map[string][]*block)
+	for _, b := range doc.children[p] {
+		if b.parentSub != nil {
+			byKey[*b.parentSub] = append(byKey[*b.parentSub], b)
+		}
+	}
+
+	result := make(map[string]*block)
+	for key, items := range byKey {
+		var winner *block
+		for _, b := range mapHeads(items) {
+			// 同時に書き込まれた場合はクライアントIDの大きい方が右側になる
+			if winner == nil || b.id.Client > winner.id.Client ||
+				(b.id.Client == winner.id.Client && b.id.Clock > winner.id.Clock) {
+				winner = b
+			}
+		}
+		if winner != nil {
+			result[key] = winner
+		}
+	}
+	return result
+}
+
+// mapHeads 同じキーのItemのうち、他のItemのoriginになっていないもの
+// 複数ある場合は、互いの書き込みを知らずに同時に書き込まれた（競合した）ことを表す。
+func mapHeads(items []*block) []*block {
+	superseded := make(map[ID]bool)
+	for _, b := range items {
+		if b.origin != nil {
+			superseded[*b.origin] = true
+		}
+	}
+	var heads []*block
+	for _, b := range items {
+		if !superseded[ID{Client: b.id.Client, Clock: b.end() - 1}] {
+			heads = append(heads, b)
+		}
+	}
+	return heads
+}
+
+// conflicts これまでに同時に書き込まれた（競合した）Y.Mapのキーの数（ネストしたY.Mapを含む）
+// 後から上書きしても競合した書き込みは状態に残るため、履歴上の競合の数となる。
+func (doc *Document) conflicts() int {
+	n := 0
+	for _, blocks := range doc.children {
+		byKey := make(map[string][]*block)
+		for _, b := range blocks {
+			if b.parentSub != nil {
+				byKey[*b.parentSub] = append(byKey[*b.parentSub], b)
+			}
+		}
+		for _, items := range byKey {
+			if len(mapHeads(items)) > 1 {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// rootMaps Y.Mapとして使われているルート型の名前
+func (doc *Document) rootMaps() []string {
+	var names []string
+	for p, blocks := range doc.children {
+		if !p.isRoot {
+			continue
+		}
+		for _, b := range blocks {
+			if b.parentSub != nil {
+				names = append(names, p.root)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// arrayValue Y.Array（シーケンス型）として内容を組み立てる
+func (doc *Document) arrayValue(p parentRef) []any {
+	var result []any
+	doc.walkSequence(p, func(b *block, offset uint64) {
+		result = append(result, doc.values(b, offset)...)
+	})
+	return result
+}
+
+// textValue Y.Textとして文字列を組み立てる
+func (doc *Document) textValue(p parentRef) string {
+	var units []uint16
+	doc.walkSequence(p, func(b *block, offset uint64) {
+		if s, ok := b.content.(contentString); ok {
+			units = append(units, s.units[offset])
+		}
+	})
+	return string(utf16.Decode(units))
+}
+
+// walkSequence シーケンス型の削除されていない要素を順に訪問する
+// originの木を深さ優先でたどる。同じoriginを持つ要素はクライアントIDの昇順、
+// 同一クライアント内では新しい挿入を先に並べる。
+func (doc *Document) walkSequence(p parentRef, visit func(b *block, offset uint64)) {
+	items := make([]*block, 0)
+	inParent := make(map[*block]bool)
+	for _, b := range doc.children[p] {
+		if b.parentSub == nil {
+			items = append(items, b)
+			inParent[b] = true
+		}
+	}
+
+	after := make(map[ID][]*block)
+	var roots []*block
+	for _, b := range items {
+		if b.origin != nil {
+			if o := doc.find(*b.origin); o != nil && inParent[o] {
+				after[*b.origin] = append(after[*b.origin], b)
+				continue
+			}
+		}
+		roots = append(roots, b)
+	}
+	order := func(list []*block) {
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].id.Client != list[j].id.Client {
+				return list[i].id.Client < list[j].id.Client
+			}
+			return list[i].id.Clock > list[j].id.Clock
+		})
+	}
+	order(roots)
+	for _, list := range after {
+		order(list)
+	}
+
+	visited := make(map[*block]bool)
+	var walk func(b *block)
+	walk = func(b *block) {
+		if visited[b] {
+			return
+		}
+		visited[b] = true
+		for i := uint64(0); i < b.length; i++ {
+			if !doc.deleted(b, i) {
+				visit(b, i)
+			}
+			for _, child := range after[ID{Client: b.id.Client, Clock: b.id.Clock + i}] {
+				walk(child)
+			}
+		}
+	}
+	for _, b := range roots {
+		walk(b)
+	}
+}
+
+// values Itemのoffset番目の要素の値を返す（値を持たないcontentの場合は空）
+func (doc *Document) values(b *block, offset uint64) []any {
+	switch c := b.content.(type) {
+	case contentAny:
+		v, err := newDecoder(c.vals[offset]).readAny()
+		if err != nil {
+			return nil
+		}
+		return []any{v}
+	case contentJSON:
+		if c.vals[offset] == "undefined" {
+			return []any{Undefined{}}
+		}
+		var v any
+		if err := json.Unmarshal([]byte(c.vals[offset]), &v); err != nil {
+			return nil
+		}
+		return []any{v}
+	case contentString:
+		return []any{string(utf16.Decode(c.units[offset : offset+1]))}
+	case contentRaw:
+		d := newDecoder(c.raw)
+		switch c.r {
+		case refBinary:
+			v, err := d.readVarUint8Array()
+			if err != nil {
+				return nil
+			}
+			return []any{append([]byte(nil), v...)}
+		case refType:
+			typeRef, err := d.readVarUint()
+			if err != nil {
+				return nil
+			}
+			p := parentRef{item: b.id}
+			switch typeRef {
+			case typeMap:
+				return []any{doc.mapValue(p)}
+			case typeText, typeXMLText:
+				return []any{doc.textValue(p)}
+			default:
+				return []any{doc.arrayValue(p)}
+			}
+		case refDoc:
+			guid, err := d.readVarString()
+			if err != nil {
+				return nil
+			}
+			return []any{map[string]any{"guid": guid}}
+		}
+	}
+	return nil
+}
+
+// Subdocs ドキュメントに含まれる（削除されていない）サブドキュメントのGUIDをソートして返す
+// サブドキュメントの内容は親のupdateには含まれず、GUIDとオプションのみが記録される。
+func (doc *Document) Subdocs() []string {
+	seen := make(map[string]bool)
+	var guids []string
+	for _, blocks := range doc.u.structs {
+		for _, b := range blocks {
+			c, ok := b.content.(contentRaw)
+			if !ok || c.r != refDoc || doc.deleted(b, 0) {
+				continue
+			}
+			guid, err := newDecoder(c.raw).readVarString()
+			if err != nil || seen[guid] {
+				continue
+			}
+			seen[guid] = true
+			guids = append(guids, guid)
+		}
+	}
+	sort.Strings(guids)
+	return guids
+}
+
+// DocumentInfo ドキュメントの概要
+type DocumentInfo struct {
+	Nodes        int // ノード数
+	Edges        int // エッジ数
+	Clients      int // 編集したクライアント数
+	Structs      int // struct数
+	Tombstones   int // 削除済みの要素数
+	MissingRange int // 欠けている範囲（Skip）の数
+	Conflicts    int // これまでに同時に書き込まれたY.Mapのキーの数
+}
+
+// InspectYjsDocument updateをデコードしてノード数・エッジ数などを数える
+// nodesById / edgesById（Y.Map）と旧形式の nodes / edges（Y.Array）の両方を数える。
+func InspectYjsDocument(data []byte) (*DocumentInfo, error) {
+	doc, err := DecodeDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	info := &DocumentInfo{
+		Nodes:     len(doc.Map(NodesMapName)) + len(doc.Array(LegacyNodesKey)),
+		Edges:     len(doc.Map(EdgesMapName)) + len(doc.Array(LegacyEdgesKey)),
+		Clients:   len(doc.u.structs),
+		Conflicts: doc.conflicts(),
+	}
+	for _, blocks := range doc.u.structs {
+		for _, b := range blocks {
+			info.Structs++
+			switch b.kind {
+			case kindSkip:
+				info.MissingRange++
+			case kindItem:
+				for i := uint64(0); i < b.length; i++ {
+					if doc.deleted(b, i) {
+						info.Tombstones++
+					}
+				}
+			}
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,336 @@
+package yjsutil
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"unicode/utf8"
+)
+
+// ErrUnexpectedEnd データが途中で終わっている場合のエラー
+var ErrUnexpectedEnd = errors.New("yjsutil: unexpected end of data")
+
+// Undefined JavaScriptのundefinedを表す値
+type Undefined struct{}
+
+// BigInt64 JavaScriptのBigInt（64bit）を表す値
+type BigInt64 int64
+
+// decoder lib0形式のバイナリデコーダー
+type decoder struct {
+	buf []byte
+	pos int
+}
+
+func newDecoder(buf []byte) *decoder {
+	return &decoder{buf: buf}
+}
+
+func (d *decoder) hasContent() bool {
+	return d.pos < len(d.buf)
+}
+
+func (d *decoder) readUint8() (byte, error) {
+	if d.pos >= len(d.buf) {
+		return 0, ErrUnexpectedEnd
+	}
+	b := d.buf[d.pos]
+	d.pos++
+	return b, nil
+}
+
+func (d *decoder) readBytes(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.buf) {
+		return nil, ErrUnexpectedEnd
+	}
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// readVarUint 可変長の符号なし整数を読み込む
+func (d *decoder) readVarUint() (uint64, error) {
+	var num uint64
+	var shift uint
+	for {
+		b, err := d.readUint8()
+		if err != nil {
+			return 0, err
+		}
+		num |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return num, nil
+		}
+		shift += 7
+		if shift > 63 {
+			return 0, errors.New("yjsutil: varuint overflow")
+		}
+	}
+}
+
+// readVarInt 可変長の符号付き整数を読み込む（先頭バイトの0x40が符号ビット）
+func (d *decoder) readVarInt() (int64, error) {
+	b, err := d.readUint8()
+	if err != nil {
+		return 0, err
+	}
+	num := uint64(b & 0x3f)
+	negative := b&0x40 > 0
+	shift := uint(6)
+	for b&0x80 > 0 {
+		if b, err = d.readUint8(); err != nil {
+			return 0, err
+		}
+		num |= uint64(b&0x7f) << shift
+		shift += 7
+		if shift > 63 {
+			return 0, errors.New("yjsutil: varint overflow")
+		}
+	}
+	if negative {
+		return -int64(num), nil
+	}
+	return int64(num), nil
+}
+
+func (d *decoder) readVarUint8Array() ([]byte, error) {
+	n, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(d.buf)) {
+		return nil, ErrUnexpectedEnd
+	}
+	return d.readBytes(int(n))
+}
+
+func (d *decoder) readVarString() (string, error) {
+	b, err := d.readVarUint8Array()
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// readAny lib0のany形式の値を読み込む
+func (d *decoder) readAny() (any, error) {
+	t, err := d.readUint8()
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case 127:
+		return Undefined{}, nil
+	case 126:
+		return nil, nil
+	case 125:
+		return d.readVarInt()
+	case 124:
+		b, err := d.readBytes(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case 123:
+		b, err := d.readBytes(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case 122:
+		b, err := d.readBytes(8)
+		if err != nil {
+			return nil, err
+		}
+		return BigInt64(binary.BigEndian.Uint64(b)), nil
+	case 121:
+		return false, nil
+	case 120:
+		return true, nil
+	case 119:
+		return d.readVarString()
+	case 118:
+		n, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		obj := make(map[string]any)
+		for i := uint64(0); i < n; i++ {
+			key, err := d.readVarString()
+			if err != nil {
+				return nil, err
+			}
+			if obj[key], err = d.readAny(); err != nil {
+				return nil, err
+			}
+		}
+		return obj, nil
+	case 117:
+		n, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(len(d.buf)) {
+			return nil, ErrUnexpectedEnd
+		}
+		arr := make([]any, 0, n)
+		for i := uint64(0); i < n; i++ {
+			v, err := d.readAny()
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	case 116:
+		b, err := d.readVarUint8Array()
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), b...), nil
+	default:
+		return Undefined{}, nil
+	}
+}
+
+// skipAny any形式の値を読み飛ばし、そのエンコード済みバイト列を返す
+func (d *decoder) skipAny() ([]byte, error) {
+	start := d.pos
+	if _, err := d.readAny(); err != nil {
+		return nil, err
+	}
+	return d.buf[start:d.pos], nil
+}
+
+// encoder lib0形式のバイナリエンコーダー
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) bytes() []byte {
+	return e.buf
+}
+
+func (e *encoder) writeUint8(b byte) {
+	e.buf = append(e.buf, b)
+}
+
+func (e *encoder) writeVarUint(num uint64) {
+	for num > 0x7f {
+		e.buf = append(e.buf, byte(0x80|(num&0x7f)))
+		num >>= 7
+	}
+	e.buf = append(e.buf, byte(num))
+}
+
+func (e *encoder) writeVarUint8Array(b []byte) {
+	e.writeVarUint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) writeVarString(s string) {
+	if !utf8.ValidString(s) {
+		s = string([]rune(s))
+	}
+	e.writeVarUint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) writeRaw(b []byte) {
+	e.buf = append(e.buf, b...)
+}
+
+// writeVarInt 可変長の符号付き整数を書き込む
+func (e *encoder) writeVarInt(num int64) {
+	negative := num < 0
+	abs := uint64(num)
+	if negative {
+		abs = uint64(-num)
+	}
+	b := byte(abs & 0x3f)
+	if negative {
+		b |= 0x40
+	}
+	abs >>= 6
+	if abs > 0 {
+		b |= 0x80
+	}
+	e.writeUint8(b)
+	for abs > 0 {
+		b = byte(abs & 0x7f)
+		abs >>= 7
+		if abs > 0 {
+			b |= 0x80
+		}
+		e.writeUint8(b)
+	}
+}
+
+// writeAny lib0のany形式で値を書き込む（数値の扱いはlib0のwriteAnyと同じ）
+func (e *encoder) writeAny(v any) {
+	switch v := v.(type) {
+	case nil:
+		e.writeUint8(126)
+	case Undefined:
+		e.writeUint8(127)
+	case bool:
+		if v {
+			e.writeUint8(120)
+		} else {
+			e.writeUint8(121)
+		}
+	case int:
+		e.writeNumber(float64(v))
+	case int64:
+		e.writeNumber(float64(v))
+	case float64:
+		e.writeNumber(v)
+	case BigInt64:
+		e.writeUint8(122)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(v))
+	case string:
+		e.writeUint8(119)
+		e.writeVarString(v)
+	case []byte:
+		e.writeUint8(116)
+		e.writeVarUint8Array(v)
+	case []any:
+		e.writeUint8(117)
+		e.writeVarUint(uint64(len(v)))
+		for _, item := range v {
+			e.writeAny(item)
+		}
+	case map[string]any:
+		// 出力を安定させるためキーの順に書き込む
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		e.writeUint8(118)
+		e.writeVarUint(uint64(len(keys)))
+		for _, key := range keys {
+			e.writeVarString(key)
+			e.writeAny(v[key])
+		}
+	default:
+		e.writeUint8(127)
+	}
+}
+
+// writeNumber JavaScriptの数値として書き込む
+func (e *encoder) writeNumber(f float64) {
+	const bits31 = 1<<31 - 1
+	switch {
+	case f == math.Trunc(f) && math.Abs(f) <= bits31:
+		e.writeUint8(125)
+		e.writeVarInt(int64(f))
+	case float64(float32(f)) == f:
+		e.writeUint8(124)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, math.Float32bits(float32(f)))
+	default:
+		e.writeUint8(123)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, math.Float64bits(f))
+	}
+}
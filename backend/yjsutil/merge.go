@@ -0,0 +1,248 @@
+package yjsutil
+
+import "sort"
+
+// MergeUpdates 複数のYjs update（v1形式）を1つのupdateにマージする
+// Y.mergeUpdatesと同様に、同じIDのstructは1つにまとめ、欠けている範囲はSkipで埋める。
+// ドキュメントへの統合（integrate）は行わないため、依存関係が欠けたupdateもそのまま保持される。
+// 削除済みのItemはYjsのgc: trueと同じく内容を捨てるため、同じキーの上書きを繰り返しても大きくならない。
+func MergeUpdates(updates ...[]byte) ([]byte, error) {
+	decoded := make([]*update, 0, len(updates))
+	for _, data := range updates {
+		u, err := decodeUpdate(data)
+		if err != nil {
+			return nil, err
+		}
+		decoded = append(decoded, u)
+	}
+	return mergeDecoded(decoded).encode(), nil
+}
+
+// mergeDecoded デコード済みのupdateをマージする
+func mergeDecoded(updates []*update) *update {
+	merged := &update{structs: make(map[uint64][]*block), ds: make(deleteSet)}
+
+	all := make(map[uint64][]*block)
+	for _, u := range updates {
+		for client, blocks := range u.structs {
+			for _, b := range blocks {
+				// Skipは「不明な範囲」を表すだけなので、マージ後に改めて埋める
+				if b.kind != kindSkip {
+					all[client] = append(all[client], b)
+				}
+			}
+		}
+		for client, ranges := range u.ds {
+			for _, r := range ranges {
+				merged.ds.add(client, r.clock, r.length)
+			}
+		}
+	}
+	merged.ds.normalize()
+
+	for client, blocks := range all {
+		// 同じクロックから始まる場合は長い方を優先する
+		sort.SliceStable(blocks, func(i, j int) bool {
+			if blocks[i].id.Clock != blocks[j].id.Clock {
+				return blocks[i].id.Clock < blocks[j].id.Clock
+			}
+			return blocks[i].length > blocks[j].length
+		})
+
+		var out []*block
+		var next uint64
+		for _, b := range blocks {
+			if len(out) > 0 {
+				if b.end() <= next {
+					// 既に含まれている範囲
+					continue
+				}
+				if b.id.Clock > next {
+					out = append(out, &block{kind: kindSkip, id: ID{Client: client, Clock: next}, length: b.id.Clock - next})
+				} else if b.id.Clock < next {
+					b = b.slice(next - b.id.Clock)
+				}
+			}
+			out = append(out, b)
+			next = b.end()
+		}
+		merged.structs[client] = gcDeleted(out, merged.ds)
+	}
+	return merged
+}
+
+// gcDeleted 削除済みのItemの内容をContentDeletedに置き換える（Yjsのgc: trueと同じ）
+// 一部だけ削除されたItemは削除範囲の境界で分割し、続けて削除されたItemは1つにまとめる。
+// GC structには置き換えない（上書きした値のoriginとして参照されるため、親が生きている間は残す）。
+func gcDeleted(blocks []*block, ds deleteSet) []*block {
+	out := make([]*block, 0, len(blocks))
+	for _, b := range blocks {
+		if b.kind != kindItem {
+			out = appendMerged(out, b)
+			continue
+		}
+		clock, itemEnd := b.id.Clock, b.end()
+		for _, r := range ds[b.id.Client] {
+			start, end := max(r.clock, clock), min(r.clock+r.length, itemEnd)
+			if start >= end {
+				continue
+			}
+			if start > clock {
+				out = appendMerged(out, b.truncate(start-clock))
+				b = b.slice(start - clock)
+			}
+			deleted := b.truncate(end - start)
+			if deleted == b {
+				copied := *b
+				deleted = &copied
+			}
+			deleted.content = contentDeleted{n: end - start}
+			out = appendMerged(out, deleted)
+			clock = end
+			if clock == itemEnd {
+				break
+			}
+			b = b.slice(end - start)
+		}
+		if clock < itemEnd {
+			out = appendMerged(out, b)
+		}
+	}
+	return out
+}
+
+// appendMerged structを追加する。直前のstructと続いた削除済みの範囲であれば1つにまとめる
+func appendMerged(blocks []*block, b *block) []*block {
+	n := len(blocks)
+	if n == 0 || blocks[n-1].end() != b.id.Clock {
+		return append(blocks, b)
+	}
+	last := blocks[n-1]
+	switch {
+	case last.kind == kindGC && b.kind == kindGC:
+	case last.kind == kindItem && b.kind == kindItem && isContentDeleted(last) && isContentDeleted(b) &&
+		b.origin != nil && *b.origin == (ID{Client: last.id.Client, Clock: last.end() - 1}) && sameID(last.rightOrigin, b.rightOrigin):
+	default:
+		return append(blocks, b)
+	}
+	joined := *last
+	joined.length += b.length
+	if joined.kind == kindItem {
+		joined.content = contentDeleted{n: joined.length}
+	}
+	blocks[n-1] = &joined
+	return blocks
+}
+
+func isContentDeleted(b *block) bool {
+	_, ok := b.content.(contentDeleted)
+	return ok
+}
+
+func sameID(a, b *ID) bool {
+	return a == b || (a != nil && b != nil && *a == *b)
+}
+
+// DiffUpdate updateから、state vectorが示す状態に含まれていない差分だけを取り出す
+// 削除セットはすべて含める（Y.diffUpdateと同じ挙動）。
+func DiffUpdate(data []byte, stateVector []byte) ([]byte, error) {
+	u, err := decodeUpdate(data)
+	if err != nil {
+		return nil, err
+	}
+	sv, err := DecodeStateVector(stateVector)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &update{structs: make(map[uint64][]*block), ds: u.ds}
+	for client, blocks := range u.structs {
+		known := sv[client]
+		var out []*block
+		for _, b := range blocks {
+			if b.end() <= known {
+				continue
+			}
+			if len(out) == 0 && b.kind == kindSkip {
+				continue
+			}
+			if b.id.Clock < known {
+				b = b.slice(known - b.id.Clock)
+			}
+			out = append(out, b)
+		}
+		// 末尾のSkipは情報を持たないので取り除く
+		for len(out) > 0 && out[len(out)-1].kind == kindSkip {
+			out = out[:len(out)-1]
+		}
+		if len(out) > 0 {
+			diff.structs[client] = out
+		}
+	}
+	return diff.encode(), nil
+}
+
+// EncodeStateVectorFromUpdate updateが表すドキュメントのstate vectorをエンコードする
+// クロック0から途切れずに続いている範囲だけを既知の状態として扱う。
+func EncodeStateVectorFromUpdate(data []byte) ([]byte, error) {
+	u, err := decodeUpdate(data)
+	if err != nil {
+		return nil, err
+	}
+	return EncodeStateVector(u.stateVector()), nil
+}
+
+// stateVector クライアントごとの既知のクロック
+func (u *update) stateVector() map[uint64]uint64 {
+	sv := make(map[uint64]uint64)
+	for client, blocks := range u.structs {
+		var clock uint64
+		for _, b := range blocks {
+			if b.kind == kindSkip || b.id.Clock != clock {
+				break
+			}
+			clock = b.end()
+		}
+		if clock > 0 {
+			sv[client] = clock
+		}
+	}
+	return sv
+}
+
+// EncodeStateVector state vectorをYjsのバイナリ形式にエンコードする
+func EncodeStateVector(sv map[uint64]uint64) []byte {
+	e := &encoder{}
+	clients := sortedClients(sv)
+	e.writeVarUint(uint64(len(clients)))
+	for _, client := range clients {
+		e.writeVarUint(client)
+		e.writeVarUint(sv[client])
+	}
+	return e.bytes()
+}
+
+// DecodeStateVector Yjsのバイナリ形式のstate vectorをデコードする
+func DecodeStateVector(data []byte) (map[uint64]uint64, error) {
+	sv := make(map[uint64]uint64)
+	if len(data) == 0 {
+		return sv, nil
+	}
+	d := newDecoder(data)
+	n, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < n; i++ {
+		client, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		clock, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		sv[client] = clock
+	}
+	return sv, nil
+}
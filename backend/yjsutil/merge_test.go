@@ -0,0 +1,283 @@
+package yjsutil
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testdata/fixtures.mjsの操作でY.Docが送るv1形式のupdate（同スクリプトで再生成・照合できる）
+var (
+	// clientID 1: getMap("m").set("k", "v")
+	fixtureMapSet = "010101002801016d016b0177017600"
+	// clientID 1: 続けて getMap("m").set("k", "w")（前の値をoriginにして上書きし、削除する）
+	fixtureMapOverwrite = "01010101880100017701770101010001"
+	// clientID 1: 続けて getMap("m").set("k2", "z")
+	fixtureMapSetNext = "010101022801016d026b320177017a00"
+	// clientID 2: getArray("a").insert(0, ["x", "y"])
+	fixtureArrayInsert = "01010200080101610277017877017900"
+	// clientID 3: getText("t").insert(0, "hi")
+	fixtureTextInsert = "010103000401017402686900"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("invalid fixture %q: %v", s, err)
+	}
+	return b
+}
+
+func mustMerge(t *testing.T, updates ...[]byte) []byte {
+	t.Helper()
+	merged, err := MergeUpdates(updates...)
+	if err != nil {
+		t.Fatalf("MergeUpdates: %v", err)
+	}
+	return merged
+}
+
+func TestMergeUpdates(t *testing.T) {
+	tests := []struct {
+		name    string
+		updates []string
+		want    string
+	}{
+		{
+			name:    "single update is unchanged",
+			updates: []string{fixtureMapSet},
+			want:    fixtureMapSet,
+		},
+		{
+			// クライアントIDの降順に並ぶ
+			name:    "different clients",
+			updates: []string{fixtureMapSet, fixtureArrayInsert},
+			want:    "02" + "0102000801016102770178770179" + "0101002801016d016b01770176" + "00",
+		},
+		{
+			// 上書きされた値はContentDeletedになる（Y.encodeStateAsUpdateと同じ）
+			name:    "same client in order",
+			updates: []string{fixtureMapSet, fixtureMapOverwrite},
+			want:    "01" + "020100" + "2101016d016b01" + "88010001770177" + "0101010001",
+		},
+		{
+			name:    "same client out of order",
+			updates: []string{fixtureMapOverwrite, fixtureMapSet},
+			want:    "01" + "020100" + "2101016d016b01" + "88010001770177" + "0101010001",
+		},
+		{
+			name:    "duplicate update",
+			updates: []string{fixtureMapSet, fixtureMapSet},
+			want:    fixtureMapSet,
+		},
+		{
+			// 欠けているclock 1はSkipで埋める
+			name:    "gap is filled with skip",
+			updates: []string{fixtureMapSet, fixtureMapSetNext},
+			want:    "01" + "030100" + "2801016d016b01770176" + "0a01" + "2801016d026b320177017a" + "00",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var updates [][]byte
+			for _, u := range tt.updates {
+				updates = append(updates, mustHex(t, u))
+			}
+			if got := hex.EncodeToString(mustMerge(t, updates...)); got != tt.want {
+				t.Errorf("MergeUpdates = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeUpdatesGCDeletedContent(t *testing.T) {
+	// clientID 3: getText("t").insert(0, "hello") の後に delete(1, 3)
+	insert := mustHex(t, "0101030004010174"+"0568656c6c6f"+"00")
+	remove := mustHex(t, "00"+"0103010103")
+
+	// 一部だけ削除されたItemは分割し、削除された範囲の内容だけを捨てる
+	merged := mustMerge(t, insert, remove)
+	want := "01" + "030300" + "040101740168" + "81030003" + "840303016f" + "0103010103"
+	if got := hex.EncodeToString(merged); got != want {
+		t.Errorf("MergeUpdates = %s, want %s", got, want)
+	}
+	doc, err := DecodeDocument(merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := doc.textValue(parentRef{root: "t", isRoot: true}); got != "ho" {
+		t.Errorf("text = %q, want %q", got, "ho")
+	}
+}
+
+func TestMergeUpdatesOverwriteBounded(t *testing.T) {
+	// clientID 1: getMap("m").set("k", ...) を繰り返す（前の値をoriginにして上書きし、削除する）
+	overwrite := func(clock uint64, value string) []byte {
+		e := &encoder{}
+		e.writeVarUint(1)
+		e.writeVarUint(1)
+		e.writeVarUint(1)
+		e.writeVarUint(clock)
+		e.writeUint8(refAny | 0x80)
+		e.writeVarUint(1)
+		e.writeVarUint(clock - 1)
+		e.writeVarUint(1)
+		e.writeUint8(119)
+		e.writeVarString(value)
+		ds := deleteSet{1: {{clock: clock - 1, length: 1}}}
+		ds.write(e)
+		return e.bytes()
+	}
+
+	state := mustHex(t, fixtureMapSet)
+	var first int
+	for clock := uint64(1); clock <= 1000; clock++ {
+		state = mustMerge(t, state, overwrite(clock, strings.Repeat("x", 100)))
+		if clock == 1 {
+			first = len(state)
+		}
+	}
+	// 上書きされた値は残らないため、上書きの回数によらずクロックの桁数分しか増えない
+	if len(state) > first+4 {
+		t.Errorf("state after 1000 overwrites = %d bytes, after 1 overwrite = %d bytes", len(state), first)
+	}
+	doc, err := DecodeDocument(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := doc.Map("m")["k"]; got != strings.Repeat("x", 100) {
+		t.Errorf("m.k = %v after overwrites", got)
+	}
+}
+
+func TestMergeUpdatesAssociative(t *testing.T) {
+	fixtures := [][]string{
+		{fixtureMapSet, fixtureArrayInsert, fixtureTextInsert},
+		{fixtureMapSet, fixtureMapOverwrite, fixtureArrayInsert},
+		{fixtureMapOverwrite, fixtureTextInsert, fixtureMapSet},
+		{fixtureMapSet, fixtureMapSetNext, fixtureMapOverwrite},
+	}
+	for _, f := range fixtures {
+		a, b, c := mustHex(t, f[0]), mustHex(t, f[1]), mustHex(t, f[2])
+		left := mustMerge(t, mustMerge(t, a, b), c)
+		right := mustMerge(t, a, mustMerge(t, b, c))
+		all := mustMerge(t, a, b, c)
+		if !bytes.Equal(left, right) || !bytes.Equal(left, all) {
+			t.Errorf("merge of %v is not associative:\n(a+b)+c = %x\na+(b+c) = %x\na+b+c   = %x", f, left, right, all)
+		}
+		// 順序にもよらない
+		if reversed := mustMerge(t, c, b, a); !bytes.Equal(reversed, all) {
+			t.Errorf("merge of %v depends on order:\nc+b+a = %x\na+b+c = %x", f, reversed, all)
+		}
+	}
+}
+
+func TestDiffUpdate(t *testing.T) {
+	tests := []struct {
+		name        string
+		update      []string
+		stateVector map[uint64]uint64
+		want        string
+	}{
+		{
+			name:        "empty state vector",
+			update:      []string{fixtureMapSet, fixtureArrayInsert},
+			stateVector: map[uint64]uint64{},
+			want:        "02" + "0102000801016102770178770179" + "0101002801016d016b01770176" + "00",
+		},
+		{
+			name:        "known client is removed",
+			update:      []string{fixtureMapSet, fixtureArrayInsert},
+			stateVector: map[uint64]uint64{2: 2},
+			want:        fixtureMapSet,
+		},
+		{
+			// 削除セットはすべて含める
+			name:        "only structs after the known clock",
+			update:      []string{fixtureMapSet, fixtureMapOverwrite},
+			stateVector: map[uint64]uint64{1: 1},
+			want:        fixtureMapOverwrite,
+		},
+		{
+			name:        "partially known struct is sliced",
+			update:      []string{fixtureArrayInsert},
+			stateVector: map[uint64]uint64{2: 1},
+			// 2つ目の要素だけが、1つ目の要素をoriginとして残る
+			want: "010102018802000177017900",
+		},
+		{
+			name:        "everything is known",
+			update:      []string{fixtureMapSet, fixtureTextInsert},
+			stateVector: map[uint64]uint64{1: 1, 3: 2},
+			want:        "0000",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var updates [][]byte
+			for _, u := range tt.update {
+				updates = append(updates, mustHex(t, u))
+			}
+			diff, err := DiffUpdate(mustMerge(t, updates...), EncodeStateVector(tt.stateVector))
+			if err != nil {
+				t.Fatalf("DiffUpdate: %v", err)
+			}
+			if got := hex.EncodeToString(diff); got != tt.want {
+				t.Errorf("DiffUpdate = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStateVectorRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		updates []string
+		want    map[uint64]uint64
+	}{
+		{"empty update", []string{"0000"}, map[uint64]uint64{}},
+		{"single client", []string{fixtureMapSet, fixtureMapOverwrite}, map[uint64]uint64{1: 2}},
+		{"several clients", []string{fixtureMapSet, fixtureArrayInsert, fixtureTextInsert}, map[uint64]uint64{1: 1, 2: 2, 3: 2}},
+		// Skipより後ろのstructはまだ適用できないので含めない
+		{"gap", []string{fixtureMapSet, fixtureMapSetNext}, map[uint64]uint64{1: 1}},
+		{"missing start", []string{fixtureMapOverwrite}, map[uint64]uint64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var updates [][]byte
+			for _, u := range tt.updates {
+				updates = append(updates, mustHex(t, u))
+			}
+			encoded, err := EncodeStateVectorFromUpdate(mustMerge(t, updates...))
+			if err != nil {
+				t.Fatalf("EncodeStateVectorFromUpdate: %v", err)
+			}
+			if !bytes.Equal(encoded, EncodeStateVector(tt.want)) {
+				t.Errorf("EncodeStateVectorFromUpdate = %x, want %x", encoded, EncodeStateVector(tt.want))
+			}
+			decoded, err := DecodeStateVector(encoded)
+			if err != nil {
+				t.Fatalf("DecodeStateVector: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, tt.want) {
+				t.Errorf("DecodeStateVector = %v, want %v", decoded, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateRoundTrip(t *testing.T) {
+	// デコードしてエンコードし直しても、Yjsが生成したバイト列と一致する
+	for _, f := range []string{fixtureMapSet, fixtureMapOverwrite, fixtureMapSetNext, fixtureArrayInsert, fixtureTextInsert} {
+		u, err := decodeUpdate(mustHex(t, f))
+		if err != nil {
+			t.Fatalf("decodeUpdate(%s): %v", f, err)
+		}
+		if got := hex.EncodeToString(u.encode()); got != f {
+			t.Errorf("round trip of %s = %s", f, got)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package yjsutil
+
+import "strings"
+
+// RedactUpdate update内のany形式の値（オブジェクト）から指定したフィールドを取り除く
+// fieldsは "data.secret" のようにドットで区切ったパスで指定する。
+// structのIDや長さは変えないため、結果は元のupdateとマージ可能なままになる。
+func RedactUpdate(data []byte, fields []string) ([]byte, error) {
+	u, err := decodeUpdate(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return data, nil
+	}
+
+	paths := make([][]string, 0, len(fields))
+	for _, f := range fields {
+		paths = append(paths, strings.Split(f, "."))
+	}
+
+	for _, blocks := range u.structs {
+		for _, b := range blocks {
+			c, ok := b.content.(contentAny)
+			if !ok {
+				continue
+			}
+			vals := make([][]byte, len(c.vals))
+			for i, raw := range c.vals {
+				vals[i] = raw
+				v, err := newDecoder(raw).readAny()
+				if err != nil {
+					continue
+				}
+				obj, ok := v.(map[string]any)
+				if !ok || !redactPaths(obj, paths) {
+					continue
+				}
+				e := &encoder{}
+				e.writeAny(obj)
+				vals[i] = e.bytes()
+			}
+			b.content = contentAny{vals: vals}
+		}
+	}
+	return u.encode(), nil
+}
+
+// redactPaths オブジェクトからパスに一致するフィールドを削除（変更があればtrue）
+func redactPaths(obj map[string]any, paths [][]string) bool {
+	changed := false
+	for _, path := range paths {
+		cur := obj
+		for i, key := range path {
+			if i == len(path)-1 {
+				if _, ok := cur[key]; ok {
+					delete(cur, key)
+					changed = true
+				}
+				break
+			}
+			next, ok := cur[key].(map[string]any)
+			if !ok {
+				break
+			}
+			cur = next
+		}
+	}
+	return changed
+}
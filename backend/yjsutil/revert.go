@@ -0,0 +1,108 @@
+package yjsutil
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+)
+
+// RevertUpdate currentの状態をtargetの状態に戻すupdateを作成する
+// ルートのY.Map（nodesById / edgesByIdなど）のキーごとに、targetと値が異なるものは
+// targetの値を新しく書き込み、targetにないキーは削除する。Y.Arrayなどのシーケンス型は対象外で、
+// ネストしたY.Mapなどの値は通常のオブジェクトとして書き込まれる。
+// 作成されるのは新しいクライアントIDによる通常のupdateなので、currentを持つクライアントにそのまま送信できる。
+func RevertUpdate(current, target []byte) ([]byte, error) {
+	cur, err := DecodeDocument(current)
+	if err != nil {
+		return nil, err
+	}
+	tgt, err := DecodeDocument(target)
+	if err != nil {
+		return nil, err
+	}
+
+	client := newClientID(cur, tgt)
+	u := &update{structs: make(map[uint64][]*block), ds: make(deleteSet)}
+	var clock uint64
+
+	names := append(cur.rootMaps(), tgt.rootMaps()...)
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		p := parentRef{root: name, isRoot: true}
+		items := cur.mapItems(p)
+		want := tgt.mapValue(p)
+
+		keys := make([]string, 0, len(items)+len(want))
+		for key := range items {
+			keys = append(keys, key)
+		}
+		for key := range want {
+			if _, ok := items[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			w := items[key]
+			alive := w != nil && !cur.deleted(w, w.length-1)
+			value, keep := want[key]
+
+			if alive && keep {
+				if values := cur.values(w, w.length-1); len(values) > 0 && reflect.DeepEqual(values[len(values)-1], value) {
+					continue
+				}
+			}
+			// 現在の値を削除する
+			if alive {
+				u.ds.add(w.id.Client, w.end()-1, 1)
+			}
+			if !keep {
+				continue
+			}
+
+			// targetの値を現在の値の右側に書き込む（Y.Map.setと同じ）
+			e := &encoder{}
+			e.writeAny(value)
+			k := key
+			b := &block{
+				kind:      kindItem,
+				id:        ID{Client: client, Clock: clock},
+				length:    1,
+				parentSub: &k,
+				content:   contentAny{vals: [][]byte{e.bytes()}},
+			}
+			if w != nil {
+				b.origin = &ID{Client: w.id.Client, Clock: w.end() - 1}
+			} else {
+				n := name
+				b.parentKey = &n
+			}
+			u.structs[client] = append(u.structs[client], b)
+			clock++
+		}
+	}
+	u.ds.normalize()
+	return u.encode(), nil
+}
+
+// newClientID どちらのドキュメントでも使われていないクライアントIDを選ぶ（Yjsと同じ32bit）
+func newClientID(docs ...*Document) uint64 {
+	for {
+		id := uint64(rand.Uint32())
+		used := false
+		for _, doc := range docs {
+			if _, ok := doc.u.structs[id]; ok {
+				used = true
+			}
+		}
+		if !used {
+			return id
+		}
+	}
+}
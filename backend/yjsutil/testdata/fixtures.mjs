@@ -0,0 +1,38 @@
+// merge_test.goのupdateのフィクスチャを生成する
+//
+//	npm install yjs && node testdata/fixtures.mjs
+import * as Y from "yjs";
+
+const hex = (u) => Buffer.from(u).toString("hex");
+
+function updates(clientID, fn) {
+  const doc = new Y.Doc();
+  doc.clientID = clientID;
+  const out = [];
+  doc.on("update", (u) => out.push(hex(u)));
+  fn(doc);
+  return out;
+}
+
+const [mapSet, mapOverwrite, mapSetNext] = updates(1, (doc) => {
+  doc.getMap("m").set("k", "v");
+  doc.getMap("m").set("k", "w");
+  doc.getMap("m").set("k2", "z");
+});
+// MergeUpdatesは削除済みの内容を捨てるため、上書き後の状態はgc: trueのY.Docの状態と一致する
+const overwritten = new Y.Doc();
+overwritten.clientID = 1;
+overwritten.getMap("m").set("k", "v");
+overwritten.getMap("m").set("k", "w");
+// clientID 3: getText("t").insert(0, "hello") の後に delete(1, 3)
+const text = new Y.Doc();
+text.clientID = 3;
+text.getText("t").insert(0, "hello");
+text.getText("t").delete(1, 3);
+const [arrayInsert] = updates(2, (doc) => doc.getArray("a").insert(0, ["x", "y"]));
+const [textInsert] = updates(3, (doc) => doc.getText("t").insert(0, "hi"));
+
+console.log({ mapSet, mapOverwrite, mapSetNext, arrayInsert, textInsert });
+console.log("mergeAB", hex(Y.mergeUpdates([mapSet, arrayInsert].map((h) => Buffer.from(h, "hex")))));
+console.log("mapOverwriteState", hex(Y.encodeStateAsUpdate(overwritten)));
+console.log("textDeleteState", hex(Y.encodeStateAsUpdate(text)));
@@ -0,0 +1,549 @@
+package yjsutil
+
+import (
+	"fmt"
+	"sort"
+	"unicode/utf16"
+)
+
+// Yjsのstruct/contentの参照番号
+const (
+	refGC      = 0
+	refDeleted = 1
+	refJSON    = 2
+	refBinary  = 3
+	refString  = 4
+	refEmbed   = 5
+	refFormat  = 6
+	refType    = 7
+	refAny     = 8
+	refDoc     = 9
+	refSkip    = 10
+)
+
+// ID Yjsのstruct識別子（クライアントIDと論理クロック）
+type ID struct {
+	Client uint64
+	Clock  uint64
+}
+
+// blockKind structの種類
+type blockKind int
+
+const (
+	kindItem blockKind = iota
+	kindGC
+	kindSkip
+)
+
+// block updateに含まれる1つのstruct（Item / GC / Skip）
+type block struct {
+	kind   blockKind
+	id     ID
+	length uint64
+
+	// 以下はItemのみ
+	origin      *ID
+	rightOrigin *ID
+	parentKey   *string // ルート型の名前
+	parentID    *ID     // ネストした型の場合の親Item
+	parentSub   *string // Y.Mapのキー
+	content     content
+}
+
+// end このstructの次のクロック
+func (b *block) end() uint64 {
+	return b.id.Clock + b.length
+}
+
+// slice 先頭からoffset分を切り落としたstructを返す
+func (b *block) slice(offset uint64) *block {
+	if offset == 0 {
+		return b
+	}
+	n := &block{
+		kind:   b.kind,
+		id:     ID{Client: b.id.Client, Clock: b.id.Clock + offset},
+		length: b.length - offset,
+	}
+	if b.kind == kindItem {
+		n.origin = &ID{Client: b.id.Client, Clock: b.id.Clock + offset - 1}
+		n.rightOrigin = b.rightOrigin
+		n.parentKey = b.parentKey
+		n.parentID = b.parentID
+		n.parentSub = b.parentSub
+		n.content = b.content.splice(offset)
+	}
+	return n
+}
+
+// truncate 先頭からn個分だけを残したstructを返す
+func (b *block) truncate(n uint64) *block {
+	if n >= b.length {
+		return b
+	}
+	t := *b
+	t.length = n
+	if b.kind == kindItem {
+		t.content = b.content.truncate(n)
+	}
+	return &t
+}
+
+func (b *block) write(e *encoder) {
+	switch b.kind {
+	case kindGC:
+		e.writeUint8(refGC)
+		e.writeVarUint(b.length)
+	case kindSkip:
+		e.writeUint8(refSkip)
+		e.writeVarUint(b.length)
+	default:
+		info := b.content.ref() & 0x1f
+		if b.origin != nil {
+			info |= 0x80
+		}
+		if b.rightOrigin != nil {
+			info |= 0x40
+		}
+		if b.parentSub != nil {
+			info |= 0x20
+		}
+		e.writeUint8(info)
+		if b.origin != nil {
+			e.writeVarUint(b.origin.Client)
+			e.writeVarUint(b.origin.Clock)
+		}
+		if b.rightOrigin != nil {
+			e.writeVarUint(b.rightOrigin.Client)
+			e.writeVarUint(b.rightOrigin.Clock)
+		}
+		if b.origin == nil && b.rightOrigin == nil {
+			if b.parentKey != nil {
+				e.writeVarUint(1)
+				e.writeVarString(*b.parentKey)
+			} else {
+				e.writeVarUint(0)
+				e.writeVarUint(b.parentID.Client)
+				e.writeVarUint(b.parentID.Clock)
+			}
+			if b.parentSub != nil {
+				e.writeVarString(*b.parentSub)
+			}
+		}
+		b.content.write(e)
+	}
+}
+
+// content Itemが保持する内容
+type content interface {
+	ref() byte
+	length() uint64
+	// splice 先頭offset分を除いた残りを返す
+	splice(offset uint64) content
+	// truncate 先頭n個分だけを返す
+	truncate(n uint64) content
+	write(e *encoder)
+}
+
+// contentDeleted 削除済み（内容は保持しない）
+type contentDeleted struct {
+	n uint64
+}
+
+func (c contentDeleted) ref() byte                 { return refDeleted }
+func (c contentDeleted) length() uint64            { return c.n }
+func (c contentDeleted) splice(o uint64) content   { return contentDeleted{n: c.n - o} }
+func (c contentDeleted) truncate(n uint64) content { return contentDeleted{n: n} }
+func (c contentDeleted) write(e *encoder)          { e.writeVarUint(c.n) }
+
+// contentJSON JSON文字列の配列（旧形式）
+type contentJSON struct {
+	vals []string
+}
+
+func (c contentJSON) ref() byte                 { return refJSON }
+func (c contentJSON) length() uint64            { return uint64(len(c.vals)) }
+func (c contentJSON) splice(o uint64) content   { return contentJSON{vals: c.vals[o:]} }
+func (c contentJSON) truncate(n uint64) content { return contentJSON{vals: c.vals[:n]} }
+func (c contentJSON) write(e *encoder) {
+	e.writeVarUint(uint64(len(c.vals)))
+	for _, v := range c.vals {
+		e.writeVarString(v)
+	}
+}
+
+// contentString 文字列（長さはUTF-16のコードユニット数）
+type contentString struct {
+	units []uint16
+}
+
+func (c contentString) ref() byte      { return refString }
+func (c contentString) length() uint64 { return uint64(len(c.units)) }
+
+// splice サロゲートペアの途中で分割する場合はYjsと同様にU+FFFDへ置き換える
+func (c contentString) splice(o uint64) content {
+	right := append([]uint16(nil), c.units[o:]...)
+	if o > 0 && utf16.IsSurrogate(rune(c.units[o-1])) && c.units[o-1] < 0xdc00 && len(right) > 0 {
+		right[0] = 0xfffd
+	}
+	return contentString{units: right}
+}
+
+// truncate サロゲートペアの途中で分割する場合は、末尾をspliceと同じくU+FFFDへ置き換える
+func (c contentString) truncate(n uint64) content {
+	left := append([]uint16(nil), c.units[:n]...)
+	if n > 0 && n < uint64(len(c.units)) && utf16.IsSurrogate(rune(left[n-1])) && left[n-1] < 0xdc00 {
+		left[n-1] = 0xfffd
+	}
+	return contentString{units: left}
+}
+
+func (c contentString) write(e *encoder) {
+	e.writeVarString(string(utf16.Decode(c.units)))
+}
+
+// contentAny any形式の値の配列（エンコード済みのまま保持する）
+type contentAny struct {
+	vals [][]byte
+}
+
+func (c contentAny) ref() byte                 { return refAny }
+func (c contentAny) length() uint64            { return uint64(len(c.vals)) }
+func (c contentAny) splice(o uint64) content   { return contentAny{vals: c.vals[o:]} }
+func (c contentAny) truncate(n uint64) content { return contentAny{vals: c.vals[:n]} }
+func (c contentAny) write(e *encoder) {
+	e.writeVarUint(uint64(len(c.vals)))
+	for _, v := range c.vals {
+		e.writeRaw(v)
+	}
+}
+
+// contentRaw 分割できない長さ1のcontent（Binary/Embed/Format/Type/Doc）
+type contentRaw struct {
+	r   byte
+	raw []byte
+}
+
+func (c contentRaw) ref() byte                 { return c.r }
+func (c contentRaw) length() uint64            { return 1 }
+func (c contentRaw) splice(o uint64) content   { return c }
+func (c contentRaw) truncate(n uint64) content { return c }
+func (c contentRaw) write(e *encoder)          { e.writeRaw(c.raw) }
+
+// deleteSet クライアントごとの削除範囲
+type deleteSet map[uint64][]deleteRange
+
+type deleteRange struct {
+	clock  uint64
+	length uint64
+}
+
+// add 削除範囲を追加する
+func (ds deleteSet) add(client, clock, length uint64) {
+	if length == 0 {
+		return
+	}
+	ds[client] = append(ds[client], deleteRange{clock: clock, length: length})
+}
+
+// normalize 削除範囲をソートし、重なりや隣接する範囲をまとめる
+func (ds deleteSet) normalize() {
+	for client, ranges := range ds {
+		sort.Slice(ranges, func(i, j int) bool { return ranges[i].clock < ranges[j].clock })
+		merged := ranges[:0]
+		for _, r := range ranges {
+			if n := len(merged); n > 0 && merged[n-1].clock+merged[n-1].length >= r.clock {
+				if end := r.clock + r.length; end > merged[n-1].clock+merged[n-1].length {
+					merged[n-1].length = end - merged[n-1].clock
+				}
+				continue
+			}
+			merged = append(merged, r)
+		}
+		ds[client] = merged
+	}
+}
+
+// isDeleted IDが削除済みかどうか（normalize済みであること）
+func (ds deleteSet) isDeleted(id ID) bool {
+	ranges := ds[id.Client]
+	i := sort.Search(len(ranges), func(i int) bool { return ranges[i].clock+ranges[i].length > id.Clock })
+	return i < len(ranges) && ranges[i].clock <= id.Clock
+}
+
+func (ds deleteSet) write(e *encoder) {
+	clients := sortedClients(ds)
+	e.writeVarUint(uint64(len(clients)))
+	for _, client := range clients {
+		ranges := ds[client]
+		e.writeVarUint(client)
+		e.writeVarUint(uint64(len(ranges)))
+		for _, r := range ranges {
+			e.writeVarUint(r.clock)
+			e.writeVarUint(r.length)
+		}
+	}
+}
+
+// update デコード済みのYjs update（v1形式）
+type update struct {
+	structs map[uint64][]*block
+	ds      deleteSet
+}
+
+// decodeUpdate v1形式のupdateをデコードする
+func decodeUpdate(data []byte) (*update, error) {
+	d := newDecoder(data)
+	u := &update{structs: make(map[uint64][]*block), ds: make(deleteSet)}
+
+	numClients, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < numClients; i++ {
+		numStructs, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		client, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		clock, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < numStructs; j++ {
+			b, err := readBlock(d, ID{Client: client, Clock: clock})
+			if err != nil {
+				return nil, fmt.Errorf("decode struct %d:%d: %w", client, clock, err)
+			}
+			u.structs[client] = append(u.structs[client], b)
+			clock += b.length
+		}
+	}
+
+	numDsClients, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < numDsClients; i++ {
+		client, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		numDeletes, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < numDeletes; j++ {
+			clock, err := d.readVarUint()
+			if err != nil {
+				return nil, err
+			}
+			length, err := d.readVarUint()
+			if err != nil {
+				return nil, err
+			}
+			u.ds.add(client, clock, length)
+		}
+	}
+	u.ds.normalize()
+
+	for client, blocks := range u.structs {
+		sort.SliceStable(blocks, func(i, j int) bool { return blocks[i].id.Clock < blocks[j].id.Clock })
+		u.structs[client] = blocks
+	}
+	return u, nil
+}
+
+// readBlock 1つのstructを読み込む
+func readBlock(d *decoder, id ID) (*block, error) {
+	info, err := d.readUint8()
+	if err != nil {
+		return nil, err
+	}
+	switch info & 0x1f {
+	case refGC:
+		length, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		return &block{kind: kindGC, id: id, length: length}, nil
+	case refSkip:
+		length, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		return &block{kind: kindSkip, id: id, length: length}, nil
+	}
+
+	b := &block{kind: kindItem, id: id}
+	if info&0x80 != 0 {
+		if b.origin, err = readID(d); err != nil {
+			return nil, err
+		}
+	}
+	if info&0x40 != 0 {
+		if b.rightOrigin, err = readID(d); err != nil {
+			return nil, err
+		}
+	}
+	if info&0xc0 == 0 {
+		isKey, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		if isKey == 1 {
+			key, err := d.readVarString()
+			if err != nil {
+				return nil, err
+			}
+			b.parentKey = &key
+		} else if b.parentID, err = readID(d); err != nil {
+			return nil, err
+		}
+		if info&0x20 != 0 {
+			sub, err := d.readVarString()
+			if err != nil {
+				return nil, err
+			}
+			b.parentSub = &sub
+		}
+	}
+	if b.content, err = readContent(d, info&0x1f); err != nil {
+		return nil, err
+	}
+	b.length = b.content.length()
+	if b.length == 0 {
+		return nil, fmt.Errorf("empty content (ref %d)", info&0x1f)
+	}
+	return b, nil
+}
+
+func readID(d *decoder) (*ID, error) {
+	client, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	clock, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	return &ID{Client: client, Clock: clock}, nil
+}
+
+// readContent contentRefに応じてItemの内容を読み込む
+func readContent(d *decoder, ref byte) (content, error) {
+	switch ref {
+	case refDeleted:
+		n, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		return contentDeleted{n: n}, nil
+	case refJSON:
+		n, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(len(d.buf)) {
+			return nil, ErrUnexpectedEnd
+		}
+		vals := make([]string, 0, n)
+		for i := uint64(0); i < n; i++ {
+			s, err := d.readVarString()
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, s)
+		}
+		return contentJSON{vals: vals}, nil
+	case refString:
+		s, err := d.readVarString()
+		if err != nil {
+			return nil, err
+		}
+		return contentString{units: utf16.Encode([]rune(s))}, nil
+	case refAny:
+		n, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(len(d.buf)) {
+			return nil, ErrUnexpectedEnd
+		}
+		vals := make([][]byte, 0, n)
+		for i := uint64(0); i < n; i++ {
+			raw, err := d.skipAny()
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, raw)
+		}
+		return contentAny{vals: vals}, nil
+	}
+
+	start := d.pos
+	var err error
+	switch ref {
+	case refBinary:
+		_, err = d.readVarUint8Array()
+	case refEmbed:
+		_, err = d.readVarString()
+	case refFormat:
+		if _, err = d.readVarString(); err == nil {
+			_, err = d.readVarString()
+		}
+	case refType:
+		var typeRef uint64
+		if typeRef, err = d.readVarUint(); err == nil && (typeRef == typeXMLElement || typeRef == typeXMLHook) {
+			_, err = d.readVarString()
+		}
+	case refDoc:
+		if _, err = d.readVarString(); err == nil {
+			_, err = d.readAny()
+		}
+	default:
+		return nil, fmt.Errorf("unknown content ref %d", ref)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return contentRaw{r: ref, raw: d.buf[start:d.pos]}, nil
+}
+
+// encode v1形式のupdateとしてエンコードする
+func (u *update) encode() []byte {
+	e := &encoder{}
+	clients := make([]uint64, 0, len(u.structs))
+	for client, blocks := range u.structs {
+		if len(blocks) > 0 {
+			clients = append(clients, client)
+		}
+	}
+	// Yjsと同様にクライアントIDの降順で書き出す
+	sort.Slice(clients, func(i, j int) bool { return clients[i] > clients[j] })
+	e.writeVarUint(uint64(len(clients)))
+	for _, client := range clients {
+		blocks := u.structs[client]
+		e.writeVarUint(uint64(len(blocks)))
+		e.writeVarUint(client)
+		e.writeVarUint(blocks[0].id.Clock)
+		for _, b := range blocks {
+			b.write(e)
+		}
+	}
+	u.ds.write(e)
+	return e.bytes()
+}
+
+func sortedClients[T any](m map[uint64]T) []uint64 {
+	clients := make([]uint64, 0, len(m))
+	for client := range m {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i] < clients[j] })
+	return clients
+}
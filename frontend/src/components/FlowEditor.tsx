@@ -23,6 +23,10 @@ import "reactflow/dist/style.css";
 import * as Y from "yjs";
 import { useYjs } from "../hooks/useYjs";
 import { useYMapSnapshot } from "../hooks/useYMapSnapshot";
+import {
+  sendControlMessage,
+  useControlMessages,
+} from "../hooks/useControlMessages";
 
 // Awareness情報の型定義
 interface AwarenessState {
@@ -57,6 +61,49 @@ function syncListToYMap<T extends { id: string }>(
 export default function FlowEditor() {
   const { ydoc, provider } = useYjs();
 
+  // サーバーからの制御メッセージ（ウェルカムメッセージなど）
+  const { messages: controlMessages, dismiss: dismissControl } =
+    useControlMessages(provider);
+  const welcome = controlMessages.filter((m) => m.type === "welcome").pop();
+  // 図を壊す変更としてサーバーに拒否された（この画面の変更は同期されない）
+  const rejected = controlMessages
+    .filter((m) => m.type === "update-rejected")
+    .pop();
+  // 管理APIから送られたお知らせ
+  const notice = controlMessages.filter((m) => m.type === "notice").pop();
+  const idleWarning = controlMessages
+    .filter((m) => m.type === "idle-warning")
+    .pop();
+  // シングルライターモードの編集権の状態
+  const writerState = controlMessages
+    .filter((m) =>
+      ["writer-granted", "writer-released", "read-only"].includes(m.type)
+    )
+    .pop();
+  // 閲覧のみのトークンで接続している（サーバーは変更を適用しない）
+  const readOnlyAccess = controlMessages.some(
+    (m) => m.type === "access-read-only"
+  );
+  // roomのロック（プレゼンテーションモード）。保持者以外は編集できない
+  const roomLock = controlMessages
+    .filter((m) =>
+      ["room-locked", "room-lock-holder", "room-unlocked"].includes(m.type)
+    )
+    .pop();
+  const editingDisabled = readOnlyAccess || roomLock?.type === "room-locked";
+  // 永続化の縮退モード（サーバーで変更が保存されていない）
+  const persistence = controlMessages
+    .filter((m) =>
+      ["persistence-degraded", "persistence-restored"].includes(m.type)
+    )
+    .pop();
+
+  // 再接続しても同じ変更を送り直して拒否されるため、再読み込みするまで接続しない
+  useEffect(() => {
+    // 外部: y-websocketの自動再接続を止める
+    if (rejected) provider.disconnect();
+  }, [rejected, provider]);
+
   // Yjsの共有マップ（id -> Node/Edge）
   const nodesById = useMemo(() => ydoc.getMap<Node>("nodesById"), [ydoc]);
   const edgesById = useMemo(() => ydoc.getMap<Edge>("edgesById"), [ydoc]);
@@ -256,6 +303,7 @@ export default function FlowEditor() {
       >
         <button
           onClick={addNode}
+          disabled={editingDisabled}
           style={{
             padding: "8px 16px",
             background: "#007bff",
@@ -267,9 +315,131 @@ export default function FlowEditor() {
         >
           ノードを追加
         </button>
+        {readOnlyAccess && (
+          <div style={{ marginTop: "8px", fontSize: "12px", color: "#666" }}>
+            閲覧専用（このトークンでは編集できません）
+          </div>
+        )}
+        {roomLock?.type === "room-locked" && (
+          <div style={{ marginTop: "8px", fontSize: "12px", color: "#666" }}>
+            プレゼンテーション中のため編集できません（{roomLock.message}）
+          </div>
+        )}
+        {roomLock?.type === "room-lock-holder" && (
+          <div style={{ marginTop: "8px", fontSize: "12px", color: "#666" }}>
+            プレゼンテーション中（あなただけが編集できます）
+          </div>
+        )}
         <div style={{ marginTop: "8px", fontSize: "12px", color: "#666" }}>
           ノード数: {nodes.length} | エッジ数: {edges.length}
         </div>
+        {writerState && (
+          <div style={{ marginTop: "8px", fontSize: "12px" }}>
+            {writerState.type === "writer-granted" ? (
+              <>
+                編集権あり{" "}
+                <button
+                  onClick={() =>
+                    sendControlMessage(provider, { type: "release-writer" })
+                  }
+                >
+                  編集権を解放
+                </button>
+              </>
+            ) : (
+              <>
+                {writerState.type === "read-only" ? "閲覧専用" : "編集権は空いています"}{" "}
+                <button
+                  onClick={() =>
+                    sendControlMessage(provider, { type: "request-writer" })
+                  }
+                >
+                  編集権を要求
+                </button>
+              </>
+            )}
+          </div>
+        )}
+        {idleWarning && (
+          <div
+            style={{
+              marginTop: "8px",
+              padding: "6px 8px",
+              fontSize: "12px",
+              background: "#fff3cd",
+              borderRadius: "4px",
+            }}
+          >
+            操作がないため約{Math.ceil((idleWarning.expiresIn ?? 0) / 60)}
+            分後に切断されます{" "}
+            <button
+              onClick={() => {
+                sendControlMessage(provider, { type: "keepalive" });
+                dismissControl("idle-warning");
+              }}
+            >
+              接続を維持
+            </button>
+          </div>
+        )}
+        {persistence?.type === "persistence-degraded" && (
+          <div
+            style={{
+              marginTop: "8px",
+              padding: "6px 8px",
+              fontSize: "12px",
+              background: "#f8d7da",
+              borderRadius: "4px",
+              maxWidth: "280px",
+            }}
+          >
+            サーバーで変更を保存できていません。接続中のユーザー間では同期されますが、サーバーの再起動で失われる可能性があります
+          </div>
+        )}
+        {rejected && (
+          <div
+            style={{
+              marginTop: "8px",
+              padding: "6px 8px",
+              fontSize: "12px",
+              background: "#f8d7da",
+              borderRadius: "4px",
+              maxWidth: "280px",
+            }}
+          >
+            変更がサーバーで拒否されたため、同期を停止しました（{rejected.message}）{" "}
+            <button onClick={() => window.location.reload()}>再読み込み</button>
+          </div>
+        )}
+        {notice?.message && (
+          <div
+            style={{
+              marginTop: "8px",
+              padding: "6px 8px",
+              fontSize: "12px",
+              background: "#fff3cd",
+              borderRadius: "4px",
+              maxWidth: "280px",
+            }}
+          >
+            {notice.message}{" "}
+            <button onClick={() => dismissControl("notice")}>閉じる</button>
+          </div>
+        )}
+        {welcome?.message && (
+          <div
+            style={{
+              marginTop: "8px",
+              padding: "6px 8px",
+              fontSize: "12px",
+              background: "#e7f1ff",
+              borderRadius: "4px",
+              maxWidth: "280px",
+            }}
+          >
+            {welcome.message}
+          </div>
+        )}
       </div>
       {/* 他ユーザーのカーソルを表示 */}
       {Array.from(awarenessStates.entries()).map(([clientId, state]) => {
@@ -332,6 +502,9 @@ export default function FlowEditor() {
         onNodesChange={onNodesChange}
         onEdgesChange={onEdgesChange}
         onConnect={onConnect}
+        nodesDraggable={!editingDisabled}
+        nodesConnectable={!editingDisabled}
+        elementsSelectable={!editingDisabled}
         onInit={onInit}
         onMove={onMove}
         fitView
@@ -0,0 +1,94 @@
+import { useCallback, useEffect, useState } from "react";
+import { WebsocketProvider } from "y-websocket";
+
+// サーバーからの制御メッセージのタイプ（backend/handlers/control.go と対応）
+export const messageControl = 100;
+
+export interface ControlMessage {
+  type: string;
+  message?: string;
+  expiresIn?: number;
+  count?: number;
+}
+
+// lib0のDecoderのうち、ここで使うフィールドのみ
+interface Decoder {
+  arr: Uint8Array;
+  pos: number;
+}
+
+function readVarUint(decoder: Decoder): number {
+  let num = 0;
+  let mult = 1;
+  for (;;) {
+    const b = decoder.arr[decoder.pos++];
+    num += (b & 0x7f) * mult;
+    mult *= 128;
+    if (b < 0x80) return num;
+  }
+}
+
+function readVarString(decoder: Decoder): string {
+  const len = readVarUint(decoder);
+  const bytes = decoder.arr.subarray(decoder.pos, decoder.pos + len);
+  decoder.pos += len;
+  return new TextDecoder().decode(bytes);
+}
+
+function writeVarUint(out: number[], num: number) {
+  while (num > 0x7f) {
+    out.push(0x80 | (num & 0x7f));
+    num = Math.floor(num / 128);
+  }
+  out.push(num);
+}
+
+// サーバーに制御メッセージを送信する（編集権の要求・解放など）
+export function sendControlMessage(
+  provider: WebsocketProvider,
+  msg: ControlMessage
+) {
+  const payload = new TextEncoder().encode(JSON.stringify(msg));
+  const out: number[] = [];
+  writeVarUint(out, messageControl);
+  writeVarUint(out, payload.length);
+  const buf = new Uint8Array(out.length + payload.length);
+  buf.set(out);
+  buf.set(payload, out.length);
+  if (provider.ws && provider.ws.readyState === WebSocket.OPEN) {
+    provider.ws.send(buf);
+  }
+}
+
+// サーバーからの制御メッセージ（ウェルカムメッセージなど）を購読する
+export function useControlMessages(provider: WebsocketProvider) {
+  const [messages, setMessages] = useState<ControlMessage[]>([]);
+
+  useEffect(() => {
+    // 外部: y-websocketのメッセージハンドラーに制御メッセージの処理を登録する
+    const handlers = provider.messageHandlers as unknown[];
+    handlers[messageControl] = (_encoder: unknown, decoder: Decoder) => {
+      try {
+        const msg = JSON.parse(readVarString(decoder)) as ControlMessage;
+        // 永続化のACKは頻繁に届くため最新の1件だけを保持する
+        setMessages((prev) =>
+          msg.type === "persisted"
+            ? [...prev.filter((m) => m.type !== "persisted"), msg]
+            : [...prev, msg]
+        );
+      } catch (err) {
+        console.error("Invalid control message:", err);
+      }
+    };
+    return () => {
+      delete handlers[messageControl];
+    };
+  }, [provider]);
+
+  // 指定したタイプのメッセージを取り除く（表示を閉じる）
+  const dismiss = useCallback((type: string) => {
+    setMessages((prev) => prev.filter((m) => m.type !== type));
+  }, []);
+
+  return { messages, dismiss };
+}
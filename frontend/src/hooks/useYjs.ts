@@ -8,10 +8,21 @@ export function useYjs(roomName: string = "reactflow-room") {
 
   // WebSocketプロバイダーをメモ化
   const provider = useMemo(() => {
+    const search = new URLSearchParams(window.location.search);
+    const params: Record<string, string> = {};
+    // roomのトークン（サーバーでROOM_TOKEN_SECRETが設定されている場合に必要）
+    const token = search.get("token");
+    if (token) params.token = token;
+    // ?mode=readonly で開いた場合は閲覧のみで接続する（ダッシュボードへの埋め込みなど）
+    if (search.get("mode") === "readonly") params.mode = "readonly";
+    // ページと同じホストに接続する（HTTPSで配信している場合はwss）
+    // 開発時はViteのプロキシがバックエンドに転送する
+    const scheme = window.location.protocol === "https:" ? "wss" : "ws";
     const wsProvider = new WebsocketProvider(
-      "ws://localhost:8080/ws",
+      `${scheme}://${window.location.host}/ws`,
       roomName,
-      ydoc
+      ydoc,
+      { params }
     );
 
     // 接続状態のログ